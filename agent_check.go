@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/film42/pgreba/config"
+)
+
+// How long a single agent-check exchange may take.
+const agentCheckTimeout = 5 * time.Second
+
+// Serves HAProxy's agent-check protocol: each connection is sent one line
+// such as "ready up 80%" and closed.
+type agentCheckServer struct {
+	dataSource  ReplicationDataSource
+	getConfig   func() *config.Config
+	maintenance *maintenanceMode
+	listener    net.Listener
+}
+
+func newAgentCheckServer(address string, dataSource ReplicationDataSource, getConfig func() *config.Config, maintenance *maintenanceMode) (*agentCheckServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	return &agentCheckServer{dataSource: dataSource, getConfig: getConfig, maintenance: maintenance, listener: listener}, nil
+}
+
+// Accepts connections until Close is called.
+func (acs *agentCheckServer) Serve() error {
+	for {
+		conn, err := acs.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go acs.handle(conn)
+	}
+}
+
+func (acs *agentCheckServer) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(agentCheckTimeout))
+
+	reply := ""
+	if maintenance := acs.maintenance.Current(); maintenance != nil {
+		reply = agentCheckMaintenanceReply(maintenance, acs.getConfig())
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), agentCheckTimeout)
+		defer cancel()
+		nodeInfo, err := acs.dataSource.GetNodeStatus(ctx)
+		reply = agentCheckReply(nodeInfo, err, acs.getConfig())
+	}
+	slog.Debug("Agent check", "reply", reply)
+	if _, err := fmt.Fprintf(conn, "%s\n", reply); err != nil {
+		slog.Error("Error writing agent-check reply", "error", err)
+	}
+}
+
+func (acs *agentCheckServer) Addr() net.Addr {
+	return acs.listener.Addr()
+}
+
+func (acs *agentCheckServer) Close() error {
+	return acs.listener.Close()
+}
+
+// The agent-check reply for a replica: down when it isn't one, drain when
+// replay is paused or lag reached a maximum, and otherwise up with a weight
+// which shrinks as lag grows. HAProxy logs the text after "#". Drain and
+// maint are administrative states which HAProxy keeps until told "ready".
+func agentCheckReply(nodeInfo *NodeInfo, err error, cfg *config.Config) string {
+	if err != nil {
+		return "down #" + err.Error()
+	}
+	if !nodeInfo.IsReplica() {
+		return "down #not a replica"
+	}
+	if nodeInfo.Xlog.Paused {
+		return "drain #wal replay is paused"
+	}
+
+	weight := 1.0
+	if cfg.AgentCheckMaxByteLag > 0 {
+		weight = math.Min(weight, 1-float64(nodeInfo.ByteLag)/float64(cfg.AgentCheckMaxByteLag))
+	}
+	if cfg.AgentCheckMaxLagSeconds > 0 && nodeInfo.LagSeconds.Valid {
+		weight = math.Min(weight, 1-nodeInfo.LagSeconds.Float64/cfg.AgentCheckMaxLagSeconds)
+	}
+	if weight <= 0 {
+		return "drain #replica lag reached the maximum"
+	}
+
+	// Never report 0%, which HAProxy treats like drain.
+	return fmt.Sprintf("ready up %d%%", int(math.Max(1, math.Ceil(weight*100))))
+}
+
+func agentCheckMaintenanceReply(maintenance *Maintenance, cfg *config.Config) string {
+	state := cfg.AgentCheckMaintenanceState
+	if len(state) == 0 {
+		state = "drain"
+	}
+	// The reason must stay on one line.
+	return state + " #maintenance: " + strings.Join(strings.Fields(maintenance.Reason), " ")
+}
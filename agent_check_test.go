@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/film42/pgreba/config"
+	"gopkg.in/volatiletech/null.v6"
+)
+
+func TestAgentCheckReply(t *testing.T) {
+	cfg := &config.Config{AgentCheckMaxByteLag: 1000, AgentCheckMaxLagSeconds: 10}
+	replica := func(byteLag int64, lagSeconds null.Float64, paused bool) *NodeInfo {
+		return &NodeInfo{Role: "replica", ByteLag: byteLag, LagSeconds: lagSeconds, Xlog: &XlogInfo{Paused: paused}}
+	}
+
+	tests := []struct {
+		name     string
+		nodeInfo *NodeInfo
+		err      error
+		cfg      *config.Config
+		expected string
+	}{
+		{"error", nil, errors.New("connection refused"), cfg, "down #connection refused"},
+		{"primary", &NodeInfo{Role: "primary", Xlog: &XlogInfo{}}, nil, cfg, "down #not a replica"},
+		{"paused", replica(0, null.Float64From(0), true), nil, cfg, "drain #wal replay is paused"},
+		{"caught up", replica(0, null.Float64From(0), false), nil, cfg, "ready up 100%"},
+		{"byte lag", replica(250, null.Float64From(0), false), nil, cfg, "ready up 75%"},
+		{"worst lag wins", replica(250, null.Float64From(6), false), nil, cfg, "ready up 40%"},
+		{"unknown lag seconds", replica(100, null.Float64{}, false), nil, cfg, "ready up 90%"},
+		{"barely under max", replica(999, null.Float64From(0), false), nil, cfg, "ready up 1%"},
+		{"at max", replica(1000, null.Float64From(0), false), nil, cfg, "drain #replica lag reached the maximum"},
+		{"scaling disabled", replica(5000, null.Float64From(60), false), nil, &config.Config{}, "ready up 100%"},
+	}
+	for _, test := range tests {
+		reply := agentCheckReply(test.nodeInfo, test.err, test.cfg)
+		if reply != test.expected {
+			t.Fatalf("%s: expected %q but found %q", test.name, test.expected, reply)
+		}
+	}
+}
+
+func TestAgentCheckMaintenanceReply(t *testing.T) {
+	maintenance := &Maintenance{Reason: "patching\nkernel"}
+	if reply := agentCheckMaintenanceReply(maintenance, &config.Config{}); reply != "drain #maintenance: patching kernel" {
+		t.Fatalf("Unexpected reply: %q", reply)
+	}
+	cfg := &config.Config{AgentCheckMaintenanceState: "maint"}
+	if reply := agentCheckMaintenanceReply(maintenance, cfg); reply != "maint #maintenance: patching kernel" {
+		t.Fatalf("Unexpected reply: %q", reply)
+	}
+}
+
+func TestAgentCheckServer(t *testing.T) {
+	fds := &fakeDataSource{role: "replica", byteLag: 500}
+	cfg := &config.Config{AgentCheckMaxByteLag: 1000}
+	acs, err := newAgentCheckServer("127.0.0.1:0", fds, func() *config.Config { return cfg }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- acs.Serve() }()
+
+	conn, err := net.Dial("tcp", acs.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "ready up 50%\n" {
+		t.Fatalf("Unexpected reply: %q", reply)
+	}
+
+	acs.Close()
+	if err := <-done; err != nil {
+		t.Fatal("Expected Serve to return cleanly after Close but found:", err)
+	}
+}
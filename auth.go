@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/film42/pgreba/config"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// How many verified basic auth credentials are remembered.
+const maxVerifiedCredentials = 1000
+
+var ErrInvalidCredentials = errors.New("err: invalid credentials")
+
+type principalContextKey struct{}
+
+type profileLimitContextKey struct{}
+
+// Who made a request.
+type principal struct {
+	Name string
+	// One of token, basic or certificate.
+	Method string
+}
+
+// The caller authenticated by the auth middleware, or nil for anonymous
+// requests.
+func requestPrincipal(r *http.Request) *principal {
+	p, _ := r.Context().Value(principalContextKey{}).(*principal)
+	return p
+}
+
+// The most detail the health checks may give the caller, or empty when the
+// caller isn't limited.
+func requestProfileLimit(r *http.Request) string {
+	limit, _ := r.Context().Value(profileLimitContextKey{}).(string)
+	return limit
+}
+
+// Authenticates requests and checks them against the auth rules.
+type authenticator struct {
+	mutex     sync.Mutex
+	cfg       *config.AuthConfig
+	instances map[string]bool
+	// Basic auth credentials which passed bcrypt, so a load balancer
+	// checking every few seconds doesn't pay for it each time.
+	verified map[[sha256.Size]byte]bool
+}
+
+func newAuthenticator(cfg *config.Config) *authenticator {
+	a := &authenticator{instances: make(map[string]bool)}
+	for _, instance := range cfg.Instances() {
+		if len(instance.Name) > 0 {
+			a.instances[instance.Name] = true
+		}
+	}
+	a.setConfig(cfg)
+	return a
+}
+
+func (a *authenticator) setConfig(cfg *config.Config) {
+	a.cfg = cfg.Auth
+	a.verified = make(map[[sha256.Size]byte]bool)
+}
+
+// Swaps in reloaded credentials and rules.
+func (a *authenticator) reload(cfg *config.Config) {
+	if cfg.Auth == nil {
+		slog.Warn("Config reloaded: auth is only removed after a restart")
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.setConfig(cfg)
+}
+
+func (a *authenticator) getConfig() *config.AuthConfig {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.cfg
+}
+
+// Returns nil without an error for requests without credentials.
+func (a *authenticator) authenticate(r *http.Request) (*principal, error) {
+	cfg := a.getConfig()
+
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cert := r.TLS.PeerCertificates[0]
+		names := append([]string{cert.Subject.CommonName}, cert.DNSNames...)
+		names = append(names, cert.EmailAddresses...)
+		for _, ip := range cert.IPAddresses {
+			names = append(names, ip.String())
+		}
+		for _, uri := range cert.URIs {
+			names = append(names, uri.String())
+		}
+		for _, name := range names {
+			for _, allowed := range cfg.ClientCertificates {
+				if len(name) > 0 && name == allowed {
+					return &principal{Name: name, Method: "certificate"}, nil
+				}
+			}
+		}
+	}
+
+	authorization := r.Header.Get("Authorization")
+	if len(authorization) == 0 {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(authorization, "Bearer ") {
+		given := []byte(strings.TrimPrefix(authorization, "Bearer "))
+		for _, token := range cfg.Tokens {
+			if subtle.ConstantTimeCompare(given, []byte(token.Token)) == 1 {
+				return &principal{Name: token.Name, Method: "token"}, nil
+			}
+		}
+		return nil, ErrInvalidCredentials
+	}
+
+	if username, password, ok := r.BasicAuth(); ok {
+		for _, user := range cfg.Users {
+			if user.Name == username && a.verifyPassword(user, password) {
+				return &principal{Name: user.Name, Method: "basic"}, nil
+			}
+		}
+	}
+	return nil, ErrInvalidCredentials
+}
+
+func (a *authenticator) verifyPassword(user config.AuthUser, password string) bool {
+	key := sha256.Sum256([]byte(user.Name + "\x00" + user.PasswordHash + "\x00" + password))
+	a.mutex.Lock()
+	verified := a.verified[key]
+	a.mutex.Unlock()
+	if verified {
+		return true
+	}
+
+	if bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) != nil {
+		return false
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if len(a.verified) >= maxVerifiedCredentials {
+		a.verified = make(map[[sha256.Size]byte]bool)
+	}
+	a.verified[key] = true
+	return true
+}
+
+// Rules are written relative to the instance, so /main/replica is checked
+// as /replica.
+func (a *authenticator) rulePath(requestPath string) string {
+	trimmed := strings.TrimPrefix(requestPath, "/")
+	instance := strings.SplitN(trimmed, "/", 2)[0]
+	if !a.instances[instance] {
+		return requestPath
+	}
+	return "/" + strings.TrimPrefix(strings.TrimPrefix(trimmed, instance), "/")
+}
+
+// Rejects requests with bad credentials with a 401, and requests the
+// matching rule doesn't let through with a 401 or, when the caller is
+// authenticated but not allowed, a 403. Anonymous requests which get through
+// are limited to anonymous_response_profile.
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := a.authenticate(r)
+		if err != nil {
+			a.unauthorized(w, err)
+			return
+		}
+
+		cfg := a.getConfig()
+		rule := cfg.Rule(a.rulePath(r.URL.Path), r.Method)
+		if rule == nil || !rule.Anonymous {
+			if p == nil {
+				a.unauthorized(w, errors.New("err: credentials required"))
+				return
+			}
+			if rule != nil && !rule.Allows(p.Name) {
+				http.Error(w, "err: "+p.Name+" may not "+r.Method+" "+r.URL.Path, http.StatusForbidden)
+				return
+			}
+		}
+
+		if p != nil {
+			r = r.WithContext(context.WithValue(r.Context(), principalContextKey{}, p))
+		} else {
+			r = r.WithContext(context.WithValue(r.Context(), profileLimitContextKey{}, cfg.AnonymousProfile()))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *authenticator) unauthorized(w http.ResponseWriter, err error) {
+	if len(a.getConfig().Users) > 0 {
+		w.Header().Set("WWW-Authenticate", `Basic realm="pgreba"`)
+	} else {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="pgreba"`)
+	}
+	http.Error(w, err.Error(), http.StatusUnauthorized)
+}
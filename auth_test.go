@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/film42/pgreba/config"
+	"github.com/gorilla/mux"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestAuthMiddleware(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("hunter2"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &config.Config{
+		Auth: &config.AuthConfig{
+			Tokens:             []config.AuthToken{{Name: "ops", Token: "0123456789abcdef"}},
+			Users:              []config.AuthUser{{Name: "prometheus", PasswordHash: string(hash)}},
+			ClientCertificates: []string{"haproxy.example.com"},
+			Rules: append([]config.AuthRule{
+				{Paths: []string{"/maintenance"}, Methods: []string{"POST", "DELETE"}, Allow: []string{"ops"}},
+			}, config.DefaultAuthRules...),
+		},
+	}
+	auth := newAuthenticator(cfg)
+	auth.instances["main"] = true
+
+	router := mux.NewRouter()
+	router.Use(auth.middleware)
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		if p := requestPrincipal(r); p != nil {
+			w.Write([]byte(p.Name))
+		}
+	}
+	router.HandleFunc("/replica", handler)
+	router.HandleFunc("/main/replica", handler)
+	router.HandleFunc("/topology", handler)
+	router.HandleFunc("/maintenance", handler)
+
+	cert := &x509.Certificate{Subject: pkix.Name{CommonName: "client"}, DNSNames: []string{"haproxy.example.com"}}
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		authorization string
+		basic         []string
+		cert          *x509.Certificate
+		status        int
+		principal     string
+	}{
+		{"anonymous health check", "GET", "/replica", "", nil, nil, 200, ""},
+		{"anonymous health check of an instance", "HEAD", "/main/replica", "", nil, nil, 200, ""},
+		{"anonymous detail", "GET", "/topology", "", nil, nil, 401, ""},
+		{"token", "GET", "/topology", "Bearer 0123456789abcdef", nil, nil, 200, "ops"},
+		{"wrong token", "GET", "/replica", "Bearer nope", nil, nil, 401, ""},
+		{"basic", "GET", "/topology", "", []string{"prometheus", "hunter2"}, nil, 200, "prometheus"},
+		{"basic again", "GET", "/topology", "", []string{"prometheus", "hunter2"}, nil, 200, "prometheus"},
+		{"wrong password", "GET", "/topology", "", []string{"prometheus", "hunter3"}, nil, 401, ""},
+		{"certificate", "GET", "/topology", "", nil, cert, 200, "haproxy.example.com"},
+		{"unlisted certificate", "GET", "/topology", "", nil, &x509.Certificate{Subject: pkix.Name{CommonName: "other"}}, 401, ""},
+		{"allowed", "POST", "/maintenance", "Bearer 0123456789abcdef", nil, nil, 200, "ops"},
+		{"not allowed", "POST", "/maintenance", "", []string{"prometheus", "hunter2"}, nil, 403, ""},
+		{"no rule", "GET", "/maintenance", "", []string{"prometheus", "hunter2"}, nil, 200, "prometheus"},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, test.path, nil)
+		if len(test.authorization) > 0 {
+			r.Header.Set("Authorization", test.authorization)
+		}
+		if test.basic != nil {
+			r.SetBasicAuth(test.basic[0], test.basic[1])
+		}
+		if test.cert != nil {
+			r.TLS = &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{test.cert},
+				VerifiedChains:   [][]*x509.Certificate{{test.cert}},
+			}
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		if w.Code != test.status {
+			t.Fatalf("%s: expected a %d but found %d: %s", test.name, test.status, w.Code, w.Body.String())
+		}
+		if w.Code == 200 && w.Body.String() != test.principal {
+			t.Fatalf("%s: expected principal %q but found %q", test.name, test.principal, w.Body.String())
+		}
+		if w.Code == 401 && w.Header().Get("WWW-Authenticate") != `Basic realm="pgreba"` {
+			t.Fatalf("%s: expected a WWW-Authenticate header", test.name)
+		}
+	}
+}
+
+func TestAuthRejectsMaintenanceToken(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.Host = "localhost"
+	cfg.Database = "postgres"
+	cfg.User = "postgres"
+	cfg.MaintenanceFile = filepath.Join(t.TempDir(), "maintenance")
+	cfg.MaintenanceToken = "fedcba9876543210"
+	cfg.Auth = &config.AuthConfig{Tokens: []config.AuthToken{{Name: "ops", Token: "0123456789abcdef"}}}
+
+	// The middleware would turn maintenance_token away before it reached
+	// /maintenance, so the combination is refused up front.
+	auth := newAuthenticator(cfg)
+	router := mux.NewRouter()
+	router.Use(auth.middleware)
+	router.HandleFunc("/maintenance", func(w http.ResponseWriter, r *http.Request) {}).Methods("POST")
+	r := httptest.NewRequest("POST", "/maintenance", nil)
+	r.Header.Set("Authorization", "Bearer "+cfg.MaintenanceToken)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != 401 {
+		t.Fatalf("Expected maintenance_token to get a 401 but found %d", w.Code)
+	}
+
+	err := cfg.Validate()
+	if err == nil || !strings.Contains(err.Error(), "maintenance_token can't be used with auth") {
+		t.Fatal("Expected maintenance_token with auth to be invalid but found:", err)
+	}
+	cfg.MaintenanceToken = ""
+	if err := cfg.Validate(); err != nil {
+		t.Fatal("Expected a valid config but found:", err)
+	}
+}
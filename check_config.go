@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/film42/pgreba/config"
+	"github.com/jmoiron/sqlx"
+)
+
+// A privilege or connectivity check run by check-config -connect.
+type configCheck struct {
+	name string
+	run  func(db *sqlx.DB) error
+}
+
+var configChecks = []configCheck{
+	{"pg_read_file (reading recovery.conf)", func(db *sqlx.DB) error {
+		var version string
+		return db.Get(&version, "SELECT pg_catalog.pg_read_file('PG_VERSION')")
+	}},
+	{"pg_stat_replication visibility", func(db *sqlx.DB) error {
+		// Without superuser or pg_read_all_stats the rows are still
+		// returned, but with every interesting column nulled out.
+		var visible bool
+		err := db.Get(&visible, `
+SELECT rolsuper OR pg_catalog.pg_has_role(current_user, 'pg_read_all_stats', 'member')
+FROM pg_catalog.pg_roles
+WHERE rolname = current_user
+`)
+		if err != nil {
+			return err
+		}
+		if !visible {
+			return fmt.Errorf("role needs superuser or pg_read_all_stats (e.g. via pg_monitor)")
+		}
+		return nil
+	}},
+	{"pg_authid access", func(db *sqlx.DB) error {
+		var count int64
+		return db.Get(&count, "SELECT count(*) FROM pg_catalog.pg_authid")
+	}},
+}
+
+// Runs `pgreba check-config [-connect] <file>`: loads the config the same way
+// the server would, validates it and optionally tests the database
+// connection and privileges. Returns the process exit code.
+func runCheckConfig(args []string) int {
+	flagSet := flag.NewFlagSet("check-config", flag.ExitOnError)
+	connect := flagSet.Bool("connect", false, "Also test connectivity and required privileges.")
+	flagSet.Usage = func() {
+		fmt.Fprintln(flagSet.Output(), "Usage: pgreba check-config [-connect] path/to/config.yml")
+		flagSet.PrintDefaults()
+	}
+	flagSet.Parse(args)
+
+	if flagSet.NArg() != 1 {
+		flagSet.Usage()
+		return 2
+	}
+
+	cfg, err := config.Load(flagSet.Arg(0), os.Environ(), nil)
+	if err != nil {
+		fmt.Println("Error loading config:", err)
+		return 1
+	}
+	if err := cfg.Validate(); err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	fmt.Println("Config OK")
+
+	if !*connect {
+		return 0
+	}
+
+	failed := false
+	for _, instance := range cfg.Instances() {
+		if len(instance.Name) > 0 {
+			fmt.Println("Instance", instance.Name)
+		}
+		if !checkConnection(instance.Config) {
+			failed = true
+		}
+	}
+
+	if failed {
+		return 1
+	}
+	return 0
+}
+
+// Prints the result of each connectivity and privilege check, returning
+// whether they all passed.
+func checkConnection(cfg *config.Config) bool {
+	db, err := sqlConnect(context.Background(), localConnInfo(cfg))
+	if err != nil {
+		fmt.Println("FAIL connect:", err)
+		return false
+	}
+	defer db.Close()
+	fmt.Println("OK   connect")
+
+	passed := true
+	for _, check := range configChecks {
+		if err := check.run(db); err != nil {
+			fmt.Printf("FAIL %s: %v\n", check.name, err)
+			passed = false
+			continue
+		}
+		fmt.Println("OK  ", check.name)
+	}
+	return passed
+}
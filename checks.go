@@ -1,13 +1,20 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"time"
+	"fmt"
 )
 
 var (
 	ErrReplicationSlotNotFound   = errors.New("replication slot not found")
-	ErrReplicationSlotLagTooHigh = errors.New("replication lag is too high")
+	ErrReplicationSlotInactive   = errors.New("replication slot is inactive")
+	ErrReplicationSlotUnreserved = errors.New("replication slot wal_status is unreserved")
+	ErrReplicationSlotLost       = errors.New("replication slot wal_status is lost")
+	ErrSubscriptionNotFound      = errors.New("subscription not found")
+	ErrSubscriptionWorkerDown    = errors.New("subscription apply worker is not running")
+	ErrTimelineDiverged          = errors.New("replica timeline differs from the upstream's")
+	ErrWalDiverged               = errors.New("replica received wal beyond the upstream's current location, pg_rewind is needed")
 )
 
 type HealthChecker struct {
@@ -20,45 +27,148 @@ func NewHealthChecker(dataSource ReplicationDataSource) *HealthChecker {
 	}
 }
 
-func (hc *HealthChecker) isInRecovery() (bool, error) {
-	return hc.dataSource.IsInRecovery()
+// Byte thresholds for a replication slot. Zero disables a check.
+type SlotThresholds struct {
+	MinSafeWalSize      int64
+	MaxRetainedWalBytes int64
 }
 
-func (hc *HealthChecker) getStatReplicationByName(slotName string) (*PgStatReplication, error) {
-	stats, err := hc.dataSource.GetPgStatReplication()
+// Thresholds for logical replication. Zero disables a check.
+type LogicalThresholds struct {
+	MaxByteLag             int64
+	MaxLagSeconds          float64
+	MaxLatestEndAgeSeconds float64
+}
+
+func (hc *HealthChecker) isInRecovery(ctx context.Context) (bool, error) {
+	return hc.dataSource.IsInRecovery(ctx)
+}
+
+func (hc *HealthChecker) getReplicationSlotByName(ctx context.Context, slotName string) (*PgReplicationSlot, error) {
+	slots, err := hc.dataSource.GetPgReplicationSlots(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, stat := range stats {
-		if stat.ApplicationName == slotName {
-			return stat, nil
+	for _, slot := range slots {
+		if slot.SlotName == slotName {
+			return slot, nil
 		}
 	}
 
 	return nil, nil
 }
 
-// A healthy database replica is:
-// 1. Online and accepting connections.
-// 2. Is actively replicating from the upstream DB.
-// 3. Has a lag of <= 1 second.
-func (hc *HealthChecker) CheckReplicationSlot(slotName string) error {
-	statReplication, err := hc.getStatReplicationByName(slotName)
+// A healthy replication slot:
+// 1. Exists and is active.
+// 2. Has not had its WAL removed or marked for removal (wal_status).
+// 3. Has at least MinSafeWalSize bytes left before it would be lost.
+// 4. Holds back no more than MaxRetainedWalBytes of WAL.
+func (hc *HealthChecker) CheckReplicationSlot(ctx context.Context, slotName string, thresholds SlotThresholds) error {
+	slot, err := hc.getReplicationSlotByName(ctx, slotName)
 	if err != nil {
 		return err
 	}
 
-	// NOTE: It would be nice to differentiate between not found and inactive.
-	// But, is it worth an extra query?
-	if statReplication == nil {
+	if slot == nil {
 		return ErrReplicationSlotNotFound
 	}
 
-	if statReplication.LagFromUpstream() > time.Second {
-		return ErrReplicationSlotLagTooHigh
+	return checkReplicationSlot(slot, thresholds)
+}
+
+func checkReplicationSlot(slot *PgReplicationSlot, thresholds SlotThresholds) error {
+	if !slot.Active {
+		return ErrReplicationSlotInactive
+	}
+
+	// wal_status is only reported on pg13+.
+	switch slot.WalStatus.String {
+	case "unreserved":
+		return ErrReplicationSlotUnreserved
+	case "lost":
+		return ErrReplicationSlotLost
+	}
+
+	if thresholds.MinSafeWalSize > 0 && slot.SafeWalSize.Valid && slot.SafeWalSize.Int64 < thresholds.MinSafeWalSize {
+		return fmt.Errorf("replication slot safe_wal_size %d is below %d", slot.SafeWalSize.Int64, thresholds.MinSafeWalSize)
+	}
+
+	if thresholds.MaxRetainedWalBytes > 0 && slot.RetainedWalBytes.Valid && slot.RetainedWalBytes.Int64 > thresholds.MaxRetainedWalBytes {
+		return fmt.Errorf("replication slot retains %d bytes of wal which exceeds %d", slot.RetainedWalBytes.Int64, thresholds.MaxRetainedWalBytes)
+	}
+
+	// The slot is healthy.
+	return nil
+}
+
+func (hc *HealthChecker) getSubscriptionByName(ctx context.Context, subName string) (*PgStatSubscription, error) {
+	subscriptions, err := hc.dataSource.GetPgStatSubscription(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, subscription := range subscriptions {
+		if subscription.SubName == subName {
+			return subscription, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// A healthy subscription has a running apply worker that is within the apply
+// lag thresholds and has recently reported its progress to the publisher.
+func checkSubscription(subscription *PgStatSubscription, thresholds LogicalThresholds) error {
+	if !subscription.Pid.Valid {
+		return ErrSubscriptionWorkerDown
+	}
+
+	if thresholds.MaxByteLag > 0 && subscription.ApplyLagBytes.Valid && subscription.ApplyLagBytes.Int64 > thresholds.MaxByteLag {
+		return fmt.Errorf("subscription apply lag %d bytes exceeds %d", subscription.ApplyLagBytes.Int64, thresholds.MaxByteLag)
+	}
+
+	if thresholds.MaxLagSeconds > 0 && subscription.ApplyLagSeconds.Valid && subscription.ApplyLagSeconds.Float64 > thresholds.MaxLagSeconds {
+		return fmt.Errorf("subscription apply lag %.3fs exceeds %.3fs", subscription.ApplyLagSeconds.Float64, thresholds.MaxLagSeconds)
+	}
+
+	if thresholds.MaxLatestEndAgeSeconds > 0 && subscription.LatestEndAgeSeconds.Valid && subscription.LatestEndAgeSeconds.Float64 > thresholds.MaxLatestEndAgeSeconds {
+		return fmt.Errorf("subscription latest_end_lsn age %.3fs exceeds %.3fs", subscription.LatestEndAgeSeconds.Float64, thresholds.MaxLatestEndAgeSeconds)
+	}
+
+	// The subscription is healthy.
+	return nil
+}
+
+// A healthy logical slot is a healthy replication slot whose consumer has
+// confirmed everything up to MaxByteLag bytes behind the current WAL position.
+func checkLogicalSlot(slot *PgReplicationSlot, thresholds LogicalThresholds) error {
+	err := checkReplicationSlot(slot, SlotThresholds{})
+	if err != nil {
+		return err
+	}
+
+	if thresholds.MaxByteLag > 0 && slot.ConfirmedFlushLagBytes.Valid && slot.ConfirmedFlushLagBytes.Int64 > thresholds.MaxByteLag {
+		return fmt.Errorf("logical slot confirmed_flush_lsn lag %d bytes exceeds %d", slot.ConfirmedFlushLagBytes.Int64, thresholds.MaxByteLag)
 	}
 
-	// The DB is healthy.
+	// The slot is healthy.
+	return nil
+}
+
+// Fails a replica which is on a different timeline than its upstream, or
+// which received WAL the upstream never wrote, as happens to an old primary
+// following a new one after failover. Unknown positions pass.
+func checkTimeline(nodeInfo *NodeInfo) error {
+	if !nodeInfo.IsReplica() {
+		return nil
+	}
+	if nodeInfo.Timeline.Valid && nodeInfo.UpstreamTimeline.Valid &&
+		nodeInfo.Timeline.Int64 != nodeInfo.UpstreamTimeline.Int64 {
+		return ErrTimelineDiverged
+	}
+	if nodeInfo.UpstreamLocation.Valid && nodeInfo.Xlog.ReceivedLocation > nodeInfo.UpstreamLocation.Int64 {
+		return ErrWalDiverged
+	}
 	return nil
 }
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"gopkg.in/volatiletech/null.v6"
+)
+
+func TestCheckReplicationSlot(t *testing.T) {
+	fds := &fakeDataSource{slots: []*PgReplicationSlot{
+		{SlotName: "healthy", Active: true, WalStatus: null.StringFrom("reserved"), SafeWalSize: null.Int64From(4096), RetainedWalBytes: null.Int64From(1024)},
+		{SlotName: "inactive", Active: false},
+		{SlotName: "unreserved", Active: true, WalStatus: null.StringFrom("unreserved")},
+		{SlotName: "lost", Active: true, WalStatus: null.StringFrom("lost")},
+		{SlotName: "pg12", Active: true},
+	}}
+	hc := NewHealthChecker(fds)
+
+	cases := map[string]error{
+		"healthy":    nil,
+		"missing":    ErrReplicationSlotNotFound,
+		"inactive":   ErrReplicationSlotInactive,
+		"unreserved": ErrReplicationSlotUnreserved,
+		"lost":       ErrReplicationSlotLost,
+		"pg12":       nil,
+	}
+	for slotName, expected := range cases {
+		if err := hc.CheckReplicationSlot(context.Background(), slotName, SlotThresholds{}); err != expected {
+			t.Fatal("Slot", slotName, "returned", err, "but expected", expected)
+		}
+	}
+
+	if err := hc.CheckReplicationSlot(context.Background(), "healthy", SlotThresholds{MinSafeWalSize: 8192}); err == nil {
+		t.Fatal("Expected a safe_wal_size below the floor to fail")
+	}
+	if err := hc.CheckReplicationSlot(context.Background(), "healthy", SlotThresholds{MaxRetainedWalBytes: 512}); err == nil {
+		t.Fatal("Expected retained wal above the max to fail")
+	}
+	if err := hc.CheckReplicationSlot(context.Background(), "pg12", SlotThresholds{MinSafeWalSize: 8192, MaxRetainedWalBytes: 512}); err != nil {
+		t.Fatal("Expected unknown sizes to pass but found:", err)
+	}
+}
+
+func TestCheckSubscription(t *testing.T) {
+	subscription := &PgStatSubscription{
+		SubName:             "cdc",
+		Pid:                 null.StringFrom("1234"),
+		ApplyLagBytes:       null.Int64From(2048),
+		ApplyLagSeconds:     null.Float64From(3),
+		LatestEndAgeSeconds: null.Float64From(10),
+	}
+
+	if err := checkSubscription(subscription, LogicalThresholds{}); err != nil {
+		t.Fatal("Expected a running subscription to be healthy but found:", err)
+	}
+	if err := checkSubscription(subscription, LogicalThresholds{MaxByteLag: 1024}); err == nil {
+		t.Fatal("Expected apply byte lag above the max to fail")
+	}
+	if err := checkSubscription(subscription, LogicalThresholds{MaxLagSeconds: 1}); err == nil {
+		t.Fatal("Expected apply lag seconds above the max to fail")
+	}
+	if err := checkSubscription(subscription, LogicalThresholds{MaxLatestEndAgeSeconds: 5}); err == nil {
+		t.Fatal("Expected a stale latest_end_lsn to fail")
+	}
+	if err := checkSubscription(&PgStatSubscription{SubName: "disabled"}, LogicalThresholds{}); err != ErrSubscriptionWorkerDown {
+		t.Fatal("Expected a worker down err but found:", err)
+	}
+}
+
+func TestCheckLogicalSlot(t *testing.T) {
+	slot := &PgReplicationSlot{SlotName: "cdc", SlotType: "logical", Active: true, ConfirmedFlushLagBytes: null.Int64From(4096)}
+
+	if err := checkLogicalSlot(slot, LogicalThresholds{}); err != nil {
+		t.Fatal("Expected an active logical slot to be healthy but found:", err)
+	}
+	if err := checkLogicalSlot(slot, LogicalThresholds{MaxByteLag: 1024}); err == nil {
+		t.Fatal("Expected confirmed_flush_lsn lag above the max to fail")
+	}
+
+	slot.Active = false
+	if err := checkLogicalSlot(slot, LogicalThresholds{}); err != ErrReplicationSlotInactive {
+		t.Fatal("Expected an inactive err but found:", err)
+	}
+}
+
+func TestCheckTimeline(t *testing.T) {
+	replica := &NodeInfo{
+		Role:             "replica",
+		Timeline:         null.Int64From(3),
+		UpstreamTimeline: null.Int64From(3),
+		UpstreamLocation: null.Int64From(1000),
+		Xlog:             &XlogInfo{ReceivedLocation: 900},
+	}
+	if err := checkTimeline(replica); err != nil {
+		t.Fatal("Expected a replica following its upstream to pass but found:", err)
+	}
+
+	replica.Xlog.ReceivedLocation = 1100
+	if err := checkTimeline(replica); err != ErrWalDiverged {
+		t.Fatal("Expected a wal diverged err but found:", err)
+	}
+
+	replica.UpstreamTimeline = null.Int64From(4)
+	if err := checkTimeline(replica); err != ErrTimelineDiverged {
+		t.Fatal("Expected a timeline diverged err but found:", err)
+	}
+
+	replica.Timeline = null.Int64{}
+	replica.UpstreamLocation = null.Int64{}
+	if err := checkTimeline(replica); err != nil {
+		t.Fatal("Expected unknown positions to pass but found:", err)
+	}
+
+	primary := &NodeInfo{Role: "primary", Timeline: null.Int64From(2), Xlog: &XlogInfo{}}
+	if err := checkTimeline(primary); err != nil {
+		t.Fatal("Expected a primary to pass but found:", err)
+	}
+}
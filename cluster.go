@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/film42/pgreba/config"
+	"gopkg.in/volatiletech/null.v6"
+)
+
+const defaultClusterTimeout = 5 * time.Second
+
+// Every cluster member in one document, for a single place to look during
+// incidents.
+type Cluster struct {
+	Members []*ClusterMember `json:"members"`
+	// The name of the primary, when exactly one member is primary.
+	Primary string `json:"primary"`
+	// More than one member is primary.
+	SplitBrain bool `json:"split_brain"`
+	// Some members are on a different timeline than the primary.
+	DivergentTimelines bool `json:"divergent_timelines"`
+}
+
+type ClusterMember struct {
+	Name             string     `json:"name"`
+	Role             string     `json:"role"`
+	Timeline         null.Int64 `json:"timeline"`
+	Location         null.Int64 `json:"location"`
+	ReceivedLocation null.Int64 `json:"received_location"`
+	ReplayedLocation null.Int64 `json:"replayed_location"`
+	ReplayPaused     bool       `json:"replay_paused"`
+	// Bytes replayed behind the primary's current location.
+	ByteLag           null.Int64   `json:"byte_lag"`
+	LagSeconds        null.Float64 `json:"lag_seconds"`
+	DivergentTimeline bool         `json:"divergent_timeline"`
+	// Set when the member could not be checked.
+	Error string `json:"error,omitempty"`
+}
+
+func (c *Cluster) healthy() bool {
+	return len(c.Primary) > 0 && !c.SplitBrain && !c.DivergentTimelines
+}
+
+// Builds the cluster document from each member's node info or error.
+func newCluster(names []string, nodeInfos []*NodeInfo, errs []error) *Cluster {
+	cluster := &Cluster{Members: []*ClusterMember{}}
+	var primaries []*ClusterMember
+	for i, name := range names {
+		member := &ClusterMember{Name: name}
+		cluster.Members = append(cluster.Members, member)
+		if errs[i] != nil {
+			member.Error = errs[i].Error()
+			continue
+		}
+
+		nodeInfo := nodeInfos[i]
+		member.Role = nodeInfo.Role
+		member.Timeline = nodeInfo.Timeline
+		// Peers which only give a summary send no WAL locations, which are
+		// left null.
+		if xlog := nodeInfo.Xlog; xlog != nil {
+			member.ReplayedLocation = xlog.ReplayedLocation
+			member.ReplayPaused = xlog.Paused
+			if nodeInfo.IsPrimary() {
+				member.Location = null.Int64From(xlog.Location)
+			} else {
+				member.ReceivedLocation = null.Int64From(xlog.ReceivedLocation)
+			}
+		}
+		if nodeInfo.IsPrimary() {
+			primaries = append(primaries, member)
+		} else {
+			member.LagSeconds = nodeInfo.LagSeconds
+		}
+	}
+
+	cluster.SplitBrain = len(primaries) > 1
+
+	// Compare against the primary, or failing that the newest timeline.
+	var primary *ClusterMember
+	var timeline null.Int64
+	if len(primaries) == 1 {
+		primary = primaries[0]
+		cluster.Primary = primary.Name
+		timeline = primary.Timeline
+	} else {
+		for _, member := range cluster.Members {
+			if member.Timeline.Valid && (!timeline.Valid || member.Timeline.Int64 > timeline.Int64) {
+				timeline = member.Timeline
+			}
+		}
+	}
+
+	for _, member := range cluster.Members {
+		if timeline.Valid && member.Timeline.Valid && member.Timeline.Int64 != timeline.Int64 {
+			member.DivergentTimeline = true
+			cluster.DivergentTimelines = true
+		}
+		if primary != nil && primary.Location.Valid && member.ReplayedLocation.Valid && member.Role == "replica" {
+			member.ByteLag = null.Int64From(primary.Location.Int64 - member.ReplayedLocation.Int64)
+		}
+	}
+
+	return cluster
+}
+
+type clusterPeer struct {
+	member config.ClusterMember
+	// Only set for members checked with a DSN.
+	pgds *pgDataSource
+	ds   ReplicationDataSource
+}
+
+// Checks every configured member on each request to /cluster.
+type clusterView struct {
+	mutex  sync.Mutex
+	cfg    *config.ClusterConfig
+	peers  []*clusterPeer
+	client *http.Client
+}
+
+func newClusterView(cfg *config.Config) (*clusterView, error) {
+	cv := &clusterView{cfg: cfg.Cluster, client: &http.Client{}}
+	for _, member := range cfg.Cluster.Members {
+		peer := &clusterPeer{member: member}
+		if len(member.DSN) > 0 {
+			memberCfg, err := member.ConnectionConfig(cfg)
+			if err != nil {
+				return nil, err
+			}
+			peer.pgds = &pgDataSource{cfg: memberCfg}
+			peer.ds = NewCachedDataSource(peer.pgds)
+		}
+		cv.peers = append(cv.peers, peer)
+	}
+	return cv, nil
+}
+
+func (cv *clusterView) timeout() time.Duration {
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	if cv.cfg.Timeout == 0 {
+		return defaultClusterTimeout
+	}
+	return cv.cfg.Timeout
+}
+
+// Swaps in a reloaded timeout and connection settings. Members only change on
+// restart.
+func (cv *clusterView) reload(cfg *config.Config) {
+	if cfg.Cluster == nil {
+		slog.Warn("Config reloaded: cluster is only removed after a restart")
+		return
+	}
+
+	cv.mutex.Lock()
+	defer cv.mutex.Unlock()
+	cv.cfg = cfg.Cluster
+	for _, member := range cfg.Cluster.Members {
+		for _, peer := range cv.peers {
+			if peer.member.Name != member.Name || peer.pgds == nil || len(member.DSN) == 0 {
+				continue
+			}
+			memberCfg, err := member.ConnectionConfig(cfg)
+			if err != nil {
+				slog.Error("Error reloading cluster member", "member", member.Name, "error", err)
+				continue
+			}
+			peer.pgds.Reload(memberCfg)
+		}
+	}
+}
+
+func (cv *clusterView) Close() error {
+	for _, peer := range cv.peers {
+		if peer.ds != nil {
+			peer.ds.Close()
+		}
+	}
+	return nil
+}
+
+func (cv *clusterView) GetCluster() *Cluster {
+	timeout := cv.timeout()
+	names := make([]string, len(cv.peers))
+	nodeInfos := make([]*NodeInfo, len(cv.peers))
+	errs := make([]error, len(cv.peers))
+
+	wg := sync.WaitGroup{}
+	for i, peer := range cv.peers {
+		names[i] = peer.member.Name
+		wg.Add(1)
+		go func(i int, peer *clusterPeer) {
+			defer wg.Done()
+			nodeInfos[i], errs[i] = cv.getNodeInfo(peer, timeout)
+		}(i, peer)
+	}
+	wg.Wait()
+
+	return newCluster(names, nodeInfos, errs)
+}
+
+func (cv *clusterView) getNodeInfo(peer *clusterPeer, timeout time.Duration) (*NodeInfo, error) {
+	if peer.ds == nil {
+		return cv.getPeerNodeInfo(peer.member, timeout)
+	}
+
+	type result struct {
+		nodeInfo *NodeInfo
+		err      error
+	}
+	results := make(chan result, 1)
+	// Only the member itself is asked. Its lag is measured against the
+	// primary's document, so walking up its replication chain adds nothing,
+	// and an unreachable upstream would hide the member.
+	go func() {
+		nodeInfo, err := peer.ds.GetLocalNodeStatus(context.Background())
+		results <- result{nodeInfo, err}
+	}()
+
+	select {
+	case r := <-results:
+		return r.nodeInfo, r.err
+	case <-time.After(timeout):
+		return nil, fmt.Errorf("err: timed out after %s", timeout)
+	}
+}
+
+// Reads node info from a peer's /health endpoint. Peers which only give
+// anonymous callers a summary leave out the WAL locations, unless the member
+// has a token.
+func (cv *clusterView) getPeerNodeInfo(member config.ClusterMember, timeout time.Duration) (*NodeInfo, error) {
+	req, err := http.NewRequest("GET", strings.TrimSuffix(member.URL, "/")+"/health?verbose=full", nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(member.Token) > 0 {
+		req.Header.Set("Authorization", "Bearer "+member.Token)
+	}
+
+	client := *cv.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("err: peer returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+
+	nodeInfo := &NodeInfo{}
+	if err := json.Unmarshal(body, nodeInfo); err != nil {
+		return nil, err
+	}
+	return nodeInfo, nil
+}
+
+// Returns a 503 when there is no single primary or a member diverged.
+func (cv *clusterView) apiGetCluster(w http.ResponseWriter, r *http.Request) {
+	cluster := cv.GetCluster()
+	if !cluster.healthy() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(cluster)
+}
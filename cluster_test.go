@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/film42/pgreba/config"
+	"github.com/gorilla/mux"
+	"gopkg.in/volatiletech/null.v6"
+)
+
+func clusterNodeInfo(role string, timeline int64, location int64) *NodeInfo {
+	nodeInfo := &NodeInfo{Role: role, Timeline: null.Int64From(timeline), Xlog: &XlogInfo{}}
+	if role == "primary" {
+		nodeInfo.Xlog.Location = location
+	} else {
+		nodeInfo.Xlog.ReceivedLocation = location
+		nodeInfo.Xlog.ReplayedLocation = null.Int64From(location)
+	}
+	return nodeInfo
+}
+
+func TestNewCluster(t *testing.T) {
+	cluster := newCluster(
+		[]string{"db1", "db2", "db3"},
+		[]*NodeInfo{clusterNodeInfo("primary", 2, 1000), clusterNodeInfo("replica", 2, 600), nil},
+		[]error{nil, nil, errors.New("connection refused")},
+	)
+
+	if cluster.Primary != "db1" || cluster.SplitBrain || cluster.DivergentTimelines || !cluster.healthy() {
+		t.Fatal("Expected a healthy cluster:", cluster)
+	}
+	if !cluster.Members[1].ByteLag.Valid || cluster.Members[1].ByteLag.Int64 != 400 {
+		t.Fatal("Expected db2 to lag the primary by 400 bytes:", cluster.Members[1].ByteLag)
+	}
+	if cluster.Members[2].Error != "connection refused" || len(cluster.Members[2].Role) > 0 {
+		t.Fatal("Expected db3 to report its error:", cluster.Members[2])
+	}
+}
+
+func TestNewClusterFlagsSplitBrainAndDivergence(t *testing.T) {
+	cluster := newCluster(
+		[]string{"db1", "db2", "db3"},
+		[]*NodeInfo{clusterNodeInfo("primary", 2, 1000), clusterNodeInfo("primary", 3, 900), clusterNodeInfo("replica", 3, 800)},
+		[]error{nil, nil, nil},
+	)
+
+	if !cluster.SplitBrain || len(cluster.Primary) > 0 || cluster.healthy() {
+		t.Fatal("Expected split-brain:", cluster)
+	}
+	if !cluster.DivergentTimelines || !cluster.Members[0].DivergentTimeline || cluster.Members[1].DivergentTimeline {
+		t.Fatal("Expected db1 to be flagged as behind the newest timeline:", cluster.Members)
+	}
+
+	cluster = newCluster(
+		[]string{"db1", "db2"},
+		[]*NodeInfo{clusterNodeInfo("primary", 3, 1000), clusterNodeInfo("replica", 2, 1200)},
+		[]error{nil, nil},
+	)
+	if !cluster.Members[1].DivergentTimeline || cluster.healthy() {
+		t.Fatal("Expected the replica on an old timeline to be flagged:", cluster.Members[1])
+	}
+}
+
+func TestNewClusterWithoutWALLocations(t *testing.T) {
+	// A primary which only gave a summary.
+	primary := &NodeInfo{Role: "primary", Timeline: null.Int64From(2)}
+	cluster := newCluster(
+		[]string{"db1", "db2"},
+		[]*NodeInfo{primary, clusterNodeInfo("replica", 2, 600)},
+		[]error{nil, nil},
+	)
+
+	if cluster.Members[0].Location.Valid || cluster.Members[0].ReplayedLocation.Valid {
+		t.Fatal("Expected db1's locations to be null:", cluster.Members[0])
+	}
+	if cluster.Members[1].ByteLag.Valid {
+		t.Fatal("Expected no byte lag without the primary's location:", cluster.Members[1].ByteLag)
+	}
+	if cluster.Primary != "db1" || !cluster.healthy() {
+		t.Fatal("Expected a healthy cluster:", cluster)
+	}
+}
+
+func TestClusterViewReadsPeerHealth(t *testing.T) {
+	peers := map[string]*fakeDataSource{"primary": {role: "primary"}, "replica": {role: "replica"}}
+	members := []config.ClusterMember{}
+	for name, fds := range peers {
+		router := mux.NewRouter()
+		hcs := &HealthCheckWebService{healthChecker: NewHealthChecker(fds), cfg: &config.Config{}}
+		hcs.registerRoutes(router)
+		server := httptest.NewServer(router)
+		defer server.Close()
+		members = append(members, config.ClusterMember{Name: name, URL: server.URL})
+	}
+	members = append(members, config.ClusterMember{Name: "down", URL: "http://127.0.0.1:1"})
+
+	cv, err := newClusterView(&config.Config{Cluster: &config.ClusterConfig{Members: members}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := cv.GetCluster()
+	if cluster.Primary != "primary" || cluster.SplitBrain {
+		t.Fatal("Unexpected cluster:", cluster)
+	}
+	for _, member := range cluster.Members {
+		if member.Name == "down" && len(member.Error) == 0 {
+			t.Fatal("Expected the unreachable peer to report an error")
+		}
+		if member.Name != "down" && member.Role != member.Name {
+			t.Fatal("Unexpected member:", member)
+		}
+	}
+}
+
+func TestClusterViewChecksDSNMembersWithoutTheirUpstream(t *testing.T) {
+	cv := &clusterView{
+		cfg: &config.ClusterConfig{},
+		peers: []*clusterPeer{
+			{member: config.ClusterMember{Name: "primary"}, ds: &fakeDataSource{role: "primary"}},
+			{member: config.ClusterMember{Name: "replica"}, ds: &fakeDataSource{role: "replica", upstreamErr: errors.New("err: upstream unreachable")}},
+		},
+	}
+
+	cluster := cv.GetCluster()
+	replica := cluster.Members[1]
+	if len(replica.Error) > 0 || replica.Role != "replica" {
+		t.Fatal("Expected the replica to be checked despite its unreachable upstream:", replica)
+	}
+	if cluster.Primary != "primary" || !cluster.healthy() {
+		t.Fatal("Unexpected cluster:", cluster)
+	}
+}
+
+func TestClusterViewSendsMemberTokens(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(clusterNodeInfo("primary", 2, 1000))
+	}))
+	defer server.Close()
+
+	cv, err := newClusterView(&config.Config{Cluster: &config.ClusterConfig{Members: []config.ClusterMember{
+		{Name: "db1", URL: server.URL, Token: "s3cret"},
+		{Name: "db2", URL: server.URL},
+	}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cluster := cv.GetCluster()
+	if len(cluster.Members[0].Error) > 0 || cluster.Members[0].Location.Int64 != 1000 {
+		t.Fatal("Expected db1 to be read with its token:", cluster.Members[0])
+	}
+	if !strings.Contains(cluster.Members[1].Error, "401") {
+		t.Fatal("Expected db2 to be turned away without a token:", cluster.Members[1])
+	}
+}
@@ -0,0 +1,187 @@
+package config
+
+import (
+	"path"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Who may call the HTTP API. Callers authenticate with a bearer token, HTTP
+// basic auth or a client certificate, and each request is checked against
+// the first rule matching its path and method. Requests matching no rule
+// need credentials.
+type AuthConfig struct {
+	Tokens []AuthToken `yaml:"tokens"`
+	Users  []AuthUser  `yaml:"users"`
+
+	// Client certificates whose common name or a subject alternative name
+	// is listed here authenticate as that name. Requires
+	// tls_client_ca_file.
+	ClientCertificates []string `yaml:"client_certificates"`
+
+	// Defaults to DefaultAuthRules.
+	Rules []AuthRule `yaml:"rules"`
+
+	// The most detail anonymous callers get from the health checks, even
+	// when they ask for more with ?verbose=. Defaults to summary, which
+	// leaves out the standbys' users and addresses.
+	AnonymousResponseProfile string `yaml:"anonymous_response_profile"`
+}
+
+type AuthToken struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+}
+
+// A basic auth user. PasswordHash is a bcrypt hash, e.g. from
+// `htpasswd -nbB user password`.
+type AuthUser struct {
+	Name         string `yaml:"name"`
+	PasswordHash string `yaml:"password_hash"`
+}
+
+// Paths are patterns as understood by path.Match, e.g. /slot/*, relative to
+// the instance for named instances. A rule without paths matches every path,
+// and one without methods every method. Anonymous rules let anyone through;
+// otherwise callers need credentials and, when Allow is set, one of the
+// listed names.
+type AuthRule struct {
+	Paths     []string `yaml:"paths"`
+	Methods   []string `yaml:"methods"`
+	Anonymous bool     `yaml:"anonymous"`
+	Allow     []string `yaml:"allow"`
+}
+
+// Health checks stay anonymous so load balancers and orchestrators need no
+// credentials. Everything else, including detailed JSON, metrics and
+// mutating endpoints, needs them.
+var DefaultAuthRules = []AuthRule{
+	{
+		Paths: []string{
+			"/", "/primary", "/read-write",
+			"/replica", "/read-only", "/standby-leader", "/synchronous", "/sync", "/asynchronous", "/async",
+			"/health", "/liveness", "/readiness",
+		},
+		Methods:   []string{"GET", "HEAD", "OPTIONS"},
+		Anonymous: true,
+	},
+}
+
+func (ac *AuthConfig) AnonymousProfile() string {
+	if len(ac.AnonymousResponseProfile) == 0 {
+		return "summary"
+	}
+	return ac.AnonymousResponseProfile
+}
+
+func (ac *AuthConfig) rules() []AuthRule {
+	if len(ac.Rules) == 0 {
+		return DefaultAuthRules
+	}
+	return ac.Rules
+}
+
+// The first rule matching a request, or nil.
+func (ac *AuthConfig) Rule(requestPath string, method string) *AuthRule {
+	rules := ac.rules()
+	for i := range rules {
+		if rules[i].matches(requestPath, method) {
+			return &rules[i]
+		}
+	}
+	return nil
+}
+
+func (ar *AuthRule) matches(requestPath string, method string) bool {
+	if len(ar.Methods) > 0 && !containsString(ar.Methods, method) {
+		return false
+	}
+	if len(ar.Paths) == 0 {
+		return true
+	}
+	for _, pattern := range ar.Paths {
+		if matched, _ := path.Match(pattern, requestPath); matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (ar *AuthRule) Allows(name string) bool {
+	return len(ar.Allow) == 0 || containsString(ar.Allow, name)
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func (ac *AuthConfig) validate(c *Config, problemf func(format string, args ...interface{})) {
+	names := make(map[string]bool)
+	addName := func(name string, kind string, i int) {
+		if len(name) == 0 {
+			problemf("auth %s[%d] has no name", kind, i)
+			return
+		}
+		if names[name] {
+			problemf("auth name %q is used more than once", name)
+		}
+		names[name] = true
+	}
+
+	tokens := make(map[string]bool)
+	for i, token := range ac.Tokens {
+		addName(token.Name, "tokens", i)
+		if len(token.Token) < 16 {
+			problemf("auth token %s must be at least 16 characters", token.Name)
+		}
+		if tokens[token.Token] {
+			problemf("auth token %s is the same as another token", token.Name)
+		}
+		tokens[token.Token] = true
+	}
+	for i, user := range ac.Users {
+		addName(user.Name, "users", i)
+		if _, err := bcrypt.Cost([]byte(user.PasswordHash)); err != nil {
+			problemf("auth user %s password_hash must be a bcrypt hash", user.Name)
+		}
+	}
+	for i, name := range ac.ClientCertificates {
+		addName(name, "client_certificates", i)
+	}
+	if len(ac.ClientCertificates) > 0 && len(c.TLSClientCAFile) == 0 {
+		problemf("auth client_certificates requires tls_client_ca_file")
+	}
+
+	switch ac.AnonymousResponseProfile {
+	case "", "status", "summary", "full":
+	default:
+		problemf("auth anonymous_response_profile %q must be status, summary or full", ac.AnonymousResponseProfile)
+	}
+
+	for i, rule := range ac.Rules {
+		for _, pattern := range rule.Paths {
+			if _, err := path.Match(pattern, ""); err != nil || !strings.HasPrefix(pattern, "/") {
+				problemf("auth rules[%d] path %q must be a pattern starting with /", i, pattern)
+			}
+		}
+		for _, method := range rule.Methods {
+			if method != strings.ToUpper(method) {
+				problemf("auth rules[%d] method %q must be upper case", i, method)
+			}
+		}
+		if rule.Anonymous && len(rule.Allow) > 0 {
+			problemf("auth rules[%d] can't be anonymous and allow specific names", i)
+		}
+		for _, name := range rule.Allow {
+			if !names[name] {
+				problemf("auth rules[%d] allows unknown name %q", i, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/film42/pgreba/conninfo"
+)
+
+// Peers making up the cluster shown by the /cluster endpoint. List every
+// node, including this one.
+type ClusterConfig struct {
+	Members []ClusterMember `yaml:"members"`
+
+	// How long to wait for each member (default 5s).
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// A cluster member is checked either directly with a postgres DSN, layered
+// over the top level connection settings, or through a peer PgReba's
+// /health endpoint at URL.
+type ClusterMember struct {
+	Name string `yaml:"name"`
+	DSN  string `yaml:"dsn"`
+	URL  string `yaml:"url"`
+	// Sent as a bearer token to a URL member, so a peer with auth configured
+	// gives its full /health.
+	Token string `yaml:"token"`
+}
+
+// The DSN settings PgReba knows how to apply.
+var clusterDSNKeys = map[string]bool{
+	"host": true, "port": true, "dbname": true, "user": true, "password": true, "sslmode": true,
+}
+
+// The connection settings for a DSN member.
+func (cm *ClusterMember) ConnectionConfig(base *Config) (*Config, error) {
+	params, err := conninfo.Parse(cm.DSN)
+	if err != nil {
+		return nil, err
+	}
+
+	c := *base
+	for key, value := range params {
+		if !clusterDSNKeys[key] {
+			return nil, fmt.Errorf("err: unsupported dsn setting %s", key)
+		}
+		if strings.Contains(value, ",") && (key == "host" || key == "port") {
+			return nil, fmt.Errorf("err: dsn must name a single host")
+		}
+	}
+	if host, ok := params["host"]; ok {
+		c.Host = host
+	}
+	if port, ok := params["port"]; ok {
+		c.Port = port
+	}
+	if database, ok := params["dbname"]; ok {
+		c.Database = database
+	}
+	if user, ok := params["user"]; ok {
+		c.User = user
+	}
+	if password, ok := params["password"]; ok {
+		c.Password = password
+	}
+	if sslmode, ok := params["sslmode"]; ok {
+		c.Sslmode = sslmode
+	}
+	return &c, nil
+}
+
+func (cc *ClusterConfig) validate(base *Config, problemf func(format string, args ...interface{})) {
+	if len(cc.Members) == 0 {
+		problemf("cluster needs at least one member")
+	}
+	if cc.Timeout < 0 {
+		problemf("cluster timeout must not be negative")
+	}
+
+	names := make(map[string]bool)
+	for i, member := range cc.Members {
+		if len(member.Name) == 0 {
+			problemf("cluster members[%d] has no name", i)
+		} else if names[member.Name] {
+			problemf("cluster member name %q is used more than once", member.Name)
+		}
+		names[member.Name] = true
+
+		switch {
+		case len(member.DSN) > 0 && len(member.URL) > 0:
+			problemf("cluster member %s needs a dsn or a url, not both", member.Name)
+		case len(member.DSN) > 0:
+			if _, err := member.ConnectionConfig(base); err != nil {
+				problemf("cluster member %s: %v", member.Name, err)
+			}
+		case len(member.URL) > 0:
+			u, err := url.Parse(member.URL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+				problemf("cluster member %s url %q must be an http or https url", member.Name, member.URL)
+			}
+		default:
+			problemf("cluster member %s needs a dsn or a url", member.Name)
+		}
+		if len(member.Token) > 0 && len(member.URL) == 0 {
+			problemf("cluster member %s token is only sent to a url", member.Name)
+		}
+	}
+}
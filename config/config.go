@@ -2,6 +2,7 @@ package config
 
 import (
 	"io/ioutil"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -15,17 +16,146 @@ type Config struct {
 	Port             string `yaml:"port"`
 	Password         string `yaml:"password"`
 	MaxHop           int64  `yaml:"max_hop"`
+
+	// Path to a file holding the password, such as a mounted secret. Only
+	// used when no password is set.
+	PasswordFile string `yaml:"password_file"`
+
+	// Default threshold for the /replica endpoint when no
+	// max_allowable_lag_seconds query param is given. Zero disables the check.
+	MaxAllowableLagSeconds float64 `yaml:"max_allowable_lag_seconds"`
+
+	// Set when this node's cluster replicates from another cluster, like a
+	// patroni standby cluster. Its replica streaming straight from the other
+	// cluster's primary is then the standby leader. Without it, no node is.
+	StandbyCluster bool `yaml:"standby_cluster"`
+
+	// HTTP server settings. TLS is enabled when a cert and key are given, and
+	// client certificates are required (mTLS) when a client CA is given.
+	ListenAddress   string `yaml:"listen_address"`
+	TLSCertFile     string `yaml:"tls_cert_file"`
+	TLSKeyFile      string `yaml:"tls_key_file"`
+	TLSClientCAFile string `yaml:"tls_client_ca_file"`
+
+	// When set, postgres is polled in the background on this interval and
+	// checks are served from the last snapshot. Checks fail once the snapshot
+	// is older than max_staleness (defaults to three poll intervals).
+	PollInterval time.Duration `yaml:"poll_interval"`
+	MaxStaleness time.Duration `yaml:"max_staleness"`
+
+	// How often the timeline is checked for promotions and for a replica
+	// diverging from its upstream (default 5s). Zero disables watching.
+	WatchInterval time.Duration `yaml:"watch_interval"`
+
+	// Default thresholds in bytes for the /slot endpoints. Zero disables the
+	// check.
+	MinSafeWalSize      int64 `yaml:"min_safe_wal_size"`
+	MaxRetainedWalBytes int64 `yaml:"max_retained_wal_bytes"`
+
+	// When set, HAProxy's agent-check protocol is served on this address.
+	// The weight scales down as a replica's lag approaches these maximums,
+	// and the replica is drained once either is reached. Zero disables
+	// scaling on that lag.
+	AgentCheckAddress       string  `yaml:"agent_check_address"`
+	AgentCheckMaxByteLag    int64   `yaml:"agent_check_max_byte_lag"`
+	AgentCheckMaxLagSeconds float64 `yaml:"agent_check_max_lag_seconds"`
+	// The agent-check reply during maintenance, drain (default) or maint.
+	AgentCheckMaintenanceState string `yaml:"agent_check_maintenance_state"`
+
+	// Maintenance mode is on while this file exists, so it survives
+	// restarts. It is written by POST /maintenance, which requires
+	// maintenance_token as a bearer token (or a client certificate when
+	// tls_client_ca_file is set). With auth, use an auth token allowed on
+	// /maintenance instead of maintenance_token.
+	MaintenanceFile  string `yaml:"maintenance_file"`
+	MaintenanceToken string `yaml:"maintenance_token"`
+
+	// How much the health checks say about the node by default: status (no
+	// body), summary (role, lag and timeline) or full (default). Callers
+	// pick another with ?verbose=.
+	ResponseProfile string `yaml:"response_profile"`
+
+	// Logs go to stderr as logfmt (default) or json, from log_level up:
+	// debug, info (default), warn or error. At debug, passing checks are
+	// logged too.
+	LogFormat string `yaml:"log_format"`
+	LogLevel  string `yaml:"log_level"`
+
+	// Optional proxy mode. See ProxyConfig.
+	Proxy *ProxyConfig `yaml:"proxy"`
+
+	// Optional peers for the /cluster endpoint. See ClusterConfig.
+	Cluster *ClusterConfig `yaml:"cluster"`
+
+	// Optional webhooks. See NotificationsConfig.
+	Notifications *NotificationsConfig `yaml:"notifications"`
+
+	// Optional authentication for the HTTP API. See AuthConfig.
+	Auth *AuthConfig `yaml:"auth"`
+
+	// Optional OpenTelemetry tracing. See TracingConfig.
+	Tracing *TracingConfig `yaml:"tracing"`
+
+	// Named postgres instances to monitor from one process. Each is a name
+	// plus any of the settings above, which default to the top level ones.
+	InstanceSettings []map[string]string `yaml:"instances"`
+
+	instances []*Instance
+}
+
+// Proxy mode forwards postgres clients to the nodes listed here, as found
+// by PgReba's own checks using the top level connection settings. Clients of
+// the primary address go to the primary. Clients of the replica address go
+// to the healthy replica with the fewest connections, or the primary when no
+// replica is healthy.
+type ProxyConfig struct {
+	PrimaryAddress string `yaml:"primary_address"`
+	ReplicaAddress string `yaml:"replica_address"`
+
+	// Each node as host:port.
+	Nodes []string `yaml:"nodes"`
+
+	// How often the nodes are checked (default 2s), and how long clients
+	// of a replica which became unhealthy may keep their connection
+	// (default 30s).
+	CheckInterval time.Duration `yaml:"check_interval"`
+	DrainTimeout  time.Duration `yaml:"drain_timeout"`
+
+	// A replica lagging this far is unhealthy. Zero disables the check.
+	MaxByteLag    int64   `yaml:"max_byte_lag"`
+	MaxLagSeconds float64 `yaml:"max_lag_seconds"`
+}
+
+// Response profiles from least to most detail.
+var ResponseProfiles = []string{"status", "summary", "full"}
+
+func Defaults() *Config {
+	return &Config{
+		Port:          "5432",
+		MaxHop:        1,
+		ListenAddress: ":8000",
+		WatchInterval: 5 * time.Second,
+	}
 }
 
 func ParseConfig(path string) (*Config, error) {
-	bytes, err := ioutil.ReadFile(path)
+	c := Defaults()
+	err := parseConfigFile(path, c)
 	if err != nil {
 		return nil, err
 	}
-	c := new(Config)
-	err = yaml.Unmarshal(bytes, c)
+	err = c.resolveInstances()
 	if err != nil {
 		return nil, err
 	}
-	return c, err
+	return c, nil
+}
+
+func parseConfigFile(path string, c *Config) error {
+	bytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	// Reject unknown keys so a typo doesn't silently leave a zero value.
+	return yaml.UnmarshalStrict(bytes, c)
 }
@@ -0,0 +1,136 @@
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+)
+
+// A setting which differs between two configs.
+type Change struct {
+	Key string
+	Old interface{}
+	New interface{}
+}
+
+// Keys whose values are secret, or may hold one such as a password in a dsn
+// or a webhook url. List indexes are left out, so auth.tokens.token covers
+// auth.tokens[0].token.
+var secretKeys = map[string]bool{
+	"password":                   true,
+	"maintenance_token":          true,
+	"auth.tokens":                true,
+	"auth.tokens.token":          true,
+	"auth.users":                 true,
+	"auth.users.password_hash":   true,
+	"cluster.members":            true,
+	"cluster.members.dsn":        true,
+	"cluster.members.token":      true,
+	"notifications.webhooks":     true,
+	"notifications.webhooks.url": true,
+}
+
+var listIndexPattern = regexp.MustCompile(`\[\d+\]`)
+
+// Like "max_hop: 1 -> 3". Secrets are masked.
+func (c Change) String() string {
+	if secretKeys[listIndexPattern.ReplaceAllString(c.Key, "")] {
+		return c.Key + ": (changed)"
+	}
+	return fmt.Sprintf("%s: %v -> %v", c.Key, c.Old, c.New)
+}
+
+// Every scalar setting which differs between two configs. Instances are
+// compared one by one. See DiffSections for the process wide sections.
+func Diff(old *Config, new *Config) []Change {
+	changes := []Change{}
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(new).Elem()
+	t := oldValue.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := yamlKey(t.Field(i))
+		if len(key) == 0 || !isScalar(t.Field(i).Type) {
+			continue
+		}
+
+		before := oldValue.Field(i).Interface()
+		after := newValue.Field(i).Interface()
+		if !reflect.DeepEqual(before, after) {
+			changes = append(changes, Change{Key: key, Old: before, New: after})
+		}
+	}
+	return changes
+}
+
+// Every setting which differs in the sections shared by all instances:
+// proxy, cluster, notifications, auth and tracing. Keys are dotted, like
+// "proxy.check_interval" or "auth.rules[1].allow".
+func DiffSections(old *Config, new *Config) []Change {
+	changes := []Change{}
+	oldValue := reflect.ValueOf(old).Elem()
+	newValue := reflect.ValueOf(new).Elem()
+	t := oldValue.Type()
+	for i := 0; i < t.NumField(); i++ {
+		key := yamlKey(t.Field(i))
+		if len(key) == 0 || !isSection(t.Field(i).Type) {
+			continue
+		}
+		changes = diffValue(key, oldValue.Field(i), newValue.Field(i), changes)
+	}
+	return changes
+}
+
+func isSection(t reflect.Type) bool {
+	return t.Kind() == reflect.Ptr && t.Elem().Kind() == reflect.Struct
+}
+
+func diffValue(key string, before reflect.Value, after reflect.Value, changes []Change) []Change {
+	if reflect.DeepEqual(before.Interface(), after.Interface()) {
+		return changes
+	}
+
+	switch {
+	case isSection(before.Type()):
+		// An added or removed section is compared with an empty one, so
+		// every setting it brings or takes away is listed.
+		if before.IsNil() || after.IsNil() {
+			found := len(changes)
+			changes = diffValue(key, elemOrZero(before), elemOrZero(after), changes)
+			if len(changes) == found {
+				changes = append(changes, Change{Key: key, Old: sectionState(before), New: sectionState(after)})
+			}
+			return changes
+		}
+		return diffValue(key, before.Elem(), after.Elem(), changes)
+	case before.Kind() == reflect.Struct:
+		t := before.Type()
+		for i := 0; i < t.NumField(); i++ {
+			fieldKey := yamlKey(t.Field(i))
+			if len(fieldKey) == 0 {
+				continue
+			}
+			changes = diffValue(key+"."+fieldKey, before.Field(i), after.Field(i), changes)
+		}
+		return changes
+	case before.Kind() == reflect.Slice && before.Type().Elem().Kind() == reflect.Struct && before.Len() == after.Len():
+		for i := 0; i < before.Len(); i++ {
+			changes = diffValue(fmt.Sprintf("%s[%d]", key, i), before.Index(i), after.Index(i), changes)
+		}
+		return changes
+	}
+	return append(changes, Change{Key: key, Old: before.Interface(), New: after.Interface()})
+}
+
+func elemOrZero(v reflect.Value) reflect.Value {
+	if v.IsNil() {
+		return reflect.Zero(v.Type().Elem())
+	}
+	return v.Elem()
+}
+
+func sectionState(v reflect.Value) string {
+	if v.IsNil() {
+		return "(none)"
+	}
+	return "(set)"
+}
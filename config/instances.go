@@ -0,0 +1,56 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// A named postgres instance and its settings. The instance built from a
+// config without an instances list has no name.
+type Instance struct {
+	Name string
+	*Config
+}
+
+var instanceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// The instances to monitor. Without an instances list, this is a single
+// unnamed instance using the top level settings.
+func (c *Config) Instances() []*Instance {
+	if len(c.instances) > 0 {
+		return c.instances
+	}
+	return []*Instance{{Config: c}}
+}
+
+// Builds each instance by applying its settings over a copy of the top level
+// settings. The password is resolved per instance afterwards, since the
+// matching pgpass entry depends on the instance's host and port.
+func (c *Config) resolveInstances() error {
+	c.instances = nil
+	for i, settings := range c.InstanceSettings {
+		name := settings["name"]
+		if len(name) == 0 {
+			return fmt.Errorf("err: instances[%d] has no name", i)
+		}
+
+		instanceConfig := *c
+		instanceConfig.InstanceSettings = nil
+		instanceConfig.instances = nil
+		instanceConfig.Proxy = nil
+		instanceConfig.Cluster = nil
+		instanceConfig.Notifications = nil
+		instanceConfig.Auth = nil
+		instanceConfig.Tracing = nil
+		for key, value := range settings {
+			if key == "name" {
+				continue
+			}
+			if err := instanceConfig.set(key, value); err != nil {
+				return fmt.Errorf("err: instance %s: %v", name, err)
+			}
+		}
+		c.instances = append(c.instances, &Instance{Name: name, Config: &instanceConfig})
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package config
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Standard libpq environment variables and the config keys they set.
+var libpqEnvironment = map[string]string{
+	"PGHOST":     "host",
+	"PGPORT":     "port",
+	"PGDATABASE": "database",
+	"PGUSER":     "user",
+	"PGPASSWORD": "password",
+	"PGSSLMODE":  "sslmode",
+}
+
+// Loads the config in layers, each overriding the last:
+//
+//  1. Defaults
+//  2. The config file at path, when a path is given
+//  3. Standard libpq environment variables (PGHOST, PGPORT, PGDATABASE, PGUSER,
+//     PGPASSWORD and PGSSLMODE)
+//  4. PGREBA_<KEY> environment variables, e.g. PGREBA_LISTEN_ADDRESS
+//  5. Command line flags, e.g. -listen-address
+//
+// Each entry in instances is then layered over the result.
+//
+// When no password is set by any layer, it is read from password_file, and
+// failing that from PGPASSFILE or ~/.pgpass.
+func Load(path string, environ []string, flags *Flags) (*Config, error) {
+	c := Defaults()
+
+	if len(path) > 0 {
+		err := parseConfigFile(path, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	env := make(map[string]string)
+	for _, kv := range environ {
+		if idx := strings.Index(kv, "="); idx > 0 {
+			env[kv[:idx]] = kv[idx+1:]
+		}
+	}
+
+	for name, key := range libpqEnvironment {
+		if value, ok := env[name]; ok {
+			if err := c.set(key, value); err != nil {
+				return nil, fmt.Errorf("err: invalid %s: %v", name, err)
+			}
+		}
+	}
+
+	for _, key := range c.keys() {
+		name := "PGREBA_" + strings.ToUpper(key)
+		if value, ok := env[name]; ok {
+			if err := c.set(key, value); err != nil {
+				return nil, fmt.Errorf("err: invalid %s: %v", name, err)
+			}
+		}
+	}
+
+	if flags != nil {
+		for key, value := range flags.overrides() {
+			if err := c.set(key, value); err != nil {
+				return nil, fmt.Errorf("err: invalid -%s: %v", flagName(key), err)
+			}
+		}
+	}
+
+	err := c.resolveInstances()
+	if err != nil {
+		return nil, err
+	}
+
+	err = c.resolvePassword(env)
+	if err != nil {
+		return nil, err
+	}
+	for _, instance := range c.instances {
+		err = instance.resolvePassword(env)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+func (c *Config) resolvePassword(env map[string]string) error {
+	if len(c.Password) > 0 {
+		return nil
+	}
+
+	if len(c.PasswordFile) > 0 {
+		bytes, err := ioutil.ReadFile(c.PasswordFile)
+		if err != nil {
+			return err
+		}
+		c.Password = strings.TrimRight(string(bytes), "\r\n")
+		return nil
+	}
+
+	passfile := env["PGPASSFILE"]
+	if len(passfile) == 0 {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil
+		}
+		passfile = filepath.Join(home, ".pgpass")
+	}
+	password, err := lookupPgpass(passfile, c.Host, c.Port, c.Database, c.User)
+	if err != nil {
+		return err
+	}
+	c.Password = password
+	return nil
+}
+
+// Command line flags for every config key. Only flags which are explicitly
+// given override the other layers.
+type Flags struct {
+	flagSet *flag.FlagSet
+	values  map[string]*string
+}
+
+func RegisterFlags(flagSet *flag.FlagSet) *Flags {
+	flags := &Flags{flagSet: flagSet, values: make(map[string]*string)}
+	for _, key := range Defaults().keys() {
+		flags.values[key] = flagSet.String(flagName(key), "", fmt.Sprintf("Overrides %s from the config file.", key))
+	}
+	return flags
+}
+
+func (f *Flags) overrides() map[string]string {
+	overrides := make(map[string]string)
+	f.flagSet.Visit(func(fl *flag.Flag) {
+		for key, value := range f.values {
+			if flagName(key) == fl.Name {
+				overrides[key] = *value
+			}
+		}
+	})
+	return overrides
+}
+
+func flagName(key string) string {
+	return strings.Replace(key, "_", "-", -1)
+}
+
+// The yaml keys of every scalar config field.
+func (c *Config) keys() []string {
+	keys := []string{}
+	t := reflect.TypeOf(c).Elem()
+	for i := 0; i < t.NumField(); i++ {
+		key := yamlKey(t.Field(i))
+		if len(key) > 0 && isScalar(t.Field(i).Type) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func yamlKey(field reflect.StructField) string {
+	key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+	if key == "-" {
+		return ""
+	}
+	return key
+}
+
+var durationType = reflect.TypeOf(time.Duration(0))
+
+func isScalar(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.String, reflect.Bool, reflect.Int64, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// Sets the field with the given yaml key from its string form.
+func (c *Config) set(key string, value string) error {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if yamlKey(t.Field(i)) != key {
+			continue
+		}
+
+		field := v.Field(i)
+		switch {
+		case field.Type() == durationType:
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.String:
+			field.SetString(value)
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return err
+			}
+			field.SetBool(b)
+		case field.Kind() == reflect.Int64:
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return err
+			}
+			field.SetInt(n)
+		case field.Kind() == reflect.Float64:
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return err
+			}
+			field.SetFloat(f)
+		default:
+			return fmt.Errorf("err: %s can not be set from a string", key)
+		}
+		return nil
+	}
+	return fmt.Errorf("err: unknown config key %s", key)
+}
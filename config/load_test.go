@@ -0,0 +1,230 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func writeTempFile(t *testing.T, dir string, name string, contents string, perm os.FileMode) string {
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(contents), perm); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadLayersInPrecedenceOrder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgreba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeTempFile(t, dir, "config.yml", `
+host: file-host
+port: 6432
+user: file-user
+database: file-db
+listen_address: ":9000"
+poll_interval: 1s
+password: from-file
+`, 0600)
+
+	flagSet := flag.NewFlagSet("pgreba", flag.ContinueOnError)
+	flags := RegisterFlags(flagSet)
+	if err := flagSet.Parse([]string{"-listen-address", ":9432"}); err != nil {
+		t.Fatal(err)
+	}
+
+	environ := []string{
+		"PGHOST=env-host",
+		"PGUSER=libpq-user",
+		"PGREBA_USER=pgreba-user",
+		"PGREBA_LISTEN_ADDRESS=:9001",
+		"PGREBA_POLL_INTERVAL=2s",
+		"PGREBA_MAX_HOP=3",
+	}
+
+	c, err := Load(path, environ, flags)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Host != "env-host" {
+		t.Fatal("Expected PGHOST to override the file but found:", c.Host)
+	}
+	if c.Port != "6432" || c.Database != "file-db" || c.Password != "from-file" {
+		t.Fatal("Expected file values to be kept:", c.Port, c.Database, c.Password)
+	}
+	if c.User != "pgreba-user" {
+		t.Fatal("Expected PGREBA_USER to override PGUSER but found:", c.User)
+	}
+	if c.ListenAddress != ":9432" {
+		t.Fatal("Expected the flag to override everything but found:", c.ListenAddress)
+	}
+	if c.PollInterval != 2*time.Second || c.MaxHop != 3 {
+		t.Fatal("Expected typed env values to be parsed:", c.PollInterval, c.MaxHop)
+	}
+}
+
+func TestLoadDefaultsWithoutConfigFile(t *testing.T) {
+	c, err := Load("", []string{"PGPASSFILE=/does/not/exist"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.ListenAddress != ":8000" || c.Port != "5432" {
+		t.Fatal("Expected defaults but found:", c.ListenAddress, c.Port)
+	}
+
+	if _, err := Load("", []string{"PGREBA_MAX_HOP=lots"}, nil); err == nil {
+		t.Fatal("Expected an error for an invalid env value")
+	}
+}
+
+func TestLoadPasswordFromPasswordFileAndPgpass(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgreba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	secret := writeTempFile(t, dir, "secret", "hunter2\n", 0600)
+	pgpass := writeTempFile(t, dir, "pgpass", `
+# hostname:port:database:username:password
+other:5432:*:pgreba:wrong
+db1:5432:*:pgreba:pa\:ss\\word
+`, 0600)
+
+	c, err := Load("", []string{"PGREBA_PASSWORD_FILE=" + secret, "PGPASSFILE=" + pgpass}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Password != "hunter2" {
+		t.Fatal("Expected the password from password_file but found:", c.Password)
+	}
+
+	c, err = Load("", []string{"PGHOST=db1", "PGUSER=pgreba", "PGPASSFILE=" + pgpass}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Password != `pa:ss\word` {
+		t.Fatal("Expected the password from pgpass but found:", c.Password)
+	}
+
+	// Like libpq, a pgpass readable by others is ignored.
+	if err := os.Chmod(pgpass, 0644); err != nil {
+		t.Fatal(err)
+	}
+	c, err = Load("", []string{"PGHOST=db1", "PGUSER=pgreba", "PGPASSFILE=" + pgpass}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Password != "" {
+		t.Fatal("Expected an insecure pgpass to be ignored but found:", c.Password)
+	}
+}
+
+func TestDiffMasksPassword(t *testing.T) {
+	old := Defaults()
+	old.Password = "old-secret"
+	new := Defaults()
+	new.Password = "new-secret"
+	new.MaxHop = 3
+
+	changes := []string{}
+	for _, change := range Diff(old, new) {
+		changes = append(changes, change.String())
+	}
+	expected := []string{"password: (changed)", "max_hop: 1 -> 3"}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatal("Unexpected changes:", changes)
+	}
+}
+
+func TestDiffSectionsMasksSecrets(t *testing.T) {
+	old := Defaults()
+	old.Auth = &AuthConfig{Tokens: []AuthToken{{Name: "ops", Token: "0123456789abcdef"}}}
+	old.Proxy = &ProxyConfig{Nodes: []string{"db1:5432"}, CheckInterval: time.Second}
+	new := Defaults()
+	new.Auth = &AuthConfig{Tokens: []AuthToken{{Name: "ops", Token: "fedcba9876543210"}}, AnonymousResponseProfile: "status"}
+	new.Proxy = &ProxyConfig{Nodes: []string{"db1:5432"}, CheckInterval: 2 * time.Second}
+	new.Tracing = &TracingConfig{Exporter: "stdout"}
+
+	changes := []string{}
+	for _, change := range DiffSections(old, new) {
+		changes = append(changes, change.String())
+	}
+	expected := []string{
+		"proxy.check_interval: 1s -> 2s",
+		"auth.tokens[0].token: (changed)",
+		"auth.anonymous_response_profile:  -> status",
+		"tracing.exporter:  -> stdout",
+	}
+	if !reflect.DeepEqual(changes, expected) {
+		t.Fatal("Unexpected changes:", changes)
+	}
+	if len(DiffSections(new, new)) != 0 {
+		t.Fatal("Expected no changes between the same config")
+	}
+}
+
+func TestLoadInstancesInheritTopLevelSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgreba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeTempFile(t, dir, "config.yml", `
+host: localhost
+user: postgres
+database: postgres
+password: shared
+max_hop: 2
+instances:
+  - name: main
+  - name: reporting
+    port: 5433
+    listen_address: ":8009"
+    max_allowable_lag_seconds: 30
+`, 0600)
+
+	c, err := Load(path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	instances := c.Instances()
+	if len(instances) != 2 || instances[0].Name != "main" || instances[1].Name != "reporting" {
+		t.Fatal("Unexpected instances:", instances)
+	}
+	main, reporting := instances[0], instances[1]
+	if main.Port != "5432" || main.ListenAddress != ":8000" || main.MaxHop != 2 {
+		t.Fatal("Expected main to inherit the top level settings:", main.Config)
+	}
+	if reporting.Port != "5433" || reporting.ListenAddress != ":8009" || reporting.MaxAllowableLagSeconds != 30 {
+		t.Fatal("Expected reporting to override settings:", reporting.Config)
+	}
+	if reporting.Password != "shared" || reporting.MaxHop != 2 {
+		t.Fatal("Expected reporting to inherit the other settings:", reporting.Config)
+	}
+}
+
+func TestLoadWithoutInstancesHasOneUnnamedInstance(t *testing.T) {
+	c, err := Load("", nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	instances := c.Instances()
+	if len(instances) != 1 || instances[0].Name != "" || instances[0].Config != c {
+		t.Fatal("Unexpected instances:", instances)
+	}
+}
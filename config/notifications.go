@@ -0,0 +1,84 @@
+package config
+
+import (
+	"net/url"
+	"sort"
+	"time"
+)
+
+// The notification types webhooks can receive.
+var NotificationTypes = []string{
+	"promoted", "demoted", "lag_exceeded", "lag_recovered", "replay_paused", "replay_resumed", "slot_lost",
+}
+
+// Webhooks called when a monitored node changes role or goes bad.
+type NotificationsConfig struct {
+	Webhooks []WebhookConfig `yaml:"webhooks"`
+
+	// A notification type is sent at most once per interval for each node
+	// (default 5m). MinIntervals overrides it per type, e.g. lag_exceeded.
+	MinInterval  time.Duration            `yaml:"min_interval"`
+	MinIntervals map[string]time.Duration `yaml:"min_intervals"`
+
+	// Failed deliveries are retried this many times (default 3), waiting
+	// RetryBackoff (default 1s) before the first retry and doubling after
+	// each. Timeout bounds each attempt (default 10s).
+	MaxRetries   int           `yaml:"max_retries"`
+	RetryBackoff time.Duration `yaml:"retry_backoff"`
+	Timeout      time.Duration `yaml:"timeout"`
+}
+
+// A webhook receives a JSON document per notification. Format "slack" sends a
+// Slack-compatible {"text": ...} payload instead of the generic one.
+type WebhookConfig struct {
+	URL    string `yaml:"url"`
+	Format string `yaml:"format"`
+}
+
+func (nc *NotificationsConfig) validate(problemf func(format string, args ...interface{})) {
+	if len(nc.Webhooks) == 0 {
+		problemf("notifications needs at least one webhook")
+	}
+	for i, webhook := range nc.Webhooks {
+		u, err := url.Parse(webhook.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			problemf("notifications webhooks[%d] url must be an http or https url", i)
+		}
+		switch webhook.Format {
+		case "", "json", "slack":
+		default:
+			problemf("notifications webhooks[%d] format %q must be one of json, slack", i, webhook.Format)
+		}
+	}
+
+	if nc.MinInterval < 0 {
+		problemf("notifications min_interval must not be negative")
+	}
+	known := make(map[string]bool)
+	for _, notificationType := range NotificationTypes {
+		known[notificationType] = true
+	}
+	types := []string{}
+	for notificationType := range nc.MinIntervals {
+		types = append(types, notificationType)
+	}
+	sort.Strings(types)
+	for _, notificationType := range types {
+		if !known[notificationType] {
+			problemf("notifications min_intervals has unknown type %q", notificationType)
+		}
+		if nc.MinIntervals[notificationType] < 0 {
+			problemf("notifications min_intervals %s must not be negative", notificationType)
+		}
+	}
+
+	if nc.MaxRetries < 0 {
+		problemf("notifications max_retries must not be negative")
+	}
+	if nc.RetryBackoff < 0 {
+		problemf("notifications retry_backoff must not be negative")
+	}
+	if nc.Timeout < 0 {
+		problemf("notifications timeout must not be negative")
+	}
+}
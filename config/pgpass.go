@@ -0,0 +1,79 @@
+package config
+
+import (
+	"bufio"
+	"os"
+	"strings"
+)
+
+// Finds the password for a connection in a pgpass file, following libpq: each
+// line is host:port:database:username:password, "*" matches anything, and a
+// backslash escapes ":" or "\". Like libpq, a missing file or one readable by
+// group or others is ignored.
+func lookupPgpass(path, host, port, database, user string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	// libpq treats an empty host and a unix socket as localhost.
+	if len(host) == 0 || strings.HasPrefix(host, "/") {
+		host = "localhost"
+	}
+
+	want := []string{host, port, database, user}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if len(strings.TrimSpace(line)) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := splitPgpassLine(line)
+		if len(fields) != 5 {
+			continue
+		}
+
+		matches := true
+		for i, value := range want {
+			if fields[i] != "*" && fields[i] != value {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return fields[4], nil
+		}
+	}
+	return "", scanner.Err()
+}
+
+func splitPgpassLine(line string) []string {
+	fields := []string{}
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case line[i] == ':' && len(fields) < 4:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
@@ -0,0 +1,40 @@
+package config
+
+import "net/url"
+
+// Traces each request down to the cache, every query and every upstream hop.
+// Spans are sent to an OTLP/HTTP collector, or printed to stdout for local
+// debugging.
+type TracingConfig struct {
+	// otlp (default) or stdout.
+	Exporter string `yaml:"exporter"`
+
+	// The collector's OTLP/HTTP url, e.g. http://collector:4318. Defaults to
+	// the OTEL_EXPORTER_OTLP_ENDPOINT environment variable, then
+	// https://localhost:4318.
+	Endpoint string `yaml:"endpoint"`
+
+	// The share of traces kept, above 0 and up to 1 (default 1). Requests
+	// carrying a traceparent header follow the caller's decision.
+	SampleRatio float64 `yaml:"sample_ratio"`
+}
+
+func (tc *TracingConfig) validate(problemf func(format string, args ...interface{})) {
+	switch tc.Exporter {
+	case "", "otlp", "stdout":
+	default:
+		problemf("tracing exporter %q must be otlp or stdout", tc.Exporter)
+	}
+	if len(tc.Endpoint) > 0 {
+		u, err := url.Parse(tc.Endpoint)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			problemf("tracing endpoint %q must be an http or https url", tc.Endpoint)
+		}
+		if tc.Exporter == "stdout" {
+			problemf("tracing endpoint is only used by the otlp exporter")
+		}
+	}
+	if tc.SampleRatio < 0 || tc.SampleRatio > 1 {
+		problemf("tracing sample_ratio must be between 0 and 1")
+	}
+}
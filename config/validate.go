@@ -0,0 +1,287 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Instances are served under their name, so names which are also routes at
+// the root are taken.
+var reservedInstanceNames = map[string]bool{
+	"metrics": true,
+	"events":  true,
+	"cluster": true,
+}
+
+// Every problem found in a config, so they can all be fixed in one go.
+type ValidationError struct {
+	Problems []string
+}
+
+func (ve *ValidationError) Error() string {
+	return "invalid config:\n  - " + strings.Join(ve.Problems, "\n  - ")
+}
+
+// Checks every field for values that would fail, or silently misbehave, at
+// runtime. Returns a *ValidationError listing all problems.
+func (c *Config) Validate() error {
+	problems := []string{}
+	problemf := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if len(c.instances) == 0 {
+		c.validate(problemf)
+	}
+	switch c.LogFormat {
+	case "", "logfmt", "json":
+	default:
+		problemf("log_format %q must be logfmt or json", c.LogFormat)
+	}
+	switch c.LogLevel {
+	case "", "debug", "info", "warn", "error":
+	default:
+		problemf("log_level %q must be debug, info, warn or error", c.LogLevel)
+	}
+	if c.Proxy != nil {
+		c.Proxy.validate(problemf)
+	}
+	if c.Cluster != nil {
+		c.Cluster.validate(c, problemf)
+	}
+	if c.Auth != nil {
+		c.Auth.validate(c, problemf)
+		// The auth middleware turns away bearer tokens it doesn't know
+		// before they reach /maintenance.
+		for _, instance := range c.Instances() {
+			if len(instance.MaintenanceToken) == 0 {
+				continue
+			}
+			if len(instance.Name) > 0 {
+				problemf("instance %s: maintenance_token can't be used with auth, add it to auth tokens and allow it on /maintenance instead", instance.Name)
+			} else {
+				problemf("maintenance_token can't be used with auth, add it to auth tokens and allow it on /maintenance instead")
+			}
+		}
+	}
+	if c.Tracing != nil {
+		c.Tracing.validate(problemf)
+	}
+	if c.Notifications != nil {
+		c.Notifications.validate(problemf)
+		if c.WatchInterval == 0 {
+			problemf("notifications require watch_interval")
+		}
+	}
+
+	names := make(map[string]bool)
+	listenAddresses := make(map[string]string)
+	agentCheckAddresses := make(map[string]string)
+	maintenanceFiles := make(map[string]string)
+	for _, instance := range c.instances {
+		if !instanceNamePattern.MatchString(instance.Name) {
+			problemf("instance name %q may only contain letters, digits, - and _", instance.Name)
+		}
+		if reservedInstanceNames[instance.Name] {
+			problemf("instance name %q is reserved", instance.Name)
+		}
+		if names[instance.Name] {
+			problemf("instance name %q is used more than once", instance.Name)
+		}
+		names[instance.Name] = true
+
+		if instance.ListenAddress != c.ListenAddress {
+			if other, ok := listenAddresses[instance.ListenAddress]; ok {
+				problemf("instances %s and %s both listen on %s", other, instance.Name, instance.ListenAddress)
+			}
+			listenAddresses[instance.ListenAddress] = instance.Name
+		}
+		if len(instance.AgentCheckAddress) > 0 {
+			if other, ok := agentCheckAddresses[instance.AgentCheckAddress]; ok {
+				problemf("instances %s and %s both serve agent checks on %s", other, instance.Name, instance.AgentCheckAddress)
+			}
+			agentCheckAddresses[instance.AgentCheckAddress] = instance.Name
+		}
+		if len(instance.MaintenanceFile) > 0 {
+			if other, ok := maintenanceFiles[instance.MaintenanceFile]; ok {
+				problemf("instances %s and %s both use maintenance_file %s", other, instance.Name, instance.MaintenanceFile)
+			}
+			maintenanceFiles[instance.MaintenanceFile] = instance.Name
+		}
+
+		instance.validate(func(format string, args ...interface{}) {
+			problemf("instance %s: "+format, append([]interface{}{instance.Name}, args...)...)
+		})
+	}
+
+	if len(problems) > 0 {
+		return &ValidationError{Problems: problems}
+	}
+	return nil
+}
+
+func (c *Config) validate(problemf func(format string, args ...interface{})) {
+	// Postgres connection
+	if strings.ContainsAny(c.Host, " \t") {
+		problemf("host %q must not contain whitespace", c.Host)
+	}
+	if port, err := strconv.Atoi(c.Port); err != nil || port < 1 || port > 65535 {
+		problemf("port %q must be a number between 1 and 65535", c.Port)
+	}
+	if len(c.Database) == 0 {
+		problemf("database is required")
+	}
+	if len(c.User) == 0 {
+		problemf("user is required")
+	}
+	switch c.Sslmode {
+	case "", "disable", "require", "verify-ca", "verify-full":
+	default:
+		problemf("sslmode %q must be one of disable, require, verify-ca or verify-full", c.Sslmode)
+	}
+	switch c.BinaryParameters {
+	case "", "yes", "no":
+	default:
+		problemf("binary_parameters %q must be yes or no", c.BinaryParameters)
+	}
+	if len(c.PasswordFile) > 0 {
+		if _, err := os.Stat(c.PasswordFile); err != nil {
+			problemf("password_file: %v", err)
+		}
+	}
+	if c.MaxHop < 1 {
+		problemf("max_hop must be at least 1 to measure replica lag, found %d", c.MaxHop)
+	}
+
+	// Thresholds
+	if c.MaxAllowableLagSeconds < 0 {
+		problemf("max_allowable_lag_seconds must not be negative")
+	}
+	if c.MinSafeWalSize < 0 {
+		problemf("min_safe_wal_size must not be negative")
+	}
+	if c.MaxRetainedWalBytes < 0 {
+		problemf("max_retained_wal_bytes must not be negative")
+	}
+
+	// HTTP server
+	if _, _, err := net.SplitHostPort(c.ListenAddress); err != nil {
+		problemf("listen_address %q must be host:port, e.g. :8000", c.ListenAddress)
+	}
+	if (len(c.TLSCertFile) == 0) != (len(c.TLSKeyFile) == 0) {
+		problemf("tls_cert_file and tls_key_file must be set together")
+	}
+	if len(c.TLSClientCAFile) > 0 && len(c.TLSCertFile) == 0 {
+		problemf("tls_client_ca_file requires tls_cert_file and tls_key_file")
+	}
+	tlsFiles := []struct{ key, path string }{
+		{"tls_cert_file", c.TLSCertFile},
+		{"tls_key_file", c.TLSKeyFile},
+		{"tls_client_ca_file", c.TLSClientCAFile},
+	}
+	for _, file := range tlsFiles {
+		if len(file.path) == 0 {
+			continue
+		}
+		if _, err := os.Stat(file.path); err != nil {
+			problemf("%s: %v", file.key, err)
+		}
+	}
+
+	if c.WatchInterval < 0 {
+		problemf("watch_interval must not be negative")
+	}
+
+	// HAProxy agent-check
+	if len(c.AgentCheckAddress) > 0 {
+		if _, _, err := net.SplitHostPort(c.AgentCheckAddress); err != nil {
+			problemf("agent_check_address %q must be host:port, e.g. :8010", c.AgentCheckAddress)
+		}
+	}
+	if c.AgentCheckMaxByteLag < 0 {
+		problemf("agent_check_max_byte_lag must not be negative")
+	}
+	if c.AgentCheckMaxLagSeconds < 0 {
+		problemf("agent_check_max_lag_seconds must not be negative")
+	}
+	switch c.AgentCheckMaintenanceState {
+	case "", "drain", "maint":
+	default:
+		problemf("agent_check_maintenance_state %q must be drain or maint", c.AgentCheckMaintenanceState)
+	}
+
+	// Maintenance mode
+	if len(c.MaintenanceFile) > 0 {
+		if info, err := os.Stat(filepath.Dir(c.MaintenanceFile)); err != nil || !info.IsDir() {
+			problemf("maintenance_file %q must be in an existing directory", c.MaintenanceFile)
+		}
+	}
+	if len(c.MaintenanceToken) > 0 && len(c.MaintenanceFile) == 0 {
+		problemf("maintenance_token requires maintenance_file")
+	}
+
+	switch c.ResponseProfile {
+	case "", "status", "summary", "full":
+	default:
+		problemf("response_profile %q must be status, summary or full", c.ResponseProfile)
+	}
+
+	// Background polling
+	if c.PollInterval < 0 {
+		problemf("poll_interval must not be negative")
+	}
+	if c.MaxStaleness < 0 {
+		problemf("max_staleness must not be negative")
+	}
+	if c.MaxStaleness > 0 && c.PollInterval == 0 {
+		problemf("max_staleness requires poll_interval")
+	}
+	if c.MaxStaleness > 0 && c.MaxStaleness < c.PollInterval {
+		problemf("max_staleness %s must not be shorter than poll_interval %s", c.MaxStaleness, c.PollInterval)
+	}
+}
+
+func (pc *ProxyConfig) validate(problemf func(format string, args ...interface{})) {
+	if len(pc.PrimaryAddress) == 0 && len(pc.ReplicaAddress) == 0 {
+		problemf("proxy needs a primary_address, a replica_address or both")
+	}
+	addresses := []struct{ key, address string }{
+		{"primary_address", pc.PrimaryAddress},
+		{"replica_address", pc.ReplicaAddress},
+	}
+	for _, listen := range addresses {
+		if len(listen.address) == 0 {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(listen.address); err != nil {
+			problemf("proxy %s %q must be host:port, e.g. :6432", listen.key, listen.address)
+		}
+	}
+	if len(pc.PrimaryAddress) > 0 && pc.PrimaryAddress == pc.ReplicaAddress {
+		problemf("proxy primary_address and replica_address must differ")
+	}
+	if len(pc.Nodes) == 0 {
+		problemf("proxy needs at least one node")
+	}
+	for _, node := range pc.Nodes {
+		if _, _, err := net.SplitHostPort(node); err != nil {
+			problemf("proxy node %q must be host:port", node)
+		}
+	}
+	if pc.CheckInterval < 0 {
+		problemf("proxy check_interval must not be negative")
+	}
+	if pc.DrainTimeout < 0 {
+		problemf("proxy drain_timeout must not be negative")
+	}
+	if pc.MaxByteLag < 0 {
+		problemf("proxy max_byte_lag must not be negative")
+	}
+	if pc.MaxLagSeconds < 0 {
+		problemf("proxy max_lag_seconds must not be negative")
+	}
+}
@@ -0,0 +1,316 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func validConfig() *Config {
+	c := Defaults()
+	c.Host = "localhost"
+	c.Database = "postgres"
+	c.User = "postgres"
+	return c
+}
+
+func TestValidateAcceptsDefaults(t *testing.T) {
+	if err := validConfig().Validate(); err != nil {
+		t.Fatal("Expected a valid config but found:", err)
+	}
+}
+
+func TestValidateReportsEveryProblem(t *testing.T) {
+	c := validConfig()
+	c.Port = "abc"
+	c.Sslmode = "prefer"
+	c.MaxHop = 0
+	c.TLSCertFile = "/nonexistent/cert.pem"
+	c.PollInterval = 10 * time.Second
+	c.MaxStaleness = time.Second
+	c.LogFormat = "apache"
+	c.LogLevel = "verbose"
+
+	err := c.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatal("Expected a validation error but found:", err)
+	}
+
+	expected := []string{
+		`port "abc" must be a number between 1 and 65535`,
+		`sslmode "prefer" must be one of`,
+		"max_hop must be at least 1",
+		"tls_cert_file and tls_key_file must be set together",
+		"tls_cert_file: stat /nonexistent/cert.pem",
+		"max_staleness 1s must not be shorter than poll_interval 10s",
+		`log_format "apache" must be logfmt or json`,
+		`log_level "verbose" must be debug, info, warn or error`,
+	}
+	if len(ve.Problems) != len(expected) {
+		t.Fatal("Unexpected problems:", ve.Problems)
+	}
+	for i, prefix := range expected {
+		if !strings.HasPrefix(ve.Problems[i], prefix) {
+			t.Fatalf("Expected problem %d to start with %q but found %q", i, prefix, ve.Problems[i])
+		}
+	}
+}
+
+func TestParseConfigRejectsUnknownKeys(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgreba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := writeTempFile(t, dir, "config.yml", "host: localhost\nmax_hops: 3\n", 0600)
+	_, err = ParseConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "max_hops") {
+		t.Fatal("Expected the unknown key to be rejected but found:", err)
+	}
+}
+
+func TestValidateInstances(t *testing.T) {
+	c := validConfig()
+	c.InstanceSettings = []map[string]string{
+		{"name": "db1"},
+		{"name": "db1", "listen_address": ":8001"},
+		{"name": "db/2", "listen_address": ":8001", "port": "0"},
+	}
+	if err := c.resolveInstances(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatal("Expected a validation error but found:", err)
+	}
+	expected := []string{
+		`instance name "db1" is used more than once`,
+		`instance name "db/2" may only contain letters, digits, - and _`,
+		"instances db1 and db/2 both listen on :8001",
+		`instance db/2: port "0" must be a number between 1 and 65535`,
+	}
+	if !reflect.DeepEqual(ve.Problems, expected) {
+		t.Fatal("Unexpected problems:", ve.Problems)
+	}
+}
+
+func TestValidateReservedInstanceNames(t *testing.T) {
+	c := validConfig()
+	c.InstanceSettings = []map[string]string{
+		{"name": "metrics"},
+		{"name": "events", "listen_address": ":8001"},
+		{"name": "cluster", "listen_address": ":8002"},
+		{"name": "main", "listen_address": ":8003"},
+	}
+	if err := c.resolveInstances(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatal("Expected a validation error but found:", err)
+	}
+	expected := []string{
+		`instance name "metrics" is reserved`,
+		`instance name "events" is reserved`,
+		`instance name "cluster" is reserved`,
+	}
+	if !reflect.DeepEqual(ve.Problems, expected) {
+		t.Fatal("Unexpected problems:", ve.Problems)
+	}
+}
+
+func TestValidateMaintenance(t *testing.T) {
+	c := validConfig()
+	c.AgentCheckMaintenanceState = "stopped"
+	c.InstanceSettings = []map[string]string{
+		{"name": "db1", "maintenance_file": "/tmp/db1.maintenance"},
+		{"name": "db2", "maintenance_file": "/tmp/db1.maintenance"},
+		{"name": "db3", "maintenance_file": "", "maintenance_token": "secret"},
+	}
+	if err := c.resolveInstances(); err != nil {
+		t.Fatal(err)
+	}
+
+	err := c.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatal("Expected a validation error but found:", err)
+	}
+	expected := []string{
+		`instance db1: agent_check_maintenance_state "stopped" must be drain or maint`,
+		"instances db1 and db2 both use maintenance_file /tmp/db1.maintenance",
+		`instance db2: agent_check_maintenance_state "stopped" must be drain or maint`,
+		`instance db3: agent_check_maintenance_state "stopped" must be drain or maint`,
+		"instance db3: maintenance_token requires maintenance_file",
+	}
+	if !reflect.DeepEqual(ve.Problems, expected) {
+		t.Fatal("Unexpected problems:", ve.Problems)
+	}
+}
+
+func TestValidateProxy(t *testing.T) {
+	c := validConfig()
+	c.Proxy = &ProxyConfig{
+		PrimaryAddress: ":6432",
+		ReplicaAddress: ":6432",
+		Nodes:          []string{"db1:5432", "db2"},
+	}
+
+	err := c.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatal("Expected a validation error but found:", err)
+	}
+	expected := []string{
+		"proxy primary_address and replica_address must differ",
+		`proxy node "db2" must be host:port`,
+	}
+	if !reflect.DeepEqual(ve.Problems, expected) {
+		t.Fatal("Unexpected problems:", ve.Problems)
+	}
+}
+
+func TestValidateCluster(t *testing.T) {
+	c := validConfig()
+	c.Cluster = &ClusterConfig{Members: []ClusterMember{
+		{Name: "db1", DSN: "host=db1 port=5432"},
+		{Name: "db1", URL: "http://db2:8000"},
+		{Name: "db3", DSN: "host=db3 target_session_attrs=any"},
+		{Name: "db4", URL: "db4:8000"},
+		{Name: "db5"},
+		{Name: "db6", DSN: "host=db6", Token: "secret"},
+		{Name: "db7", URL: "http://db7:8000", Token: "secret"},
+	}}
+
+	err := c.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatal("Expected a validation error but found:", err)
+	}
+	expected := []string{
+		`cluster member name "db1" is used more than once`,
+		"cluster member db3: err: unsupported dsn setting target_session_attrs",
+		`cluster member db4 url "db4:8000" must be an http or https url`,
+		"cluster member db5 needs a dsn or a url",
+		"cluster member db6 token is only sent to a url",
+	}
+	if !reflect.DeepEqual(ve.Problems, expected) {
+		t.Fatal("Unexpected problems:", ve.Problems)
+	}
+}
+
+func TestValidateNotifications(t *testing.T) {
+	c := validConfig()
+	c.Notifications = &NotificationsConfig{
+		Webhooks: []WebhookConfig{
+			{URL: "https://hooks.slack.com/services/T0/B0/x", Format: "slack"},
+			{URL: "hooks.example.com", Format: "xml"},
+		},
+		MinIntervals: map[string]time.Duration{"promoted": 0, "lagging": time.Minute, "demoted": -time.Second},
+		MaxRetries:   -1,
+	}
+
+	err := c.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatal("Expected a validation error but found:", err)
+	}
+	expected := []string{
+		"notifications webhooks[1] url must be an http or https url",
+		`notifications webhooks[1] format "xml" must be one of json, slack`,
+		"notifications min_intervals demoted must not be negative",
+		`notifications min_intervals has unknown type "lagging"`,
+		"notifications max_retries must not be negative",
+	}
+	if !reflect.DeepEqual(ve.Problems, expected) {
+		t.Fatal("Unexpected problems:", ve.Problems)
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	c := validConfig()
+	c.Auth = &AuthConfig{
+		Tokens: []AuthToken{
+			{Name: "ops", Token: "0123456789abcdef"},
+			{Name: "ci", Token: "short"},
+		},
+		Users:              []AuthUser{{Name: "ops", PasswordHash: "hunter2"}},
+		ClientCertificates: []string{"haproxy.example.com"},
+		Rules: []AuthRule{
+			{Paths: []string{"replica", "/slot/["}, Methods: []string{"get"}},
+			{Paths: []string{"/maintenance"}, Anonymous: true, Allow: []string{"nobody"}},
+		},
+		AnonymousResponseProfile: "everything",
+	}
+	c.ResponseProfile = "brief"
+
+	err := c.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatal("Expected a validation error but found:", err)
+	}
+	expected := []string{
+		`response_profile "brief" must be status, summary or full`,
+		"auth token ci must be at least 16 characters",
+		`auth name "ops" is used more than once`,
+		"auth user ops password_hash must be a bcrypt hash",
+		"auth client_certificates requires tls_client_ca_file",
+		`auth anonymous_response_profile "everything" must be status, summary or full`,
+		`auth rules[0] path "replica" must be a pattern starting with /`,
+		`auth rules[0] path "/slot/[" must be a pattern starting with /`,
+		`auth rules[0] method "get" must be upper case`,
+		"auth rules[1] can't be anonymous and allow specific names",
+		`auth rules[1] allows unknown name "nobody"`,
+	}
+	if !reflect.DeepEqual(ve.Problems, expected) {
+		t.Fatal("Unexpected problems:", ve.Problems)
+	}
+
+	rule := (&AuthConfig{}).Rule("/slot/main", "HEAD")
+	if rule != nil {
+		t.Fatal("Expected no default rule for slots but found", rule)
+	}
+	rule = (&AuthConfig{}).Rule("/replica", "HEAD")
+	if rule == nil || !rule.Anonymous {
+		t.Fatal("Expected health checks to be anonymous by default")
+	}
+}
+
+func TestValidateTracing(t *testing.T) {
+	c := validConfig()
+	c.Tracing = &TracingConfig{Exporter: "stdout", Endpoint: "collector:4318", SampleRatio: 2}
+
+	err := c.Validate()
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatal("Expected a validation error but found:", err)
+	}
+	expected := []string{
+		`tracing endpoint "collector:4318" must be an http or https url`,
+		"tracing endpoint is only used by the otlp exporter",
+		"tracing sample_ratio must be between 0 and 1",
+	}
+	if !reflect.DeepEqual(ve.Problems, expected) {
+		t.Fatal("Unexpected problems:", ve.Problems)
+	}
+}
+
+func TestClusterMemberConnectionConfig(t *testing.T) {
+	member := ClusterMember{Name: "db2", DSN: "postgresql://replica@db2:5433/app"}
+	c, err := member.ConnectionConfig(validConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Host != "db2" || c.Port != "5433" || c.Database != "app" || c.User != "replica" {
+		t.Fatal("Expected the dsn to override the top level settings:", c)
+	}
+}
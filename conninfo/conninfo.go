@@ -0,0 +1,278 @@
+package conninfo
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+var (
+	ErrMissingEquals     = errors.New("err: missing \"=\" after keyword in conninfo")
+	ErrUnterminatedQuote = errors.New("err: unterminated quoted string in conninfo")
+	ErrInvalidURI        = errors.New("err: invalid connection URI")
+)
+
+// A single entry of a (possibly multi-host) conninfo.
+type Host struct {
+	Host string
+	Port string
+}
+
+// Parses a libpq connection string in either keyword/value form
+// ("host=db1 options='-c x=y'") or URI form
+// ("postgresql://user@db1:5432,db2:5433/postgres?sslmode=require").
+func Parse(conninfo string) (map[string]string, error) {
+	if strings.HasPrefix(conninfo, "postgresql://") || strings.HasPrefix(conninfo, "postgres://") {
+		return parseURI(conninfo)
+	}
+	return parseKeywordValue(conninfo)
+}
+
+// Follows libpq's conninfo_parse: whitespace around "=" is allowed, values may
+// be single-quoted, and a backslash escapes the next character in both quoted
+// and unquoted values.
+func parseKeywordValue(conninfo string) (map[string]string, error) {
+	params := make(map[string]string)
+	s := []rune(conninfo)
+	i := 0
+
+	skipSpace := func() {
+		for i < len(s) && isSpace(s[i]) {
+			i++
+		}
+	}
+
+	for {
+		skipSpace()
+		if i >= len(s) {
+			return params, nil
+		}
+
+		// Keyword
+		start := i
+		for i < len(s) && !isSpace(s[i]) && s[i] != '=' {
+			i++
+		}
+		keyword := string(s[start:i])
+
+		skipSpace()
+		if i >= len(s) || s[i] != '=' {
+			return nil, fmt.Errorf("%w: %q", ErrMissingEquals, keyword)
+		}
+		i++
+		skipSpace()
+
+		// Value
+		var value strings.Builder
+		if i < len(s) && s[i] == '\'' {
+			i++
+			terminated := false
+			for i < len(s) {
+				if s[i] == '\\' && i+1 < len(s) {
+					value.WriteRune(s[i+1])
+					i += 2
+					continue
+				}
+				if s[i] == '\'' {
+					i++
+					terminated = true
+					break
+				}
+				value.WriteRune(s[i])
+				i++
+			}
+			if !terminated {
+				return nil, ErrUnterminatedQuote
+			}
+		} else {
+			for i < len(s) && !isSpace(s[i]) {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				value.WriteRune(s[i])
+				i++
+			}
+		}
+
+		params[keyword] = value.String()
+	}
+}
+
+// Follows libpq's conninfo_uri_parse, including comma separated host lists
+// and bracketed IPv6 addresses.
+func parseURI(uri string) (map[string]string, error) {
+	params := make(map[string]string)
+
+	rest := uri[strings.Index(uri, "://")+len("://"):]
+
+	// Split off the query string and then the dbname.
+	query := ""
+	if idx := strings.Index(rest, "?"); idx >= 0 {
+		rest, query = rest[:idx], rest[idx+1:]
+	}
+	netloc := rest
+	if idx := strings.Index(rest, "/"); idx >= 0 {
+		netloc = rest[:idx]
+		dbname, err := url.PathUnescape(rest[idx+1:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidURI, err)
+		}
+		if len(dbname) > 0 {
+			params["dbname"] = dbname
+		}
+	}
+
+	// user[:password]@
+	if idx := strings.LastIndex(netloc, "@"); idx >= 0 {
+		userinfo := netloc[:idx]
+		netloc = netloc[idx+1:]
+
+		user, password := userinfo, ""
+		hasPassword := false
+		if colon := strings.Index(userinfo, ":"); colon >= 0 {
+			user, password, hasPassword = userinfo[:colon], userinfo[colon+1:], true
+		}
+		var err error
+		if params["user"], err = url.PathUnescape(user); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidURI, err)
+		}
+		if len(params["user"]) == 0 {
+			delete(params, "user")
+		}
+		if hasPassword {
+			if params["password"], err = url.PathUnescape(password); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidURI, err)
+			}
+		}
+	}
+
+	// host[:port][,host[:port]...]
+	if len(netloc) > 0 {
+		hosts := []string{}
+		ports := []string{}
+		hasPort := false
+		for _, hostspec := range strings.Split(netloc, ",") {
+			host, port, err := splitHostPort(hostspec)
+			if err != nil {
+				return nil, err
+			}
+			if host, err = url.PathUnescape(host); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidURI, err)
+			}
+			hosts = append(hosts, host)
+			ports = append(ports, port)
+			hasPort = hasPort || len(port) > 0
+		}
+		if joined := strings.Join(hosts, ","); len(strings.Trim(joined, ",")) > 0 {
+			params["host"] = joined
+		}
+		if hasPort {
+			params["port"] = strings.Join(ports, ",")
+		}
+	}
+
+	// Query params override anything set above.
+	if len(query) > 0 {
+		for _, pair := range strings.Split(query, "&") {
+			if len(pair) == 0 {
+				continue
+			}
+			eq := strings.Index(pair, "=")
+			if eq < 0 {
+				return nil, fmt.Errorf("%w: %q", ErrMissingEquals, pair)
+			}
+			key, err := url.QueryUnescape(pair[:eq])
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidURI, err)
+			}
+			value, err := url.QueryUnescape(pair[eq+1:])
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrInvalidURI, err)
+			}
+
+			// JDBC style ssl=true is accepted by libpq as sslmode=require.
+			if key == "ssl" && value == "true" {
+				key, value = "sslmode", "require"
+			}
+			params[key] = value
+		}
+	}
+
+	return params, nil
+}
+
+func splitHostPort(hostspec string) (string, string, error) {
+	if strings.HasPrefix(hostspec, "[") {
+		end := strings.Index(hostspec, "]")
+		if end < 0 {
+			return "", "", fmt.Errorf("%w: missing \"]\" in %q", ErrInvalidURI, hostspec)
+		}
+		host, rest := hostspec[1:end], hostspec[end+1:]
+		if len(rest) == 0 {
+			return host, "", nil
+		}
+		if !strings.HasPrefix(rest, ":") {
+			return "", "", fmt.Errorf("%w: unexpected %q after IPv6 host", ErrInvalidURI, rest)
+		}
+		return host, rest[1:], nil
+	}
+
+	if idx := strings.LastIndex(hostspec, ":"); idx >= 0 {
+		return hostspec[:idx], hostspec[idx+1:], nil
+	}
+	return hostspec, "", nil
+}
+
+// Formats params as a keyword/value conninfo in a stable order, quoting and
+// escaping values as needed.
+func Format(params map[string]string) string {
+	keys := make([]string, 0, len(params))
+	for key := range params {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, 0, len(keys))
+	for _, key := range keys {
+		parts = append(parts, key+"="+quote(params[key]))
+	}
+	return strings.Join(parts, " ")
+}
+
+func quote(value string) string {
+	if len(value) > 0 && !strings.ContainsAny(value, " \t\n\r\f\v'\\") {
+		return value
+	}
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)
+	return "'" + escaped + "'"
+}
+
+// Expands the host (or hostaddr) and port lists into one entry per host. Like
+// libpq, a single port applies to every host.
+func Hosts(params map[string]string) []Host {
+	hosts := strings.Split(params["host"], ",")
+	if len(params["host"]) == 0 && len(params["hostaddr"]) > 0 {
+		hosts = strings.Split(params["hostaddr"], ",")
+	}
+	ports := strings.Split(params["port"], ",")
+
+	entries := make([]Host, 0, len(hosts))
+	for i, host := range hosts {
+		port := ports[0]
+		if len(ports) > 1 && i < len(ports) {
+			port = ports[i]
+		}
+		entries = append(entries, Host{Host: host, Port: port})
+	}
+	return entries
+}
+
+func isSpace(r rune) bool {
+	switch r {
+	case ' ', '\t', '\n', '\r', '\f', '\v':
+		return true
+	}
+	return false
+}
@@ -1,22 +1,27 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
-	"strings"
+	"log/slog"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/film42/pgreba/config"
+	"github.com/film42/pgreba/conninfo"
 	"github.com/jmoiron/sqlx"
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/volatiletech/null.v6"
 )
 
-func sqlConnect(connInfo string) (*sqlx.DB, error) {
-	db, err := sqlx.Connect("postgres", connInfo)
+func sqlConnect(ctx context.Context, connInfo string) (*sqlx.DB, error) {
+	db, err := sqlx.ConnectContext(ctx, "postgres", connInfo)
 	if err != nil {
 		return nil, err
 	}
@@ -28,41 +33,62 @@ func sqlConnect(connInfo string) (*sqlx.DB, error) {
 // Postgres repication data models
 
 type PgReplicationSlot struct {
-	SlotName          string      `db:"slot_name"`
-	Plugin            string      `db:"plugin"`
-	SlotType          string      `db:"slot_type"`
-	Datoid            string      `db:"datoid"`
-	Database          string      `db:"database"`
-	Temporary         bool        `db:"temporary"`
-	Active            bool        `db:"active"`
-	ActivePid         null.String `db:"active_pid"`
-	Xmin              null.String `db:"xmin"`
-	CatalogXmin       string      `db:"catalog_xmin"`
-	RestartLsn        string      `db:"restart_lsn"`
-	ConfirmedFlushLsn string      `db:"confirmed_flush_lsn"`
+	SlotName          string      `db:"slot_name" json:"slot_name"`
+	Plugin            null.String `db:"plugin" json:"plugin"`
+	SlotType          string      `db:"slot_type" json:"slot_type"`
+	Datoid            null.String `db:"datoid" json:"datoid"`
+	Database          null.String `db:"database" json:"database"`
+	Temporary         bool        `db:"temporary" json:"temporary"`
+	Active            bool        `db:"active" json:"active"`
+	ActivePid         null.String `db:"active_pid" json:"active_pid"`
+	Xmin              null.String `db:"xmin" json:"xmin"`
+	CatalogXmin       null.String `db:"catalog_xmin" json:"catalog_xmin"`
+	RestartLsn        null.String `db:"restart_lsn" json:"restart_lsn"`
+	ConfirmedFlushLsn null.String `db:"confirmed_flush_lsn" json:"confirmed_flush_lsn"`
 	//pg13 columns
-	WalStatus   string      `db:"wal_status"`
-	SafeWalSize null.String `db:"safe_wal_size"`
+	WalStatus   null.String `db:"wal_status" json:"wal_status"`
+	SafeWalSize null.Int64  `db:"safe_wal_size" json:"safe_wal_size"`
+	// Bytes of WAL held back by restart_lsn
+	RetainedWalBytes null.Int64 `db:"retained_wal_bytes" json:"retained_wal_bytes"`
+	// Bytes a logical slot's consumer has yet to confirm
+	ConfirmedFlushLagBytes null.Int64 `db:"confirmed_flush_lag_bytes" json:"confirmed_flush_lag_bytes"`
+}
+
+type PgStatSubscription struct {
+	SubId              string      `db:"subid" json:"subid"`
+	SubName            string      `db:"subname" json:"subname"`
+	Pid                null.String `db:"pid" json:"pid"`
+	ReceivedLsn        null.String `db:"received_lsn" json:"received_lsn"`
+	LastMsgSendTime    null.String `db:"last_msg_send_time" json:"last_msg_send_time"`
+	LastMsgReceiptTime null.String `db:"last_msg_receipt_time" json:"last_msg_receipt_time"`
+	LatestEndLsn       null.String `db:"latest_end_lsn" json:"latest_end_lsn"`
+	LatestEndTime      null.String `db:"latest_end_time" json:"latest_end_time"`
+	// Bytes received but not yet applied and reported back to the publisher
+	ApplyLagBytes null.Int64 `db:"apply_lag_bytes" json:"apply_lag_bytes"`
+	// Seconds since the publisher sent the last message we processed
+	ApplyLagSeconds null.Float64 `db:"apply_lag_seconds" json:"apply_lag_seconds"`
+	// Seconds since latest_end_lsn was last reported to the publisher
+	LatestEndAgeSeconds null.Float64 `db:"latest_end_age_seconds" json:"latest_end_age_seconds"`
 }
 
 type PgStatWalReceiver struct {
-	Pid                string `db:"pid"`
-	Status             string `db:"status"`
-	ReceivedLsn        string `db:"received_lsn"`
-	ReceivedTli        string `db:"received_tli"`
-	ReceiveStartLsn    string `db:"receive_start_lsn"`
-	ReceiveStartTli    string `db:"receive_start_tli"`
-	LastMsgSendTime    string `db:"last_msg_send_time"`
-	LastMsgReceiptTime string `db:"last_msg_receipt_time"`
-	LatestEndLsn       string `db:"latest_end_lsn"`
-	LatestEndTime      string `db:"latest_end_time"`
-	SlotName           string `db:"slot_name"`
-	ConnInfo           string `db:"conninfo"`
+	Pid                string      `db:"pid"`
+	Status             string      `db:"status"`
+	ReceivedLsn        null.String `db:"received_lsn"`
+	ReceivedTli        null.String `db:"received_tli"`
+	ReceiveStartLsn    null.String `db:"receive_start_lsn"`
+	ReceiveStartTli    null.String `db:"receive_start_tli"`
+	LastMsgSendTime    null.String `db:"last_msg_send_time"`
+	LastMsgReceiptTime null.String `db:"last_msg_receipt_time"`
+	LatestEndLsn       null.String `db:"latest_end_lsn"`
+	LatestEndTime      null.String `db:"latest_end_time"`
+	SlotName           null.String `db:"slot_name"`
+	ConnInfo           null.String `db:"conninfo"`
 	//pg13 columns
-	WrittenLsn string `db:"written_lsn"`
-	FlushedLsn string `db:"flushed_lsn"`
-	SenderHost string `db:"sender_host"`
-	SenderPort string `db:"sender_port"`
+	WrittenLsn null.String `db:"written_lsn"`
+	FlushedLsn null.String `db:"flushed_lsn"`
+	SenderHost null.String `db:"sender_host"`
+	SenderPort null.String `db:"sender_port"`
 }
 
 type PgStatReplication struct {
@@ -112,6 +138,13 @@ type NodeInfo struct {
 	Xlog                *XlogInfo          `json:"xlog"`
 	Replication         []*ReplicationInfo `json:"replication"`
 	ByteLag             int64              `json:"byte_lag"`
+	LagSeconds          null.Float64       `json:"lag_seconds"`
+	// Unlike State, also set for replicas while their wal receiver runs.
+	Timeline null.Int64 `json:"timeline"`
+	// For replicas, the timeline and current WAL location of the primary
+	// at the top of the replication chain.
+	UpstreamTimeline null.Int64 `json:"upstream_timeline"`
+	UpstreamLocation null.Int64 `json:"upstream_location"`
 }
 
 func (ni *NodeInfo) IsPrimary() bool {
@@ -129,10 +162,15 @@ func (sr *PgStatReplication) LagFromUpstream() time.Duration {
 
 // Generic type useful for mocking out the health checking logic.
 type ReplicationDataSource interface {
-	GetNodeInfo() (*NodeInfo, error)
-	IsInRecovery() (bool, error)
-	GetPgStatReplication() ([]*PgStatReplication, error)
-	GetPgReplicationSlots() ([]*PgReplicationSlot, error)
+	GetNodeInfo(ctx context.Context) (*NodeInfo, error)
+	GetNodeStatus(ctx context.Context) (*NodeInfo, error)
+	GetLocalNodeStatus(ctx context.Context) (*NodeInfo, error)
+	IsInRecovery(ctx context.Context) (bool, error)
+	GetPgStatReplication(ctx context.Context) ([]*PgStatReplication, error)
+	GetPgReplicationSlots(ctx context.Context) ([]*PgReplicationSlot, error)
+	GetSyncState(ctx context.Context) (string, error)
+	GetTopology(ctx context.Context) (*Topology, error)
+	GetPgStatSubscription(ctx context.Context) ([]*PgStatSubscription, error)
 	Close() error
 }
 
@@ -147,6 +185,38 @@ func NewPgReplicationDataSource(config *config.Config) ReplicationDataSource {
 	return &pgDataSource{cfg: config, dbMutex: sync.Mutex{}}
 }
 
+// How long a connection pool replaced by a reload stays open, so checks which
+// already hold it can finish their queries.
+const reloadGracePeriod = 5 * time.Second
+
+// Swaps in a reloaded config. When the connection settings changed, the next
+// check connects with the new settings and the old pool is closed once
+// in-flight checks had time to finish.
+func (ds *pgDataSource) Reload(cfg *config.Config) {
+	ds.dbMutex.Lock()
+	defer ds.dbMutex.Unlock()
+
+	connInfoChanged := localConnInfo(ds.cfg) != localConnInfo(cfg)
+	ds.cfg = cfg
+	if !connInfoChanged || ds.db == nil {
+		return
+	}
+
+	oldDb := ds.db
+	ds.db = nil
+	time.AfterFunc(reloadGracePeriod, func() {
+		if err := oldDb.Close(); err != nil {
+			slog.Error("Error closing replaced connection pool", "error", err)
+		}
+	})
+}
+
+func (ds *pgDataSource) getConfig() *config.Config {
+	ds.dbMutex.Lock()
+	defer ds.dbMutex.Unlock()
+	return ds.cfg
+}
+
 func (ds *pgDataSource) Close() error {
 	ds.dbMutex.Lock()
 	defer ds.dbMutex.Unlock()
@@ -158,15 +228,15 @@ func (ds *pgDataSource) Close() error {
 	return err
 }
 
-func (ds *pgDataSource) getDB() (*sqlx.DB, error) {
+func (ds *pgDataSource) getDB(ctx context.Context) (*sqlx.DB, error) {
 	ds.dbMutex.Lock()
 	defer ds.dbMutex.Unlock()
 	if ds.db != nil {
 		return ds.db, nil
 	}
-	db, err := sqlConnect(fmt.Sprintf("host=%s port=%s database=%s user=%s sslmode=%s binary_parameters=%s", ds.cfg.Host, ds.cfg.Port, ds.cfg.Database, ds.cfg.User, ds.cfg.Sslmode, ds.cfg.BinaryParameters))
+	db, err := sqlConnect(ctx, localConnInfo(ds.cfg))
 	if err != nil {
-		fmt.Println("Error creating a connection pool.")
+		slog.ErrorContext(ctx, "Error creating a connection pool", "error", err)
 		return nil, err
 	}
 	ds.db = db
@@ -174,7 +244,67 @@ func (ds *pgDataSource) getDB() (*sqlx.DB, error) {
 	return db, nil
 }
 
-func (ds *pgDataSource) GetNodeInfo() (*NodeInfo, error) {
+func localConnInfo(cfg *config.Config) string {
+	params := map[string]string{
+		"host":              cfg.Host,
+		"port":              cfg.Port,
+		"dbname":            cfg.Database,
+		"user":              cfg.User,
+		"sslmode":           cfg.Sslmode,
+		"binary_parameters": cfg.BinaryParameters,
+		"password":          cfg.Password,
+	}
+	// Leave unset settings to the driver defaults.
+	for key, value := range params {
+		if len(value) == 0 {
+			delete(params, key)
+		}
+	}
+	return conninfo.Format(params)
+}
+
+func (ds *pgDataSource) GetNodeInfo(ctx context.Context) (*NodeInfo, error) {
+	defer observeQueryDuration("node_info", time.Now())
+	return ds.getNodeInfo(ctx, true, true)
+}
+
+// Like GetNodeInfo, but without the replication summary. Joining every wal
+// sender with its backend is the expensive part of the query on a node with
+// many standbys, and health checks which only answer with a status code or
+// a summary don't need it.
+func (ds *pgDataSource) GetNodeStatus(ctx context.Context) (*NodeInfo, error) {
+	defer observeQueryDuration("node_status", time.Now())
+	return ds.getNodeInfo(ctx, false, true)
+}
+
+// Like GetNodeStatus, but without walking up the replication chain, so it
+// answers while the primary is unreachable. A replica's byte lag and upstream
+// timeline and location are left unset; its lag in seconds is local.
+func (ds *pgDataSource) GetLocalNodeStatus(ctx context.Context) (*NodeInfo, error) {
+	defer observeQueryDuration("local_node_status", time.Now())
+	return ds.getNodeInfo(ctx, false, false)
+}
+
+func (ds *pgDataSource) getNodeInfo(ctx context.Context, withReplication bool, withUpstream bool) (*NodeInfo, error) {
+	summaryColumn := "NULL::json"
+	summarySource := ""
+	if withReplication {
+		summaryColumn = "pg_catalog.array_to_json(pg_catalog.array_agg(pg_catalog.row_to_json(ri)))"
+		summarySource = `
+FROM
+  (SELECT
+     (SELECT rolname
+      FROM pg_authid
+      WHERE oid = usesysid) AS usename,
+          application_name,
+          client_addr,
+          w.state,
+          sync_state,
+          sync_priority
+   FROM pg_catalog.pg_stat_get_wal_senders() w,
+        pg_catalog.pg_stat_get_activity(pid)) AS ri`
+	}
+
 	// NOTE: This was copied from patroni.
 	sql := `
 SELECT pg_catalog.to_char(pg_catalog.pg_postmaster_start_time(), 'YYYY-MM-DD HH24:MI:SS.MS TZ'),
@@ -191,32 +321,28 @@ SELECT pg_catalog.to_char(pg_catalog.pg_postmaster_start_time(), 'YYYY-MM-DD HH2
        pg_catalog.pg_is_in_recovery()
 AND pg_catalog.pg_is_wal_replay_paused(),
     pg_catalog.to_char(pg_catalog.pg_last_xact_replay_timestamp(), 'YYYY-MM-DD HH24:MI:SS.MS TZ'),
-    pg_catalog.array_to_json(pg_catalog.array_agg(pg_catalog.row_to_json(ri)))
-FROM
-  (SELECT
-     (SELECT rolname
-      FROM pg_authid
-      WHERE oid = usesysid) AS usename,
-          application_name,
-          client_addr,
-          w.state,
-          sync_state,
-          sync_priority
-   FROM pg_catalog.pg_stat_get_wal_senders() w,
-        pg_catalog.pg_stat_get_activity(pid)) AS ri
+    ` + summaryColumn + `,
+       CASE
+           WHEN pg_catalog.pg_is_in_recovery() THEN (SELECT received_tli FROM pg_catalog.pg_stat_wal_receiver)
+           ELSE ('x' || pg_catalog.substr(pg_catalog.pg_walfile_name(pg_catalog.pg_current_wal_lsn()), 1, 8))::bit(32)::int
+       END` + summarySource + `
 `
-	db, dbErr := ds.getDB()
+	db, dbErr := ds.getDB(ctx)
 	if dbErr != nil {
 		return nil, dbErr
 	}
 
-	rows, err := db.Queryx(sql)
+	queryCtx, span := startQuerySpan(ctx, sql)
+	rows, err := db.QueryxContext(queryCtx, sql)
 	if err != nil {
+		endSpan(span, err)
 		return nil, err
 	}
 	defer rows.Close()
 	if !rows.Next() {
-		return nil, fmt.Errorf("err: did not find at least one row in node info response")
+		err = fmt.Errorf("err: did not find at least one row in node info response")
+		endSpan(span, err)
+		return nil, err
 	}
 
 	// Parse out results from DB
@@ -234,7 +360,9 @@ FROM
 		&nodeInfo.Xlog.Paused,
 		&nodeInfo.Xlog.ReplayedTimestamp,
 		&replicationSummary,
+		&nodeInfo.Timeline,
 	)
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
@@ -259,15 +387,30 @@ FROM
 
 	// only calculate byte lag for replicas
 	if nodeInfo.State == 0 {
-		pgCurrentWalLsn, err := ds.getPgCurrentWalLsn(ds.cfg.MaxHop, db)
+		nodeInfo.LagSeconds, err = ds.getReplicationLagSeconds(ctx, db)
 		if err != nil {
-			log.Println("Error getting pg_current_wal_lsn:", err)
+			slog.ErrorContext(ctx, "Error getting replication lag seconds", "error", err)
 			return nil, err
 		}
+		if !withUpstream {
+			return nodeInfo, nil
+		}
 
-		pgLastWalLsn, err := ds.getPgLastWalReplayLsn()
+		pgCurrentWalLsn, upstreamTimeline, err := ds.getPgCurrentWalLsn(ctx, 0, ds.getConfig().MaxHop, db)
 		if err != nil {
-			log.Println("Error getting pg_last_wal_replay_lsn:", err)
+			slog.ErrorContext(ctx, "Error getting pg_current_wal_lsn", "error", err)
+			return nil, err
+		}
+		upstreamLocation, err := parseLsn(pgCurrentWalLsn)
+		if err != nil {
+			return nil, err
+		}
+		nodeInfo.UpstreamTimeline = null.Int64From(upstreamTimeline)
+		nodeInfo.UpstreamLocation = null.Int64From(int64(upstreamLocation))
+
+		pgLastWalLsn, err := ds.getPgLastWalReplayLsn(ctx)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error getting pg_last_wal_replay_lsn", "error", err)
 			return nil, err
 		}
 		// Skip the byte lag checks if the last wal lsn is empty
@@ -275,9 +418,9 @@ FROM
 			return nodeInfo, nil
 		}
 
-		byteLag, err := ds.getPgWalLsnDiff(pgCurrentWalLsn, pgLastWalLsn)
+		byteLag, err := ds.getPgWalLsnDiff(ctx, pgCurrentWalLsn, pgLastWalLsn)
 		if err != nil {
-			log.Println("Error getting pg_wal_lsn_diff:", err)
+			slog.ErrorContext(ctx, "Error getting pg_wal_lsn_diff", "error", err)
 			return nil, err
 		}
 
@@ -287,83 +430,252 @@ FROM
 	return nodeInfo, nil
 }
 
-func (ds *pgDataSource) getUpstreamConnInfo(db *sqlx.DB) (string, error) {
-	stats := PgStatWalReceiver{}
-	err := db.Get(&stats, "select * from pg_stat_wal_receiver;")
+// The time based lag of a replica. When the replica has replayed everything it
+// received, the replay timestamp is no longer useful since an idle primary does
+// not generate new transactions. In that case the lag is the time since the
+// last message from the upstream, which keeps ticking with keepalives. If the
+// replica is not streaming, we fall back to the age of the last replayed
+// transaction. The lag is null when nothing has been replayed yet.
+func (ds *pgDataSource) getReplicationLagSeconds(ctx context.Context, db *sqlx.DB) (null.Float64, error) {
+	sql := `
+SELECT CASE
+           WHEN pg_catalog.pg_last_wal_replay_lsn() >= pg_catalog.pg_last_wal_receive_lsn()
+                AND r.last_msg_receipt_time IS NOT NULL
+               THEN EXTRACT(EPOCH FROM pg_catalog.now() - r.last_msg_receipt_time)
+           ELSE EXTRACT(EPOCH FROM pg_catalog.now() - pg_catalog.pg_last_xact_replay_timestamp())
+       END
+FROM (SELECT 1) AS one
+LEFT JOIN pg_catalog.pg_stat_wal_receiver r ON true
+`
+	lagSeconds := null.Float64{}
+	err := tracedGet(ctx, db, &lagSeconds, sql)
 	if err != nil {
-		return "", err
+		return null.Float64{}, err
 	}
-	return stats.ConnInfo, nil
+	return lagSeconds, nil
 }
 
-func parseConnInfo(conninfo string) map[string]string {
-	params := strings.Split(conninfo, " ")
+func (ds *pgDataSource) getWalReceiver(ctx context.Context, db *sqlx.DB) (*PgStatWalReceiver, error) {
+	stats := &PgStatWalReceiver{}
+	err := tracedGet(ctx, db.Unsafe(), stats, "select * from pg_stat_wal_receiver;")
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+func (ds *pgDataSource) getUpstreamConnInfo(ctx context.Context, db *sqlx.DB) (map[string]string, error) {
+	stats, err := ds.getWalReceiver(ctx, db)
+	if err != nil {
+		return nil, err
+	}
+	return conninfo.Parse(stats.ConnInfo.String)
+}
+
+// libpq keywords which lib/pq does not understand and would otherwise forward
+// to the server as unknown runtime parameters.
+var libpqOnlyKeywords = []string{
+	"channel_binding", "gssdelegation", "gssencmode", "gsslib", "hostaddr", "keepalives",
+	"keepalives_count", "keepalives_idle", "keepalives_interval", "krbsrvname", "load_balance_hosts",
+	"passfile", "replication", "require_auth", "requirepeer", "ssl_max_protocol_version",
+	"ssl_min_protocol_version", "sslcertmode", "sslcompression", "sslcrl", "sslcrldir",
+	"sslkeylogfile", "sslnegotiation", "sslpassword", "sslsni", "target_session_attrs",
+	"tcp_user_timeout",
+}
+
+// Builds a conninfo for one upstream host. Upstream settings such as sslmode,
+// sslrootcert and application_name are kept, but we connect to our configured
+// database as our configured user since the wal receiver connects to the
+// replication pseudo-database and its password is masked.
+func (ds *pgDataSource) buildConnInfo(upstreamParams map[string]string, host conninfo.Host) string {
+	cfg := ds.getConfig()
+	params := make(map[string]string)
+	for key, value := range upstreamParams {
+		params[key] = value
+	}
+	for _, keyword := range libpqOnlyKeywords {
+		delete(params, keyword)
+	}
+
+	params["host"] = host.Host
+	params["port"] = host.Port
+	if len(params["port"]) == 0 {
+		params["port"] = cfg.Port
+	}
+	params["dbname"] = cfg.Database
+	params["user"] = cfg.User
+	params["binary_parameters"] = cfg.BinaryParameters
+	delete(params, "password")
+	if len(cfg.Password) > 0 {
+		params["password"] = cfg.Password
+	}
+
+	// lib/pq can't negotiate ssl, so the libpq default of prefer (and allow)
+	// fall back to how we connect locally.
+	switch params["sslmode"] {
+	case "", "prefer", "allow":
+		params["sslmode"] = cfg.Sslmode
+	}
 
-	parsedConnInfo := make(map[string]string)
-	for _, param := range params {
-		kv := strings.Split(param, "=")
-		parsedConnInfo[kv[0]] = kv[1]
+	return conninfo.Format(params)
+}
+
+// Connects to the node this replica streams from. PG13+ tells us exactly which
+// host the wal receiver is connected to; otherwise each host in the conninfo
+// is tried in order, honoring target_session_attrs like libpq does.
+func (ds *pgDataSource) connectUpstream(ctx context.Context, db *sqlx.DB) (*sqlx.DB, conninfo.Host, error) {
+	receiver, err := ds.getWalReceiver(ctx, db)
+	if err != nil {
+		return nil, conninfo.Host{}, err
+	}
+	params, err := conninfo.Parse(receiver.ConnInfo.String)
+	if err != nil {
+		return nil, conninfo.Host{}, err
+	}
+
+	hosts := conninfo.Hosts(params)
+	if receiver.SenderHost.Valid && len(receiver.SenderHost.String) > 0 {
+		hosts = []conninfo.Host{{Host: receiver.SenderHost.String, Port: receiver.SenderPort.String}}
+	}
+
+	targetSessionAttrs := params["target_session_attrs"]
+	upstreamDb, host, err := ds.connectFirstMatchingHost(ctx, params, hosts, targetSessionAttrs)
+	if err != nil && targetSessionAttrs == "prefer-standby" {
+		upstreamDb, host, err = ds.connectFirstMatchingHost(ctx, params, hosts, "any")
 	}
-	return parsedConnInfo
+	return upstreamDb, host, err
 }
 
-func (ds *pgDataSource) buildConnInfo(conninfo map[string]string) string {
-	return fmt.Sprintf("host=%s port=%s database=%s user=%s sslmode=%s binary_parameters=%s password=%s",
-		conninfo["host"], conninfo["port"],
-		ds.cfg.Database, ds.cfg.User, ds.cfg.Sslmode, ds.cfg.BinaryParameters, ds.cfg.Password)
+// Like connectUpstream, in an "upstream hop" span with the host, port and
+// hop. The caller ends the span once it is done with the upstream, so the
+// spans of hops further up the chain nest in it.
+func (ds *pgDataSource) connectUpstreamHop(ctx context.Context, db *sqlx.DB, hop int64) (context.Context, trace.Span, *sqlx.DB, conninfo.Host, error) {
+	ctx, span := tracer.Start(ctx, "upstream hop", trace.WithAttributes(attribute.Int64("pgreba.hop", hop)))
+	upstreamDb, host, err := ds.connectUpstream(ctx, db)
+	if err != nil {
+		recordSpanError(span, err)
+		slog.DebugContext(ctx, "Error connecting upstream", "hop", hop, "error", err)
+		return ctx, span, nil, host, err
+	}
+	span.SetAttributes(semconv.ServerAddress(host.Host))
+	if port, err := strconv.Atoi(host.Port); err == nil {
+		span.SetAttributes(semconv.ServerPort(port))
+	}
+	slog.DebugContext(ctx, "Connected upstream", "hop", hop, "host", host.Host, "port", host.Port)
+	return ctx, span, upstreamDb, host, nil
 }
 
-func (ds *pgDataSource) getPgCurrentWalLsn(maxHop int64, db *sqlx.DB) (string, error) {
+func (ds *pgDataSource) connectFirstMatchingHost(ctx context.Context, params map[string]string, hosts []conninfo.Host, targetSessionAttrs string) (*sqlx.DB, conninfo.Host, error) {
+	err := errors.New("err: no upstream hosts found in conninfo")
+	for _, host := range hosts {
+		var upstreamDb *sqlx.DB
+		upstreamDb, err = sqlConnect(ctx, ds.buildConnInfo(params, host))
+		if err != nil {
+			continue
+		}
+
+		var matches bool
+		matches, err = matchesTargetSessionAttrs(ctx, upstreamDb, targetSessionAttrs)
+		if err == nil && matches {
+			return upstreamDb, host, nil
+		}
+		upstreamDb.Close()
+		if err == nil {
+			err = fmt.Errorf("err: no upstream host matches target_session_attrs=%s", targetSessionAttrs)
+		}
+	}
+	return nil, conninfo.Host{}, err
+}
+
+func matchesTargetSessionAttrs(ctx context.Context, db *sqlx.DB, targetSessionAttrs string) (bool, error) {
+	switch targetSessionAttrs {
+	case "", "any":
+		return true, nil
+	}
+
+	var isInRecovery bool
+	err := tracedGet(ctx, db, &isInRecovery, tagQuery(ctx, "select pg_catalog.pg_is_in_recovery()"))
+	if err != nil {
+		return false, err
+	}
+
+	switch targetSessionAttrs {
+	case "read-write", "primary":
+		return !isInRecovery, nil
+	case "read-only", "standby", "prefer-standby":
+		return isInRecovery, nil
+	default:
+		return false, fmt.Errorf("err: invalid target_session_attrs %q", targetSessionAttrs)
+	}
+}
+
+// The current WAL location and timeline of the primary at the top of the
+// replication chain. Hop is how many upstreams db is away from this node.
+func (ds *pgDataSource) getPgCurrentWalLsn(ctx context.Context, hop int64, maxHop int64, db *sqlx.DB) (string, int64, error) {
 	var isReplica bool
-	err := db.Get(&isReplica, "select pg_catalog.pg_is_in_recovery()")
+	err := tracedGet(ctx, db, &isReplica, tagQuery(ctx, "select pg_catalog.pg_is_in_recovery()"))
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
 
 	if isReplica {
-		if maxHop == 0 {
-			return "", errors.New("Reached max hop limit")
+		defer observeQueryDuration("upstream_hop", time.Now())
+
+		if hop >= maxHop {
+			return "", 0, errors.New("Reached max hop limit")
 		}
 
-		conninfo, err := ds.getUpstreamConnInfo(db)
+		ctx, span, upstreamDb, _, err := ds.connectUpstreamHop(ctx, db, hop+1)
+		defer span.End()
 		if err != nil {
-			return "", err
-		}
-		upstreamConnInfo := ds.buildConnInfo(parseConnInfo(conninfo))
-		upstreamDb, err := sqlConnect(upstreamConnInfo)
-		if err != nil {
-			return "", err
+			return "", 0, err
 		}
 		// The db connection opened won't be closed until the recurisve function meets its
 		// base case, however this shouldn't be a problem as maxHop value remains pretty low
 		defer upstreamDb.Close()
-		return ds.getPgCurrentWalLsn(maxHop-1, upstreamDb)
+		return ds.getPgCurrentWalLsn(ctx, hop+1, maxHop, upstreamDb)
 	}
 
-	var pgCurrentWalLsn string
-	err = db.Get(&pgCurrentWalLsn, "select pg_current_wal_lsn()")
+	sql := `
+SELECT pg_catalog.pg_current_wal_lsn()::text AS lsn,
+       ('x' || pg_catalog.substr(pg_catalog.pg_walfile_name(pg_catalog.pg_current_wal_lsn()), 1, 8))::bit(32)::int AS timeline
+`
+	row := struct {
+		Lsn      string `db:"lsn"`
+		Timeline int64  `db:"timeline"`
+	}{}
+	err = tracedGet(ctx, db, &row, tagQuery(ctx, sql))
 	if err != nil {
-		return "", err
+		return "", 0, err
 	}
-	return pgCurrentWalLsn, nil
+	return row.Lsn, row.Timeline, nil
 }
 
-func (ds *pgDataSource) getPgLastWalReplayLsn() (string, error) {
-	db, dbErr := ds.getDB()
+// Marks queries with the request they were made for, so they can be found in
+// the postgres logs and pg_stat_activity of each upstream.
+func tagQuery(ctx context.Context, sql string) string {
+	if id := requestID(ctx); len(id) > 0 {
+		return "/* pgreba request_id=" + id + " */ " + sql
+	}
+	return sql
+}
+
+func (ds *pgDataSource) getPgLastWalReplayLsn(ctx context.Context) (string, error) {
+	db, dbErr := ds.getDB(ctx)
 	if dbErr != nil {
 		return "", dbErr
 	}
 
 	pgLastWalLsn := null.String{}
-	err := db.Get(&pgLastWalLsn, "select pg_last_wal_replay_lsn()")
+	err := tracedGet(ctx, db, &pgLastWalLsn, "select pg_last_wal_replay_lsn()")
 	if err != nil {
 		return "", err
 	}
 	return pgLastWalLsn.String, nil
 }
 
-func (ds *pgDataSource) getPgWalLsnDiff(currentLsn string, lastLsn string) (int64, error) {
-	db, dbErr := ds.getDB()
+func (ds *pgDataSource) getPgWalLsnDiff(ctx context.Context, currentLsn string, lastLsn string) (int64, error) {
+	db, dbErr := ds.getDB(ctx)
 	if dbErr != nil {
 		return 0, dbErr
 	}
@@ -372,49 +684,195 @@ func (ds *pgDataSource) getPgWalLsnDiff(currentLsn string, lastLsn string) (int6
 
 	query := fmt.Sprintf("select pg_wal_lsn_diff('%s', '%s')", currentLsn, lastLsn)
 
-	err := db.Get(&byteLag, query)
+	err := tracedGet(ctx, db, &byteLag, query)
 	if err != nil {
 		return 0, err
 	}
 	return byteLag, nil
 }
 
-func (ds *pgDataSource) IsInRecovery() (bool, error) {
-	db, dbErr := ds.getDB()
+func (ds *pgDataSource) IsInRecovery(ctx context.Context) (bool, error) {
+	defer observeQueryDuration("is_in_recovery", time.Now())
+
+	db, dbErr := ds.getDB(ctx)
 	if dbErr != nil {
 		return false, dbErr
 	}
 
 	var isInRecovery bool
 
-	err := db.Get(&isInRecovery, "select pg_catalog.pg_is_in_recovery()")
+	err := tracedGet(ctx, db, &isInRecovery, "select pg_catalog.pg_is_in_recovery()")
 	return isInRecovery, err
 }
 
-func (ds *pgDataSource) GetPgStatReplication() ([]*PgStatReplication, error) {
+func (ds *pgDataSource) GetPgStatReplication(ctx context.Context) ([]*PgStatReplication, error) {
+	defer observeQueryDuration("pg_stat_replication", time.Now())
+
+	// Nullable columns are coalesced and the lag intervals are converted to
+	// nanoseconds so they scan into a time.Duration.
+	sql := `
+SELECT pid::text,
+       usesysid::text,
+       COALESCE(usename::text, '') AS usename,
+       application_name,
+       COALESCE(client_addr::text, '') AS client_addr,
+       COALESCE(client_hostname, '') AS client_hostname,
+       COALESCE(client_port::text, '') AS client_port,
+       COALESCE(backend_start::text, '') AS backend_start,
+       COALESCE(backend_xmin::text, '') AS backend_xmin,
+       COALESCE(state, '') AS state,
+       COALESCE(sent_lsn::text, '') AS sent_lsn,
+       COALESCE(write_lsn::text, '') AS write_lsn,
+       COALESCE(flush_lsn::text, '') AS flush_lsn,
+       COALESCE(replay_lsn::text, '') AS replay_lsn,
+       (COALESCE(EXTRACT(EPOCH FROM write_lag), 0) * 1000000000)::bigint AS write_lag,
+       (COALESCE(EXTRACT(EPOCH FROM flush_lag), 0) * 1000000000)::bigint AS flush_lag,
+       (COALESCE(EXTRACT(EPOCH FROM replay_lag), 0) * 1000000000)::bigint AS replay_lag,
+       COALESCE(sync_priority::text, '') AS sync_priority,
+       COALESCE(sync_state, '') AS sync_state,
+       COALESCE(reply_time::text, '') AS reply_time
+FROM pg_catalog.pg_stat_replication
+`
 	stats := []*PgStatReplication{}
-	// TODO: Make this only grab required fields.
-	db, dbErr := ds.getDB()
+	db, dbErr := ds.getDB(ctx)
 	if dbErr != nil {
 		return nil, dbErr
 	}
 
-	err := db.Select(&stats, "select * from pg_stat_replication")
+	err := tracedSelect(ctx, db, &stats, sql)
 	return stats, err
 }
 
-func (ds *pgDataSource) GetPgReplicationSlots() ([]*PgReplicationSlot, error) {
+func (ds *pgDataSource) GetPgReplicationSlots(ctx context.Context) ([]*PgReplicationSlot, error) {
+	defer observeQueryDuration("pg_replication_slots", time.Now())
+
 	slots := []*PgReplicationSlot{}
 	// TODO: Make this only grab required fields.
-	db, dbErr := ds.getDB()
+	db, dbErr := ds.getDB(ctx)
 	if dbErr != nil {
 		return nil, dbErr
 	}
 
-	err := db.Select(&slots, "select * from pg_replication_slots")
+	// Newer postgres versions keep adding columns to this view, so we don't
+	// fail on the ones we don't know about.
+	sql := `
+SELECT s.*,
+       pg_catalog.pg_wal_lsn_diff(
+           CASE
+               WHEN pg_catalog.pg_is_in_recovery()
+                   THEN COALESCE(pg_catalog.pg_last_wal_receive_lsn(), pg_catalog.pg_last_wal_replay_lsn())
+               ELSE pg_catalog.pg_current_wal_lsn()
+           END,
+           s.restart_lsn)::bigint AS retained_wal_bytes,
+       CASE
+           WHEN NOT pg_catalog.pg_is_in_recovery()
+               THEN pg_catalog.pg_wal_lsn_diff(pg_catalog.pg_current_wal_lsn(), s.confirmed_flush_lsn)::bigint
+       END AS confirmed_flush_lag_bytes
+FROM pg_catalog.pg_replication_slots s
+`
+	err := tracedSelect(ctx, db.Unsafe(), &slots, sql)
 	return slots, err
 }
 
+func (ds *pgDataSource) GetPgStatSubscription(ctx context.Context) ([]*PgStatSubscription, error) {
+	defer observeQueryDuration("pg_stat_subscription", time.Now())
+
+	// Only the main apply worker of each subscription is interesting here, so
+	// table sync workers (relid set) and parallel apply workers (no
+	// received_lsn) are skipped.
+	sql := `
+SELECT DISTINCT ON (subid)
+       subid::text,
+       subname::text,
+       pid::text,
+       received_lsn::text,
+       last_msg_send_time::text,
+       last_msg_receipt_time::text,
+       latest_end_lsn::text,
+       latest_end_time::text,
+       pg_catalog.pg_wal_lsn_diff(received_lsn, latest_end_lsn)::bigint AS apply_lag_bytes,
+       EXTRACT(EPOCH FROM pg_catalog.now() - last_msg_send_time)::float8 AS apply_lag_seconds,
+       EXTRACT(EPOCH FROM pg_catalog.now() - latest_end_time)::float8 AS latest_end_age_seconds
+FROM pg_catalog.pg_stat_subscription
+WHERE relid IS NULL
+ORDER BY subid, received_lsn IS NULL
+`
+	subscriptions := []*PgStatSubscription{}
+	db, dbErr := ds.getDB(ctx)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+
+	err := tracedSelect(ctx, db, &subscriptions, sql)
+	return subscriptions, err
+}
+
+// The sync_state the upstream reports for this replica in pg_stat_replication
+// (sync, async, potential or quorum). An empty string is returned for a primary
+// or when the upstream does not list this replica.
+func (ds *pgDataSource) GetSyncState(ctx context.Context) (string, error) {
+	defer observeQueryDuration("sync_state", time.Now())
+
+	db, dbErr := ds.getDB(ctx)
+	if dbErr != nil {
+		return "", dbErr
+	}
+
+	var isReplica bool
+	err := tracedGet(ctx, db, &isReplica, "select pg_catalog.pg_is_in_recovery()")
+	if err != nil {
+		return "", err
+	}
+	if !isReplica {
+		return "", nil
+	}
+
+	applicationName, err := ds.getWalReceiverApplicationName(ctx, db)
+	if err != nil {
+		return "", err
+	}
+
+	ctx, span, upstreamDb, _, err := ds.connectUpstreamHop(ctx, db, 1)
+	defer span.End()
+	if err != nil {
+		return "", err
+	}
+	defer upstreamDb.Close()
+
+	syncStates := []string{}
+	err = tracedSelect(ctx, upstreamDb, &syncStates, "select sync_state from pg_stat_replication where application_name = $1", applicationName)
+	if err != nil {
+		return "", err
+	}
+	if len(syncStates) == 0 {
+		return "", nil
+	}
+	return syncStates[0], nil
+}
+
+// The application_name the wal receiver uses when connecting upstream. This
+// follows postgres: the conninfo setting wins, then cluster_name, and finally
+// the "walreceiver" default.
+func (ds *pgDataSource) getWalReceiverApplicationName(ctx context.Context, db *sqlx.DB) (string, error) {
+	params, err := ds.getUpstreamConnInfo(ctx, db)
+	if err != nil {
+		return "", err
+	}
+	if applicationName := params["application_name"]; len(applicationName) > 0 {
+		return applicationName, nil
+	}
+
+	var clusterName string
+	err = tracedGet(ctx, db, &clusterName, "select pg_catalog.current_setting('cluster_name')")
+	if err != nil {
+		return "", err
+	}
+	if len(clusterName) > 0 {
+		return clusterName, nil
+	}
+	return "walreceiver", nil
+}
+
 // Caching data source for efficient lookup
 
 type cachedDataSource struct {
@@ -425,6 +883,12 @@ type cachedDataSource struct {
 	cachedGetNodeInfo          *NodeInfo
 	cachedGetNodeInfoExpiresAt time.Time
 
+	cachedGetNodeStatus          *NodeInfo
+	cachedGetNodeStatusExpiresAt time.Time
+
+	cachedGetLocalNodeStatus          *NodeInfo
+	cachedGetLocalNodeStatusExpiresAt time.Time
+
 	cachedIsInRecovery          bool
 	cachedIsInRecoveryExpiresAt time.Time
 
@@ -433,20 +897,33 @@ type cachedDataSource struct {
 
 	cachedGetPgReplicationSlots          []*PgReplicationSlot
 	cachedGetPgReplicationSlotsExpiresAt time.Time
+
+	cachedGetSyncState          string
+	cachedGetSyncStateExpiresAt time.Time
+
+	cachedGetTopology          *Topology
+	cachedGetTopologyExpiresAt time.Time
+
+	cachedGetPgStatSubscription          []*PgStatSubscription
+	cachedGetPgStatSubscriptionExpiresAt time.Time
 }
 
 func NewCachedDataSource(ds ReplicationDataSource) ReplicationDataSource {
 	return &cachedDataSource{dataSource: ds, mutex: sync.Mutex{}, cacheTTL: time.Second}
 }
 
-func (ds *cachedDataSource) GetNodeInfo() (*NodeInfo, error) {
+func (ds *cachedDataSource) GetNodeInfo(ctx context.Context) (*NodeInfo, error) {
+	ctx, span := startCacheSpan(ctx, "GetNodeInfo")
+	defer span.End()
+
 	ds.mutex.Lock()
 	defer ds.mutex.Unlock()
 
 	// If the cache has expired.
 	if ds.cachedGetNodeInfoExpiresAt.Before(time.Now()) {
+		span.SetAttributes(cacheMiss)
 		var err error
-		ds.cachedGetNodeInfo, err = ds.dataSource.GetNodeInfo()
+		ds.cachedGetNodeInfo, err = ds.dataSource.GetNodeInfo(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -458,14 +935,77 @@ func (ds *cachedDataSource) GetNodeInfo() (*NodeInfo, error) {
 	return ds.cachedGetNodeInfo, nil
 }
 
-func (ds *cachedDataSource) IsInRecovery() (bool, error) {
+// Full node info which is still cached answers as well.
+func (ds *cachedDataSource) GetNodeStatus(ctx context.Context) (*NodeInfo, error) {
+	ctx, span := startCacheSpan(ctx, "GetNodeStatus")
+	defer span.End()
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	if !ds.cachedGetNodeInfoExpiresAt.Before(time.Now()) {
+		return ds.cachedGetNodeInfo, nil
+	}
+
+	// If the cache has expired.
+	if ds.cachedGetNodeStatusExpiresAt.Before(time.Now()) {
+		span.SetAttributes(cacheMiss)
+		var err error
+		ds.cachedGetNodeStatus, err = ds.dataSource.GetNodeStatus(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// Increase ttl point because result was valid
+		ds.cachedGetNodeStatusExpiresAt = time.Now().Add(ds.cacheTTL)
+	}
+
+	return ds.cachedGetNodeStatus, nil
+}
+
+// Node info or status which is still cached answers as well.
+func (ds *cachedDataSource) GetLocalNodeStatus(ctx context.Context) (*NodeInfo, error) {
+	ctx, span := startCacheSpan(ctx, "GetLocalNodeStatus")
+	defer span.End()
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	if !ds.cachedGetNodeInfoExpiresAt.Before(time.Now()) {
+		return ds.cachedGetNodeInfo, nil
+	}
+	if !ds.cachedGetNodeStatusExpiresAt.Before(time.Now()) {
+		return ds.cachedGetNodeStatus, nil
+	}
+
+	// If the cache has expired.
+	if ds.cachedGetLocalNodeStatusExpiresAt.Before(time.Now()) {
+		span.SetAttributes(cacheMiss)
+		var err error
+		ds.cachedGetLocalNodeStatus, err = ds.dataSource.GetLocalNodeStatus(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// Increase ttl point because result was valid
+		ds.cachedGetLocalNodeStatusExpiresAt = time.Now().Add(ds.cacheTTL)
+	}
+
+	return ds.cachedGetLocalNodeStatus, nil
+}
+
+func (ds *cachedDataSource) IsInRecovery(ctx context.Context) (bool, error) {
+	ctx, span := startCacheSpan(ctx, "IsInRecovery")
+	defer span.End()
+
 	ds.mutex.Lock()
 	defer ds.mutex.Unlock()
 
 	// If the cache has expired.
 	if ds.cachedIsInRecoveryExpiresAt.Before(time.Now()) {
+		span.SetAttributes(cacheMiss)
 		var err error
-		ds.cachedIsInRecovery, err = ds.dataSource.IsInRecovery()
+		ds.cachedIsInRecovery, err = ds.dataSource.IsInRecovery(ctx)
 		if err != nil {
 			return false, err
 		}
@@ -477,14 +1017,18 @@ func (ds *cachedDataSource) IsInRecovery() (bool, error) {
 	return ds.cachedIsInRecovery, nil
 }
 
-func (ds *cachedDataSource) GetPgStatReplication() ([]*PgStatReplication, error) {
+func (ds *cachedDataSource) GetPgStatReplication(ctx context.Context) ([]*PgStatReplication, error) {
+	ctx, span := startCacheSpan(ctx, "GetPgStatReplication")
+	defer span.End()
+
 	ds.mutex.Lock()
 	defer ds.mutex.Unlock()
 
 	// If the cache has expired.
 	if ds.cachedGetPgStatReplicationExpiresAt.Before(time.Now()) {
+		span.SetAttributes(cacheMiss)
 		var err error
-		ds.cachedGetPgStatReplication, err = ds.dataSource.GetPgStatReplication()
+		ds.cachedGetPgStatReplication, err = ds.dataSource.GetPgStatReplication(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -496,14 +1040,18 @@ func (ds *cachedDataSource) GetPgStatReplication() ([]*PgStatReplication, error)
 	return ds.cachedGetPgStatReplication, nil
 }
 
-func (ds *cachedDataSource) GetPgReplicationSlots() ([]*PgReplicationSlot, error) {
+func (ds *cachedDataSource) GetPgReplicationSlots(ctx context.Context) ([]*PgReplicationSlot, error) {
+	ctx, span := startCacheSpan(ctx, "GetPgReplicationSlots")
+	defer span.End()
+
 	ds.mutex.Lock()
 	defer ds.mutex.Unlock()
 
 	// If the cache has expired.
 	if ds.cachedGetPgReplicationSlotsExpiresAt.Before(time.Now()) {
+		span.SetAttributes(cacheMiss)
 		var err error
-		ds.cachedGetPgReplicationSlots, err = ds.dataSource.GetPgReplicationSlots()
+		ds.cachedGetPgReplicationSlots, err = ds.dataSource.GetPgReplicationSlots(ctx)
 		if err != nil {
 			return nil, err
 		}
@@ -515,6 +1063,75 @@ func (ds *cachedDataSource) GetPgReplicationSlots() ([]*PgReplicationSlot, error
 	return ds.cachedGetPgReplicationSlots, nil
 }
 
+func (ds *cachedDataSource) GetSyncState(ctx context.Context) (string, error) {
+	ctx, span := startCacheSpan(ctx, "GetSyncState")
+	defer span.End()
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	// If the cache has expired.
+	if ds.cachedGetSyncStateExpiresAt.Before(time.Now()) {
+		span.SetAttributes(cacheMiss)
+		var err error
+		ds.cachedGetSyncState, err = ds.dataSource.GetSyncState(ctx)
+		if err != nil {
+			return "", err
+		}
+
+		// Increase ttl point because result was valid
+		ds.cachedGetSyncStateExpiresAt = time.Now().Add(ds.cacheTTL)
+	}
+
+	return ds.cachedGetSyncState, nil
+}
+
+func (ds *cachedDataSource) GetTopology(ctx context.Context) (*Topology, error) {
+	ctx, span := startCacheSpan(ctx, "GetTopology")
+	defer span.End()
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	// If the cache has expired.
+	if ds.cachedGetTopologyExpiresAt.Before(time.Now()) {
+		span.SetAttributes(cacheMiss)
+		var err error
+		ds.cachedGetTopology, err = ds.dataSource.GetTopology(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// Increase ttl point because result was valid
+		ds.cachedGetTopologyExpiresAt = time.Now().Add(ds.cacheTTL)
+	}
+
+	return ds.cachedGetTopology, nil
+}
+
+func (ds *cachedDataSource) GetPgStatSubscription(ctx context.Context) ([]*PgStatSubscription, error) {
+	ctx, span := startCacheSpan(ctx, "GetPgStatSubscription")
+	defer span.End()
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	// If the cache has expired.
+	if ds.cachedGetPgStatSubscriptionExpiresAt.Before(time.Now()) {
+		span.SetAttributes(cacheMiss)
+		var err error
+		ds.cachedGetPgStatSubscription, err = ds.dataSource.GetPgStatSubscription(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// Increase ttl point because result was valid
+		ds.cachedGetPgStatSubscriptionExpiresAt = time.Now().Add(ds.cacheTTL)
+	}
+
+	return ds.cachedGetPgStatSubscription, nil
+}
+
 func (ds *cachedDataSource) Close() error {
 	return ds.dataSource.Close()
 }
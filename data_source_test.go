@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
+	"reflect"
 	"testing"
 	"time"
+
+	"github.com/film42/pgreba/config"
+	"github.com/film42/pgreba/conninfo"
 )
 
 func TestCachedDataSource_CanReuseAndExpireGetNodeInfo(t *testing.T) {
@@ -16,7 +21,7 @@ func TestCachedDataSource_CanReuseAndExpireGetNodeInfo(t *testing.T) {
 	}
 
 	// Read from data source
-	cds.GetNodeInfo()
+	cds.GetNodeInfo(context.Background())
 	if cds.cachedGetNodeInfo == nil {
 		t.Fatal("Cache was not set after calling GetNodeInfo")
 	}
@@ -26,7 +31,7 @@ func TestCachedDataSource_CanReuseAndExpireGetNodeInfo(t *testing.T) {
 
 	// Read from cache (update value before to verify the read is cached)
 	fds.byteLag = 1337
-	nodeInfo, _ := cds.GetNodeInfo()
+	nodeInfo, _ := cds.GetNodeInfo(context.Background())
 	if nodeInfo != cds.cachedGetNodeInfo && nodeInfo.ByteLag != 0 {
 		t.Fatal("Did not use the cached GetNodeInfo value when cached read was expected")
 	}
@@ -38,7 +43,7 @@ func TestCachedDataSource_CanReuseAndExpireGetNodeInfo(t *testing.T) {
 	}
 
 	// Read from data source
-	nodeInfo, _ = cds.GetNodeInfo()
+	nodeInfo, _ = cds.GetNodeInfo(context.Background())
 	if cds.cachedGetNodeInfo.ByteLag != 1337 {
 		t.Fatal("Cache was not successfully expired")
 	}
@@ -55,13 +60,13 @@ func TestCachedDataSource_CanReuseAndExpireIsInRecovery(t *testing.T) {
 	}
 
 	// Read from data source
-	cds.IsInRecovery()
+	cds.IsInRecovery(context.Background())
 	if cds.cachedIsInRecoveryExpiresAt.Before(time.Now()) {
 		t.Fatal("Cache expiration time was not set after calling IsInRecovery")
 	}
 
 	// Read from cache (update value before to verify the read is cached)
-	isInRecovery, _ := cds.IsInRecovery()
+	isInRecovery, _ := cds.IsInRecovery(context.Background())
 	if isInRecovery != cds.cachedIsInRecovery {
 		t.Fatal("Did not use the cached IsInRecovery value when cached read was expected")
 	}
@@ -73,8 +78,51 @@ func TestCachedDataSource_CanReuseAndExpireIsInRecovery(t *testing.T) {
 	}
 
 	// Read from data source
-	isInRecovery, _ = cds.IsInRecovery()
+	isInRecovery, _ = cds.IsInRecovery(context.Background())
 	if cds.cachedIsInRecoveryExpiresAt.Before(time.Now()) {
 		t.Fatal("Cache expiration time was not set after calling IsInRecovery")
 	}
 }
+
+func TestPgDataSource_BuildConnInfoKeepsUpstreamSettings(t *testing.T) {
+	ds := &pgDataSource{cfg: &config.Config{
+		Database:         "postgres",
+		User:             "pgreba",
+		Sslmode:          "disable",
+		BinaryParameters: "yes",
+		Port:             "5432",
+	}}
+
+	upstreamParams, err := conninfo.Parse(`user=replicator password=******** dbname=replication ` +
+		`host=db1,db2 port=5433 sslmode=verify-ca sslrootcert=/etc/ssl/root.crt ` +
+		`application_name=standby1 options='-c x=y' target_session_attrs=read-write`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	built, err := conninfo.Parse(ds.buildConnInfo(upstreamParams, conninfo.Host{Host: "db2", Port: "5433"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"host":              "db2",
+		"port":              "5433",
+		"dbname":            "postgres",
+		"user":              "pgreba",
+		"binary_parameters": "yes",
+		"sslmode":           "verify-ca",
+		"sslrootcert":       "/etc/ssl/root.crt",
+		"application_name":  "standby1",
+		"options":           "-c x=y",
+	}
+	if !reflect.DeepEqual(built, expected) {
+		t.Fatal("Unexpected upstream conninfo:", built)
+	}
+
+	// lib/pq does not support prefer, so we fall back to the local sslmode.
+	built, _ = conninfo.Parse(ds.buildConnInfo(map[string]string{"sslmode": "prefer"}, conninfo.Host{Host: "db1"}))
+	if built["sslmode"] != "disable" || built["port"] != "5432" {
+		t.Fatal("Expected local sslmode and port fallbacks but found:", built)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// How often /events streams send a comment so idle connections aren't dropped
+// by proxies.
+const eventsKeepaliveInterval = 15 * time.Second
+
+// How many events a /events stream may fall behind before missing some.
+const eventsStreamBuffer = 64
+
+// Event types.
+const (
+	// The local timeline changed, meaning this node or its upstream was
+	// promoted.
+	EventTimelineChanged = "timeline_changed"
+	EventRoleChanged     = "role_changed"
+	// A replica's timeline differs from its upstream's.
+	EventTimelineDiverged = "timeline_diverged"
+	// A replica received WAL beyond its upstream's current location.
+	EventWalDiverged = "wal_diverged"
+	// The node became healthy or unhealthy for its role.
+	EventHealthChanged = "health_changed"
+	// A replica's lag moved to another bucket, e.g. from low to high.
+	EventLagChanged = "lag_changed"
+	// A replica's lag went above or back below max_allowable_lag_seconds.
+	EventLagExceeded   = "lag_exceeded"
+	EventLagRecovered  = "lag_recovered"
+	EventReplayPaused  = "replay_paused"
+	EventReplayResumed = "replay_resumed"
+	// A replication slot's wal_status became lost.
+	EventSlotLost = "slot_lost"
+)
+
+// Something which happened to a monitored node.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// The name of the instance, when instances are configured.
+	Instance string `json:"instance,omitempty"`
+	// The replication slot, for slot events.
+	Slot    string `json:"slot,omitempty"`
+	Message string `json:"message"`
+	// The node info before and after the change. Null when it could not be
+	// read.
+	Previous *NodeInfo `json:"previous"`
+	Current  *NodeInfo `json:"current"`
+}
+
+// Fans events out to every subscriber. Publishing never blocks: a subscriber
+// which falls behind misses events rather than stalling the others.
+type eventBus struct {
+	mutex       sync.Mutex
+	subscribers map[chan *Event]bool
+	closed      bool
+}
+
+func newEventBus() *eventBus {
+	return &eventBus{subscribers: make(map[chan *Event]bool)}
+}
+
+func (eb *eventBus) Subscribe(buffer int) chan *Event {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	ch := make(chan *Event, buffer)
+	if eb.closed {
+		close(ch)
+		return ch
+	}
+	eb.subscribers[ch] = true
+	return ch
+}
+
+func (eb *eventBus) Unsubscribe(ch chan *Event) {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	if eb.subscribers[ch] {
+		delete(eb.subscribers, ch)
+		close(ch)
+	}
+}
+
+func (eb *eventBus) Publish(event *Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+	attrs := []interface{}{"type", event.Type, "message", event.Message}
+	if len(event.Instance) > 0 {
+		attrs = append(attrs, "instance", event.Instance)
+	}
+	if len(event.Slot) > 0 {
+		attrs = append(attrs, "slot", event.Slot)
+	}
+	slog.Info("Event", attrs...)
+
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	for ch := range eb.subscribers {
+		select {
+		case ch <- event:
+		default:
+		}
+	}
+}
+
+// Closes every subscription, ending open /events streams so the http servers
+// can shut down.
+func (eb *eventBus) Close() error {
+	eb.mutex.Lock()
+	defer eb.mutex.Unlock()
+	eb.closed = true
+	for ch := range eb.subscribers {
+		delete(eb.subscribers, ch)
+		close(ch)
+	}
+	return nil
+}
+
+// Streams events as server-sent events until the client goes away. Pass
+// ?instance=name to only receive the events of one instance.
+func (eb *eventBus) apiGetEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		// Return a 500. Something bad happened.
+		http.Error(w, "err: streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+
+	instance := r.URL.Query().Get("instance")
+	subscription := eb.Subscribe(eventsStreamBuffer)
+	defer eb.Unsubscribe(subscription)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventsKeepaliveInterval)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case event, ok := <-subscription:
+			if !ok {
+				return
+			}
+			if len(instance) > 0 && event.Instance != instance {
+				continue
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				slog.Error("Error encoding event", "error", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event.Type, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/film42/pgreba/config"
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// A postgres instance monitored by this process, with its own data source,
+// cache and checks.
+type monitoredInstance struct {
+	name    string
+	pgds    *pgDataSource
+	ds      ReplicationDataSource
+	polling *pollingDataSource
+	watcher *nodeWatcher
+	hcs     *HealthCheckWebService
+}
+
+func newMonitoredInstance(instance *config.Instance, events *eventBus) *monitoredInstance {
+	cfg := instance.Config
+	mi := &monitoredInstance{name: instance.Name, pgds: &pgDataSource{cfg: cfg}}
+
+	mi.ds = mi.pgds
+	if cfg.PollInterval > 0 {
+		// Poll in the background so check latency no longer depends
+		// on query latency.
+		mi.polling = NewPollingDataSource(mi.ds, cfg.PollInterval, cfg.MaxStaleness)
+		mi.ds = mi.polling
+	} else {
+		// Wrap the data source in a caching layer to prevent
+		// many concurrent health-checks from bogging things down.
+		mi.ds = NewCachedDataSource(mi.ds)
+	}
+
+	mi.hcs = &HealthCheckWebService{healthChecker: NewHealthChecker(mi.ds), cfg: cfg}
+	mi.hcs.maintenance = &maintenanceMode{getConfig: mi.hcs.getConfig}
+	if cfg.WatchInterval > 0 {
+		mi.watcher = newNodeWatcher(instance.Name, mi.ds, mi.hcs.getConfig, events, cfg.WatchInterval)
+		mi.hcs.watcher = mi.watcher
+	}
+	return mi
+}
+
+// Starts background work such as watching the node.
+func (mi *monitoredInstance) Start() {
+	if mi.watcher != nil {
+		mi.watcher.Start()
+	}
+}
+
+// Named instances have their metrics labelled with pgreba_instance.
+func (mi *monitoredInstance) registerMetrics(registerer prometheus.Registerer) {
+	if len(mi.name) > 0 {
+		registerer = prometheus.WrapRegistererWith(prometheus.Labels{"pgreba_instance": mi.name}, registerer)
+	}
+
+	registerer.MustRegister(newNodeCollector(mi.ds))
+	if mi.polling != nil {
+		registerer.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "pgreba_snapshot_age_seconds",
+			Help: "Age of the background poller's last snapshot.",
+		}, func() float64 { return mi.polling.SnapshotAge().Seconds() }))
+	}
+}
+
+// Serves the checks from router, which is either a root router or one
+// prefixed with the instance name.
+func (mi *monitoredInstance) registerRoutes(router *mux.Router) {
+	if mi.polling != nil {
+		router.Use(mi.polling.snapshotAgeMiddleware)
+	}
+	mi.hcs.registerRoutes(router)
+}
+
+// Swaps in a reloaded config and logs what changed.
+func (mi *monitoredInstance) reload(cfg *config.Config) (changed bool) {
+	logger := slog.Default()
+	if len(mi.name) > 0 {
+		logger = logger.With("instance", mi.name)
+	}
+
+	changes := config.Diff(mi.hcs.getConfig(), cfg)
+	for _, change := range changes {
+		logger.Info("Config reloaded", "change", change.String())
+		if restartRequiredKeys[change.Key] {
+			logger.Warn("Config reloaded: the change only takes effect after a restart", "key", change.Key)
+		}
+	}
+
+	mi.pgds.Reload(cfg)
+	mi.hcs.Reload(cfg)
+	return len(changes) > 0
+}
+
+func (mi *monitoredInstance) Close() error {
+	if mi.watcher != nil {
+		mi.watcher.Close()
+	}
+	return mi.ds.Close()
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/film42/pgreba/config"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	requestIDHeader = "X-Request-Id"
+	reasonHeader    = "X-PgReba-Reason"
+)
+
+// The level of the default logger, which a reload can change.
+var logLevel = new(slog.LevelVar)
+
+func parseLogLevel(name string) slog.Level {
+	switch name {
+	case "debug":
+		return slog.LevelDebug
+	case "warn":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	}
+	return slog.LevelInfo
+}
+
+// Replaces the default logger. The standard log package writes through it
+// too.
+func setupLogging(cfg *config.Config) {
+	logLevel.Set(parseLogLevel(cfg.LogLevel))
+	options := &slog.HandlerOptions{Level: logLevel}
+
+	var handler slog.Handler
+	if cfg.LogFormat == "json" {
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	} else {
+		handler = slog.NewTextHandler(os.Stderr, options)
+	}
+	slog.SetDefault(slog.New(&requestIDHandler{handler}))
+}
+
+// Adds the request ID and trace ID from the context to each record.
+type requestIDHandler struct {
+	slog.Handler
+}
+
+func (h *requestIDHandler) Handle(ctx context.Context, record slog.Record) error {
+	if id := requestID(ctx); len(id) > 0 {
+		record.AddAttrs(slog.String("request_id", id))
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		record.AddAttrs(slog.String("trace_id", spanContext.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *requestIDHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &requestIDHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h *requestIDHandler) WithGroup(name string) slog.Handler {
+	return &requestIDHandler{h.Handler.WithGroup(name)}
+}
+
+type requestIDContextKey struct{}
+
+// The ID of the request being served, or empty outside of one.
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey{}).(string)
+	return id
+}
+
+func newRequestID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(id)
+}
+
+// Keeps whatever a proxy in front of us passed in, so long as it's safe to
+// log and to send back.
+func validRequestID(id string) bool {
+	if len(id) == 0 || len(id) > 128 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.ContainsRune("-_.:", c)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Tags each request with an ID, taken from the X-Request-Id header when
+// given, which is echoed back and added to everything logged for it.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), requestIDContextKey{}, id)))
+	})
+}
+
+// Logs each request once it's done.
+func accessLogMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		slog.InfoContext(r.Context(), "Request",
+			"method", r.Method,
+			"path", r.URL.RequestURI(),
+			"status", recorder.status,
+			"duration", time.Since(start),
+			"remote_addr", r.RemoteAddr,
+			"user_agent", r.UserAgent(),
+		)
+	})
+}
+
+// Explains a health decision: failures are logged and their reason is sent
+// in the X-PgReba-Reason header, while passing checks are only logged at
+// debug.
+func reportCheck(w http.ResponseWriter, r *http.Request, reason string) {
+	if len(reason) == 0 {
+		slog.DebugContext(r.Context(), "Check passed", "path", r.URL.Path)
+		return
+	}
+	w.Header().Set(reasonHeader, strings.Join(strings.Fields(reason), " "))
+	slog.InfoContext(r.Context(), "Check failed", "path", r.URL.Path, "reason", reason)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/film42/pgreba/config"
+	"github.com/gorilla/mux"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var logged bytes.Buffer
+	logger := slog.New(&requestIDHandler{slog.NewJSONHandler(&logged, nil)})
+
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logger.InfoContext(r.Context(), "Handled")
+	}))
+
+	cases := map[string]bool{
+		"":                     false,
+		"abc-123":              true,
+		"bad id */ drop table": false,
+	}
+	for given, kept := range cases {
+		logged.Reset()
+		r := httptest.NewRequest("GET", "/replica", nil)
+		if len(given) > 0 {
+			r.Header.Set(requestIDHeader, given)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+
+		id := w.Header().Get(requestIDHeader)
+		if kept && id != given || !kept && (id == given || len(id) != 16) {
+			t.Fatalf("Expected %q to be kept: %v, but found %q", given, kept, id)
+		}
+		record := map[string]interface{}{}
+		if err := json.Unmarshal(logged.Bytes(), &record); err != nil {
+			t.Fatal(err)
+		}
+		if record["request_id"] != id {
+			t.Fatalf("Expected the log to carry request_id %q but found %v", id, record)
+		}
+		if query := tagQuery(context.WithValue(context.Background(), requestIDContextKey{}, id), "select 1"); query != "/* pgreba request_id="+id+" */ select 1" {
+			t.Fatal("Expected the query to be tagged but found", query)
+		}
+	}
+
+	if query := tagQuery(context.Background(), "select 1"); query != "select 1" {
+		t.Fatal("Expected queries outside of requests to be left alone but found", query)
+	}
+}
+
+func TestCheckReasons(t *testing.T) {
+	cases := []struct {
+		fds    *fakeDataSource
+		path   string
+		status int
+		reason string
+	}{
+		{&fakeDataSource{role: "replica"}, "/replica", 200, ""},
+		{&fakeDataSource{role: "replica"}, "/primary", 503, "not a primary"},
+		{&fakeDataSource{role: "primary"}, "/replica", 503, "not a replica"},
+		{&fakeDataSource{role: "replica", byteLag: 4096}, "/replica?max_allowable_byte_lag=1kB", 503, "byte lag 4096 greater than 1kB"},
+		{&fakeDataSource{role: "replica", syncState: "async"}, "/sync", 503, "not a synchronous standby, sync_state is async"},
+		{&fakeDataSource{role: "replica"}, "/standby-leader", 503, "not a standby cluster"},
+		{&fakeDataSource{nodeInfoErr: ErrSnapshotStale}, "/replica", 500, ErrSnapshotStale.Error()},
+		{&fakeDataSource{nodeInfoErr: errors.New("connection refused")}, "/health", 503, "connection refused"},
+	}
+
+	for _, c := range cases {
+		hcs := &HealthCheckWebService{healthChecker: NewHealthChecker(c.fds), cfg: &config.Config{}}
+		router := mux.NewRouter()
+		hcs.registerRoutes(router)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", c.path, nil))
+		if w.Code != c.status || w.Header().Get(reasonHeader) != c.reason {
+			t.Fatalf("%s returned %d with reason %q but expected %d with %q", c.path, w.Code, w.Header().Get(reasonHeader), c.status, c.reason)
+		}
+	}
+}
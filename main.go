@@ -1,116 +1,237 @@
 package main
 
 import (
-	"encoding/json"
-	"errors"
+	"context"
 	"flag"
 	"fmt"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
-	"strconv"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/film42/pgreba/config"
-	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-type HealthCheckWebService struct {
-	healthChecker *HealthChecker
-}
-
-func (hc *HealthCheckWebService) apiGetIsPrimary(w http.ResponseWriter, r *http.Request) {
-	nodeInfo, err := hc.healthChecker.dataSource.GetNodeInfo()
-	if err != nil {
-		// Return a 500. Something bad happened.
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
+// How long in-flight checks get to finish after SIGTERM or SIGINT.
+const shutdownTimeout = 10 * time.Second
 
-	if !nodeInfo.IsPrimary() {
-		w.WriteHeader(http.StatusServiceUnavailable)
+func main() {
+	versionPtr := flag.Bool("version", false, "Print the teecp version and exit.")
+	configFlags := config.RegisterFlags(flag.CommandLine)
+	flag.Usage = func() {
+		fmt.Fprintln(flag.CommandLine.Output(), "Usage: pgreba [flags] [path/to/config.yml]")
+		fmt.Fprintln(flag.CommandLine.Output(), "       pgreba check-config [-connect] path/to/config.yml")
+		flag.PrintDefaults()
 	}
+	flag.Parse()
 
-	json.NewEncoder(w).Encode(nodeInfo)
-}
-
-func (hc *HealthCheckWebService) apiGetIsReplica(w http.ResponseWriter, r *http.Request) {
-	nodeInfo, err := hc.healthChecker.dataSource.GetNodeInfo()
-	if err != nil {
-		// Return a 500. Something bad happened.
-		http.Error(w, err.Error(), http.StatusInternalServerError)
+	if *versionPtr {
+		fmt.Println("1.3.2")
 		return
 	}
 
-	// if replica OR byte lag exceeds max_allowable_byte_lag then return 500
-	if !nodeInfo.IsReplica() || maxAllowableByteLagExceeded(r, nodeInfo) {
-		w.WriteHeader(http.StatusServiceUnavailable)
+	if flag.Arg(0) == "check-config" {
+		os.Exit(runCheckConfig(flag.Args()[1:]))
 	}
 
-	json.NewEncoder(w).Encode(nodeInfo)
-}
-
-func maxAllowableByteLagExceeded(r *http.Request, nodeInfo *NodeInfo) bool {
-	maxAllowableByteLagString := r.URL.Query().Get("max_allowable_byte_lag")
+	// The config file is optional since everything can be set from the
+	// environment or flags.
+	pathToConfig := flag.Arg(0)
 
-	// If byte lag was not specified, assume the replica is up to date.
-	if len(maxAllowableByteLagString) == 0 {
-		return false
+	cfg, err := config.Load(pathToConfig, os.Environ(), configFlags)
+	if err == nil {
+		err = cfg.Validate()
 	}
-
-	maxAllowableByteLag, err := strconv.ParseInt(maxAllowableByteLagString, 10, 64)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	setupLogging(cfg)
+	shutdownTracing, err := setupTracing(context.Background(), cfg)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	return nodeInfo.ByteLag > maxAllowableByteLag
-}
+	// Subscribe the notifier before any node is watched, so problems found
+	// on startup are sent too.
+	events := newEventBus()
+	var notifications *notifier
+	if cfg.Notifications != nil {
+		notifications = newNotifier(cfg, events)
+		notifications.Start()
+	}
 
-func main() {
-	versionPtr := flag.Bool("version", false, "Print the teecp version and exit.")
-	flag.Parse()
+	instances := []*monitoredInstance{}
+	for _, instance := range cfg.Instances() {
+		mi := newMonitoredInstance(instance, events)
+		mi.registerMetrics(prometheus.DefaultRegisterer)
+		mi.Start()
+		instances = append(instances, mi)
+	}
 
-	if *versionPtr {
-		fmt.Println("1.3.2")
-		return
+	var auth *authenticator
+	if cfg.Auth != nil {
+		auth = newAuthenticator(cfg)
 	}
 
-	if len(os.Args) < 2 {
-		panic(errors.New("Please provide a path to config yml."))
+	newRouter := func() *mux.Router {
+		router := mux.NewRouter()
+		router.Use(requestIDMiddleware)
+		router.Use(tracingMiddleware)
+		router.Use(accessLogMiddleware)
+		router.Use(metricsMiddleware)
+		if auth != nil {
+			router.Use(auth.middleware)
+		}
+		router.Handle("/metrics", promhttp.Handler()).Methods("GET")
+		return router
 	}
-	pathToConfig := os.Args[1]
 
-	cfg, err := config.ParseConfig(pathToConfig)
+	var cluster *clusterView
+	if cfg.Cluster != nil {
+		cluster, err = newClusterView(cfg)
+		if err != nil {
+			panic(err)
+		}
+	}
 
+	// Named instances are served under /{instance}/. An instance with its
+	// own listen address is also served from the root of that address, so
+	// it can replace a dedicated sidecar without changing HAProxy configs.
+	router := newRouter()
+	srv, err := newHTTPServer(cfg, router)
 	if err != nil {
 		panic(err)
 	}
+	servers := map[*http.Server]*config.Config{srv: cfg}
+	if cluster != nil {
+		router.HandleFunc("/cluster", cluster.apiGetCluster).Methods("GET")
+	}
+	router.HandleFunc("/events", events.apiGetEvents).Methods("GET")
+	for _, mi := range instances {
+		if len(mi.name) == 0 {
+			mi.registerRoutes(router)
+			continue
+		}
+		mi.registerRoutes(router.PathPrefix("/" + mi.name).Subrouter())
+
+		instanceCfg := mi.hcs.getConfig()
+		if instanceCfg.ListenAddress != cfg.ListenAddress {
+			instanceRouter := newRouter()
+			mi.registerRoutes(instanceRouter)
+			instanceSrv, err := newHTTPServer(instanceCfg, instanceRouter)
+			if err != nil {
+				panic(err)
+			}
+			servers[instanceSrv] = instanceCfg
+		}
+	}
 
-	ds := NewPgReplicationDataSource(cfg)
-	defer ds.Close()
-
-	// Wrap the data source in a caching layer to prevent
-	// many concurrent health-checks from bogging things down.
-	ds = NewCachedDataSource(ds)
+	closeInstances := func() {
+		for _, mi := range instances {
+			if err := mi.Close(); err != nil {
+				slog.Error("Error closing data source", "instance", mi.name, "error", err)
+			}
+		}
+	}
 
-	// Fake data source
-	fds := new(fakeDataSource)
-	fds = fds
+	agentCheckServers := []*agentCheckServer{}
+	for _, mi := range instances {
+		address := mi.hcs.getConfig().AgentCheckAddress
+		if len(address) == 0 {
+			continue
+		}
+		acs, err := newAgentCheckServer(address, mi.ds, mi.hcs.getConfig, mi.hcs.maintenance)
+		if err != nil {
+			panic(err)
+		}
+		agentCheckServers = append(agentCheckServers, acs)
+	}
 
-	hc := NewHealthChecker(ds)
-	hcs := &HealthCheckWebService{healthChecker: hc}
+	var proxy *tcpProxy
+	if cfg.Proxy != nil {
+		proxy = newTCPProxy(cfg)
+		if err := proxy.Listen(); err != nil {
+			panic(err)
+		}
+	}
 
-	router := mux.NewRouter()
-	router.Use(func(next http.Handler) http.Handler {
-		return handlers.LoggingHandler(log.Writer(), next)
-	})
+	serverErrors := make(chan error, len(servers)+len(agentCheckServers)+1)
+	for srv, srvCfg := range servers {
+		go func(srv *http.Server, srvCfg *config.Config) {
+			slog.Info("Listening", "address", srvCfg.ListenAddress)
+			serverErrors <- listenAndServe(srv, srvCfg)
+		}(srv, srvCfg)
+	}
+	for _, acs := range agentCheckServers {
+		go func(acs *agentCheckServer) {
+			slog.Info("Serving HAProxy agent checks", "address", acs.Addr().String())
+			serverErrors <- acs.Serve()
+		}(acs)
+	}
 
-	router.HandleFunc("/", hcs.apiGetIsPrimary).Methods("GET")
-	router.HandleFunc("/primary", hcs.apiGetIsPrimary).Methods("GET")
+	if proxy != nil {
+		go func() {
+			serverErrors <- proxy.Serve()
+		}()
+	}
 
-	// For replicas
-	router.HandleFunc("/replica", hcs.apiGetIsReplica).Methods("GET")
+	reloader := &configReloader{path: pathToConfig, flags: configFlags, cfg: cfg, instances: instances, proxy: proxy, cluster: cluster, notifier: notifications, auth: auth}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+
+	for running := true; running; {
+		select {
+		case err := <-serverErrors:
+			closeInstances()
+			panic(err)
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				// Keep serving with the current config if the new one
+				// is broken.
+				if err := reloader.reload(); err != nil {
+					slog.Error("Error reloading config, keeping the current config", "error", err)
+				}
+				continue
+			}
+			slog.Info("Shutting down", "signal", sig.String())
+			running = false
+		}
+	}
 
-	log.Println("Listening on :8000")
-	http.ListenAndServe(":8000", router)
+	// Stop accepting new checks and let in-flight checks drain before the
+	// connection pools go away. Event streams never finish on their own.
+	events.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("Error shutting down http server", "error", err)
+		}
+	}
+	for _, acs := range agentCheckServers {
+		if err := acs.Close(); err != nil {
+			slog.Error("Error closing agent-check listener", "error", err)
+		}
+	}
+	if proxy != nil {
+		proxy.Close()
+	}
+	if cluster != nil {
+		cluster.Close()
+	}
+	if notifications != nil {
+		notifications.Close()
+	}
+	closeInstances()
+	if err := shutdownTracing(ctx); err != nil {
+		slog.Error("Error flushing traces", "error", err)
+	}
 }
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/film42/pgreba/config"
+)
+
+var (
+	ErrMaintenanceNotConfigured = errors.New("err: maintenance_file is not configured")
+	ErrMaintenanceReason        = errors.New("err: a reason is required")
+)
+
+// Manual maintenance, e.g. while patching a node. Role checks fail and the
+// agent-check drains the node until it is cleared or expires.
+type Maintenance struct {
+	Reason    string     `json:"reason"`
+	Since     time.Time  `json:"since"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+func (m *Maintenance) expired(now time.Time) bool {
+	return m.ExpiresAt != nil && !now.Before(*m.ExpiresAt)
+}
+
+// Reads and writes the maintenance_file, so maintenance survives restarts and
+// can also be set by creating the file by hand.
+type maintenanceMode struct {
+	mutex     sync.Mutex
+	getConfig func() *config.Config
+}
+
+// The current maintenance, or nil. A file which can't be read counts as
+// maintenance, since putting a node back into rotation by mistake is worse
+// than keeping it out.
+func (mm *maintenanceMode) Current() *Maintenance {
+	if mm == nil {
+		return nil
+	}
+	path := mm.getConfig().MaintenanceFile
+	if len(path) == 0 {
+		return nil
+	}
+
+	maintenance, err := readMaintenanceFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		slog.Error("Error reading maintenance_file", "error", err)
+		return &Maintenance{Reason: err.Error()}
+	}
+	if maintenance.expired(time.Now()) {
+		return nil
+	}
+	return maintenance
+}
+
+// The file holds a Maintenance document as written by Set, or for files
+// created by hand, the reason as plain text.
+func readMaintenanceFile(path string) (*Maintenance, error) {
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	maintenance := &Maintenance{}
+	if err := json.Unmarshal(contents, maintenance); err == nil {
+		return maintenance, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	maintenance = &Maintenance{Reason: strings.TrimSpace(string(contents)), Since: info.ModTime()}
+	if len(maintenance.Reason) == 0 {
+		maintenance.Reason = "maintenance_file exists"
+	}
+	return maintenance, nil
+}
+
+// Writes the maintenance_file atomically, so a crash never leaves a half
+// written file behind.
+func (mm *maintenanceMode) Set(maintenance *Maintenance) error {
+	if mm == nil {
+		return ErrMaintenanceNotConfigured
+	}
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	path := mm.getConfig().MaintenanceFile
+	if len(path) == 0 {
+		return ErrMaintenanceNotConfigured
+	}
+	contents, err := json.Marshal(maintenance)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(contents); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (mm *maintenanceMode) Clear() error {
+	if mm == nil {
+		return ErrMaintenanceNotConfigured
+	}
+	mm.mutex.Lock()
+	defer mm.mutex.Unlock()
+
+	path := mm.getConfig().MaintenanceFile
+	if len(path) == 0 {
+		return ErrMaintenanceNotConfigured
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Changing maintenance takes a caller authenticated by the auth rules,
+// maintenance_token as a bearer token, or when neither is set, a verified
+// client certificate. Config validation keeps maintenance_token and auth
+// apart, since the auth middleware rejects bearer tokens it doesn't know.
+func (mm *maintenanceMode) authorized(r *http.Request) bool {
+	if mm == nil {
+		return false
+	}
+	if requestPrincipal(r) != nil {
+		return true
+	}
+	token := mm.getConfig().MaintenanceToken
+	if len(token) == 0 {
+		return r.TLS != nil && len(r.TLS.VerifiedChains) > 0
+	}
+	given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(given), []byte(token)) == 1
+}
+
+type MaintenanceStatus struct {
+	InMaintenance bool `json:"maintenance"`
+	*Maintenance
+}
+
+type maintenanceRequest struct {
+	Reason string `json:"reason"`
+	// A duration such as "2h", or a time. Both are optional.
+	ExpiresIn string     `json:"expires_in"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func writeMaintenanceStatus(w http.ResponseWriter, maintenance *Maintenance) {
+	json.NewEncoder(w).Encode(&MaintenanceStatus{InMaintenance: maintenance != nil, Maintenance: maintenance})
+}
+
+func (hc *HealthCheckWebService) apiGetMaintenance(w http.ResponseWriter, r *http.Request) {
+	writeMaintenanceStatus(w, hc.maintenance.Current())
+}
+
+func (hc *HealthCheckWebService) apiPostMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !hc.maintenance.authorized(r) {
+		http.Error(w, "err: unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	req := &maintenanceRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		http.Error(w, "err: invalid request body: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(strings.TrimSpace(req.Reason)) == 0 {
+		http.Error(w, ErrMaintenanceReason.Error(), http.StatusBadRequest)
+		return
+	}
+
+	now := time.Now()
+	maintenance := &Maintenance{Reason: req.Reason, Since: now, ExpiresAt: req.ExpiresAt}
+	if len(req.ExpiresIn) > 0 {
+		expiresIn, err := time.ParseDuration(req.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			http.Error(w, "err: expires_in must be a positive duration such as 2h", http.StatusBadRequest)
+			return
+		}
+		expiresAt := now.Add(expiresIn)
+		maintenance.ExpiresAt = &expiresAt
+	}
+
+	if err := hc.maintenance.Set(maintenance); err != nil {
+		if err == ErrMaintenanceNotConfigured {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		// Return a 500. Something bad happened.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Maintenance started", "reason", maintenance.Reason)
+	writeMaintenanceStatus(w, maintenance)
+}
+
+func (hc *HealthCheckWebService) apiDeleteMaintenance(w http.ResponseWriter, r *http.Request) {
+	if !hc.maintenance.authorized(r) {
+		http.Error(w, "err: unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	if err := hc.maintenance.Clear(); err != nil {
+		if err == ErrMaintenanceNotConfigured {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		// Return a 500. Something bad happened.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Maintenance ended")
+	writeMaintenanceStatus(w, nil)
+}
+
+// Like writeNodeInfo, but always unhealthy during maintenance so load
+// balancers take the node out of rotation. An empty reason passes the check.
+func (hc *HealthCheckWebService) writeRoleCheck(w http.ResponseWriter, r *http.Request, profile responseProfile, nodeInfo *NodeInfo, reason string) {
+	maintenance := hc.maintenance.Current()
+	if maintenance == nil {
+		reportCheck(w, r, reason)
+		writeNodeInfo(w, profile, nodeInfo, len(reason) == 0)
+		return
+	}
+
+	reportCheck(w, r, "maintenance: "+maintenance.Reason)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	switch profile {
+	case responseStatus:
+	case responseSummary:
+		json.NewEncoder(w).Encode(&struct {
+			*NodeSummary
+			Maintenance *Maintenance `json:"maintenance"`
+		}{newNodeSummary(nodeInfo), maintenance})
+	default:
+		json.NewEncoder(w).Encode(&struct {
+			*NodeInfo
+			Maintenance *Maintenance `json:"maintenance"`
+		}{nodeInfo, maintenance})
+	}
+}
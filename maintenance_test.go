@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/film42/pgreba/config"
+	"github.com/gorilla/mux"
+)
+
+func TestMaintenanceTakesTheNodeOutOfRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgreba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{MaintenanceFile: filepath.Join(dir, "maintenance"), MaintenanceToken: "secret"}
+	newRouter := func() *mux.Router {
+		hcs := &HealthCheckWebService{healthChecker: NewHealthChecker(&fakeDataSource{role: "replica"}), cfg: cfg}
+		hcs.maintenance = &maintenanceMode{getConfig: hcs.getConfig}
+		router := mux.NewRouter()
+		hcs.registerRoutes(router)
+		return router
+	}
+	router := newRouter()
+	request := func(router *mux.Router, method string, path string, token string, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, strings.NewReader(body))
+		if len(token) > 0 {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		return w
+	}
+
+	if w := request(router, "GET", "/replica", "", ""); w.Code != 200 {
+		t.Fatal("Expected a 200 before maintenance but found", w.Code)
+	}
+	if w := request(router, "POST", "/maintenance", "wrong", `{"reason": "patching"}`); w.Code != 401 {
+		t.Fatal("Expected a 401 for a wrong token but found", w.Code)
+	}
+	if w := request(router, "POST", "/maintenance", "secret", `{}`); w.Code != 400 {
+		t.Fatal("Expected a 400 without a reason but found", w.Code)
+	}
+	w := request(router, "POST", "/maintenance", "secret", `{"reason": "patching", "expires_in": "2h"}`)
+	if w.Code != 200 {
+		t.Fatal("Expected a 200 but found", w.Code, w.Body.String())
+	}
+
+	// Maintenance survives a restart.
+	router = newRouter()
+	w = request(router, "GET", "/replica", "", "")
+	body := &struct {
+		Role        string       `json:"role"`
+		Maintenance *Maintenance `json:"maintenance"`
+	}{}
+	if err := json.Unmarshal(w.Body.Bytes(), body); err != nil {
+		t.Fatal(err)
+	}
+	if w.Code != 503 || body.Role != "replica" || body.Maintenance.Reason != "patching" ||
+		body.Maintenance.ExpiresAt.Sub(body.Maintenance.Since) != 2*time.Hour {
+		t.Fatal("Expected a 503 during maintenance but found", w.Code, w.Body.String())
+	}
+	if w := request(router, "GET", "/health", "", ""); w.Code != 200 {
+		t.Fatal("Expected /health to ignore maintenance but found", w.Code)
+	}
+
+	if w := request(router, "DELETE", "/maintenance", "secret", ""); w.Code != 200 {
+		t.Fatal("Expected a 200 but found", w.Code)
+	}
+	if w := request(router, "GET", "/replica", "", ""); w.Code != 200 {
+		t.Fatal("Expected a 200 after maintenance but found", w.Code)
+	}
+}
+
+func TestMaintenanceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgreba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &config.Config{MaintenanceFile: filepath.Join(dir, "maintenance")}
+	mm := &maintenanceMode{getConfig: func() *config.Config { return cfg }}
+	if maintenance := mm.Current(); maintenance != nil {
+		t.Fatal("Expected no maintenance without a file but found", maintenance)
+	}
+
+	// Created by hand.
+	if err := ioutil.WriteFile(cfg.MaintenanceFile, []byte("kernel upgrade\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if maintenance := mm.Current(); maintenance == nil || maintenance.Reason != "kernel upgrade" || maintenance.Since.IsZero() {
+		t.Fatal("Expected maintenance from the file but found", maintenance)
+	}
+
+	expiresAt := time.Now().Add(-time.Minute)
+	if err := mm.Set(&Maintenance{Reason: "patching", ExpiresAt: &expiresAt}); err != nil {
+		t.Fatal(err)
+	}
+	if maintenance := mm.Current(); maintenance != nil {
+		t.Fatal("Expected expired maintenance to be ignored but found", maintenance)
+	}
+
+	// When in doubt, stay out of rotation.
+	if err := os.Remove(cfg.MaintenanceFile); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(cfg.MaintenanceFile, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if maintenance := mm.Current(); maintenance == nil {
+		t.Fatal("Expected an unreadable file to count as maintenance")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	httpRequestsCounter = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "pgreba_http_requests_total",
+		Help: "Health-check requests by endpoint and status code.",
+	}, []string{"endpoint", "code"})
+
+	queryDurationHistogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "pgreba_query_duration_seconds",
+		Help:    "Latency of queries against postgres, including upstream hops.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"query"})
+)
+
+func init() {
+	prometheus.MustRegister(httpRequestsCounter, queryDurationHistogram)
+}
+
+func observeQueryDuration(query string, start time.Time) {
+	queryDurationHistogram.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
+
+// Captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Lets streaming handlers such as /events flush through the recorder.
+func (sr *statusRecorder) Flush() {
+	if flusher, ok := sr.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Counts requests by their route template so path params don't blow up the
+// label cardinality.
+func metricsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		endpoint := r.URL.Path
+		if route := mux.CurrentRoute(r); route != nil {
+			if template, err := route.GetPathTemplate(); err == nil {
+				endpoint = template
+			}
+		}
+		httpRequestsCounter.WithLabelValues(endpoint, strconv.Itoa(recorder.status)).Inc()
+	})
+}
+
+// Exposes node and replication state by reading from the data source on
+// every scrape. This should be given the cached data source.
+type nodeCollector struct {
+	dataSource ReplicationDataSource
+
+	up                   *prometheus.Desc
+	role                 *prometheus.Desc
+	timeline             *prometheus.Desc
+	walLocation          *prometheus.Desc
+	receivedLocation     *prometheus.Desc
+	replayedLocation     *prometheus.Desc
+	byteLag              *prometheus.Desc
+	lagSeconds           *prometheus.Desc
+	replayPaused         *prometheus.Desc
+	standbyWriteLag      *prometheus.Desc
+	standbyFlushLag      *prometheus.Desc
+	standbyReplayLag     *prometheus.Desc
+	slotActive           *prometheus.Desc
+	slotWalStatus        *prometheus.Desc
+	slotSafeWalSizeBytes *prometheus.Desc
+}
+
+func newNodeCollector(dataSource ReplicationDataSource) *nodeCollector {
+	desc := func(name, help string, labels ...string) *prometheus.Desc {
+		return prometheus.NewDesc("pgreba_"+name, help, labels, nil)
+	}
+
+	return &nodeCollector{
+		dataSource: dataSource,
+
+		up:                   desc("up", "Whether the last node info query succeeded."),
+		role:                 desc("node_role", "The role of the node.", "role"),
+		timeline:             desc("node_timeline", "The timeline of a primary, zero for replicas."),
+		walLocation:          desc("xlog_location_bytes", "Current WAL location of a primary."),
+		receivedLocation:     desc("xlog_received_location_bytes", "Last WAL location received by a replica."),
+		replayedLocation:     desc("xlog_replayed_location_bytes", "Last WAL location replayed by a replica."),
+		byteLag:              desc("replication_byte_lag_bytes", "Bytes the replica is behind the primary."),
+		lagSeconds:           desc("replication_lag_seconds", "Seconds the replica is behind the primary."),
+		replayPaused:         desc("xlog_replay_paused", "Whether WAL replay is paused."),
+		standbyWriteLag:      desc("standby_write_lag_seconds", "Write lag reported for a downstream standby.", "application_name", "client_addr"),
+		standbyFlushLag:      desc("standby_flush_lag_seconds", "Flush lag reported for a downstream standby.", "application_name", "client_addr"),
+		standbyReplayLag:     desc("standby_replay_lag_seconds", "Replay lag reported for a downstream standby.", "application_name", "client_addr"),
+		slotActive:           desc("replication_slot_active", "Whether the replication slot is active.", "slot_name", "slot_type"),
+		slotWalStatus:        desc("replication_slot_wal_status", "The wal_status of the replication slot.", "slot_name", "wal_status"),
+		slotSafeWalSizeBytes: desc("replication_slot_safe_wal_size_bytes", "Bytes that can be written before the slot is lost.", "slot_name"),
+	}
+}
+
+func (nc *nodeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- nc.up
+	ch <- nc.role
+	ch <- nc.timeline
+	ch <- nc.walLocation
+	ch <- nc.receivedLocation
+	ch <- nc.replayedLocation
+	ch <- nc.byteLag
+	ch <- nc.lagSeconds
+	ch <- nc.replayPaused
+	ch <- nc.standbyWriteLag
+	ch <- nc.standbyFlushLag
+	ch <- nc.standbyReplayLag
+	ch <- nc.slotActive
+	ch <- nc.slotWalStatus
+	ch <- nc.slotSafeWalSizeBytes
+}
+
+func (nc *nodeCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx := context.Background()
+	nodeInfo, err := nc.dataSource.GetNodeInfo(ctx)
+	if err != nil {
+		slog.Error("Error collecting node info metrics", "error", err)
+		ch <- prometheus.MustNewConstMetric(nc.up, prometheus.GaugeValue, 0)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(nc.up, prometheus.GaugeValue, 1)
+
+	for _, role := range []string{"primary", "replica"} {
+		ch <- prometheus.MustNewConstMetric(nc.role, prometheus.GaugeValue, boolToFloat(nodeInfo.Role == role), role)
+	}
+	ch <- prometheus.MustNewConstMetric(nc.timeline, prometheus.GaugeValue, float64(nodeInfo.State))
+	ch <- prometheus.MustNewConstMetric(nc.byteLag, prometheus.GaugeValue, float64(nodeInfo.ByteLag))
+	if nodeInfo.LagSeconds.Valid {
+		ch <- prometheus.MustNewConstMetric(nc.lagSeconds, prometheus.GaugeValue, nodeInfo.LagSeconds.Float64)
+	}
+	if nodeInfo.Xlog != nil {
+		ch <- prometheus.MustNewConstMetric(nc.walLocation, prometheus.CounterValue, float64(nodeInfo.Xlog.Location))
+		ch <- prometheus.MustNewConstMetric(nc.receivedLocation, prometheus.CounterValue, float64(nodeInfo.Xlog.ReceivedLocation))
+		if nodeInfo.Xlog.ReplayedLocation.Valid {
+			ch <- prometheus.MustNewConstMetric(nc.replayedLocation, prometheus.CounterValue, float64(nodeInfo.Xlog.ReplayedLocation.Int64))
+		}
+		ch <- prometheus.MustNewConstMetric(nc.replayPaused, prometheus.GaugeValue, boolToFloat(nodeInfo.Xlog.Paused))
+	}
+
+	stats, err := nc.dataSource.GetPgStatReplication(ctx)
+	if err != nil {
+		slog.Error("Error collecting pg_stat_replication metrics", "error", err)
+	}
+	for _, stat := range stats {
+		ch <- prometheus.MustNewConstMetric(nc.standbyWriteLag, prometheus.GaugeValue, stat.WriteLag.Seconds(), stat.ApplicationName, stat.ClientAddr)
+		ch <- prometheus.MustNewConstMetric(nc.standbyFlushLag, prometheus.GaugeValue, stat.FlushLag.Seconds(), stat.ApplicationName, stat.ClientAddr)
+		ch <- prometheus.MustNewConstMetric(nc.standbyReplayLag, prometheus.GaugeValue, stat.ReplayLag.Seconds(), stat.ApplicationName, stat.ClientAddr)
+	}
+
+	slots, err := nc.dataSource.GetPgReplicationSlots(ctx)
+	if err != nil {
+		slog.Error("Error collecting pg_replication_slots metrics", "error", err)
+	}
+	for _, slot := range slots {
+		ch <- prometheus.MustNewConstMetric(nc.slotActive, prometheus.GaugeValue, boolToFloat(slot.Active), slot.SlotName, slot.SlotType)
+		if slot.WalStatus.Valid {
+			ch <- prometheus.MustNewConstMetric(nc.slotWalStatus, prometheus.GaugeValue, 1, slot.SlotName, slot.WalStatus.String)
+		}
+		if slot.SafeWalSize.Valid {
+			ch <- prometheus.MustNewConstMetric(nc.slotSafeWalSizeBytes, prometheus.GaugeValue, float64(slot.SafeWalSize.Int64), slot.SlotName)
+		}
+	}
+}
+
+func boolToFloat(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
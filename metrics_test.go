@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestNodeCollector_ExposesNodeAndReplicationState(t *testing.T) {
+	fds := &fakeDataSource{role: "replica", byteLag: 1337}
+	collector := newNodeCollector(fds)
+
+	expected := `
+# HELP pgreba_replication_byte_lag_bytes Bytes the replica is behind the primary.
+# TYPE pgreba_replication_byte_lag_bytes gauge
+pgreba_replication_byte_lag_bytes 1337
+# HELP pgreba_node_role The role of the node.
+# TYPE pgreba_node_role gauge
+pgreba_node_role{role="primary"} 0
+pgreba_node_role{role="replica"} 1
+# HELP pgreba_standby_flush_lag_seconds Flush lag reported for a downstream standby.
+# TYPE pgreba_standby_flush_lag_seconds gauge
+pgreba_standby_flush_lag_seconds{application_name="pghost_created_replication_slot",client_addr=""} 1
+# HELP pgreba_replication_slot_active Whether the replication slot is active.
+# TYPE pgreba_replication_slot_active gauge
+pgreba_replication_slot_active{slot_name="pghost_created_replication_slot",slot_type=""} 1
+`
+	err := testutil.CollectAndCompare(collector, strings.NewReader(expected),
+		"pgreba_replication_byte_lag_bytes",
+		"pgreba_node_role",
+		"pgreba_standby_flush_lag_seconds",
+		"pgreba_replication_slot_active",
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,24 +1,65 @@
 package main
 
 import (
+	"context"
+	"sync/atomic"
 	"time"
 
 	"gopkg.in/volatiletech/null.v6"
 )
 
 type fakeDataSource struct {
-	byteLag int64
+	role        string
+	byteLag     int64
+	syncState   string
+	nodeInfoErr error
+	// Fails GetNodeInfo and GetNodeStatus for replicas, as when the primary
+	// is unreachable.
+	upstreamErr   error
+	slots         []*PgReplicationSlot
+	subscriptions []*PgStatSubscription
+	topology      *Topology
+	// Counts node info queries, local or not.
+	calls int64
 }
 
 func (fdr *fakeDataSource) Close() error {
 	return nil
 }
 
-func (fdr *fakeDataSource) GetNodeInfo() (*NodeInfo, error) {
+func (fdr *fakeDataSource) GetNodeInfo(ctx context.Context) (*NodeInfo, error) {
+	nodeInfo, err := fdr.getNodeInfo()
+	if err == nil && nodeInfo.IsReplica() && fdr.upstreamErr != nil {
+		return nil, fdr.upstreamErr
+	}
+	return nodeInfo, err
+}
+
+func (fdr *fakeDataSource) GetNodeStatus(ctx context.Context) (*NodeInfo, error) {
+	return fdr.GetNodeInfo(ctx)
+}
+
+func (fdr *fakeDataSource) GetLocalNodeStatus(ctx context.Context) (*NodeInfo, error) {
+	nodeInfo, err := fdr.getNodeInfo()
+	if err == nil && nodeInfo.IsReplica() {
+		nodeInfo.ByteLag = 0
+	}
+	return nodeInfo, err
+}
+
+func (fdr *fakeDataSource) getNodeInfo() (*NodeInfo, error) {
+	atomic.AddInt64(&fdr.calls, 1)
+	if fdr.nodeInfoErr != nil {
+		return nil, fdr.nodeInfoErr
+	}
+	role := fdr.role
+	if len(role) == 0 {
+		role = "primary"
+	}
 	return &NodeInfo{
 		State:               1,
 		PostmasterStartTime: "2020-11-12 10:55:55.073 EST",
-		Role:                "primary",
+		Role:                role,
 		Xlog: &XlogInfo{
 			Location:         137936246584,
 			ReceivedLocation: 137936246408,
@@ -29,11 +70,11 @@ func (fdr *fakeDataSource) GetNodeInfo() (*NodeInfo, error) {
 	}, nil
 }
 
-func (fdr *fakeDataSource) IsInRecovery() (bool, error) {
+func (fdr *fakeDataSource) IsInRecovery(ctx context.Context) (bool, error) {
 	return false, nil
 }
 
-func (fdr *fakeDataSource) GetPgStatReplication() ([]*PgStatReplication, error) {
+func (fdr *fakeDataSource) GetPgStatReplication(ctx context.Context) ([]*PgStatReplication, error) {
 	return []*PgStatReplication{
 		{
 			ApplicationName: "pghost_created_replication_slot",
@@ -41,7 +82,49 @@ func (fdr *fakeDataSource) GetPgStatReplication() ([]*PgStatReplication, error)
 		},
 	}, nil
 }
-func (fdr *fakeDataSource) GetPgReplicationSlots() ([]*PgReplicationSlot, error) {
+
+func (fdr *fakeDataSource) GetSyncState(ctx context.Context) (string, error) {
+	return fdr.syncState, nil
+}
+
+func (fdr *fakeDataSource) GetTopology(ctx context.Context) (*Topology, error) {
+	if fdr.topology != nil {
+		return fdr.topology, nil
+	}
+	return &Topology{
+		Nodes: []*TopologyNode{
+			{
+				Host:                "replica1",
+				Port:                "5432",
+				Role:                "replica",
+				ReplayedLsn:         null.StringFrom("20/1000"),
+				ByteLagFromUpstream: null.Int64From(fdr.byteLag),
+				Standbys:            []*TopologyStandby{},
+			},
+			{
+				Host:       "primary1",
+				Port:       "5432",
+				Hop:        1,
+				Role:       "primary",
+				CurrentLsn: null.StringFrom("20/1000"),
+				Standbys:   []*TopologyStandby{{ApplicationName: "replica1"}},
+			},
+		},
+		Complete: true,
+	}, nil
+}
+
+func (fdr *fakeDataSource) GetPgStatSubscription(ctx context.Context) ([]*PgStatSubscription, error) {
+	if fdr.subscriptions != nil {
+		return fdr.subscriptions, nil
+	}
+	return []*PgStatSubscription{}, nil
+}
+
+func (fdr *fakeDataSource) GetPgReplicationSlots(ctx context.Context) ([]*PgReplicationSlot, error) {
+	if fdr.slots != nil {
+		return fdr.slots, nil
+	}
 	return []*PgReplicationSlot{
 		{
 			SlotName: "pghost_created_replication_slot",
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/film42/pgreba/config"
+)
+
+const (
+	defaultNotificationMinInterval  = 5 * time.Minute
+	defaultNotificationMaxRetries   = 3
+	defaultNotificationRetryBackoff = time.Second
+	defaultNotificationTimeout      = 10 * time.Second
+	maxNotificationRetryBackoff     = time.Minute
+
+	// How many notifications a webhook may fall behind before missing some.
+	webhookQueueSize = 64
+)
+
+// The document sent to generic JSON webhooks.
+type Notification struct {
+	// Stays the same across retries, so receivers can drop duplicates.
+	ID       string    `json:"id"`
+	Type     string    `json:"type"`
+	Time     time.Time `json:"time"`
+	Host     string    `json:"host"`
+	Instance string    `json:"instance,omitempty"`
+	Slot     string    `json:"slot,omitempty"`
+	Message  string    `json:"message"`
+	Previous *NodeInfo `json:"previous"`
+	Current  *NodeInfo `json:"current"`
+}
+
+// The subject of a notification. Notifications about the same condition
+// report its latest state, e.g. lag_exceeded and lag_recovered.
+func (n *Notification) condition() string {
+	switch n.Type {
+	case "promoted", "demoted":
+		return n.Instance + "/role"
+	case "lag_exceeded", "lag_recovered":
+		return n.Instance + "/lag"
+	case "replay_paused", "replay_resumed":
+		return n.Instance + "/replay"
+	}
+	return n.Instance + "/" + n.Type + "/" + n.Slot
+}
+
+func (n *Notification) slackText() string {
+	source := n.Host
+	if len(n.Instance) > 0 {
+		source += " (" + n.Instance + ")"
+	}
+	return fmt.Sprintf("PgReba %s: %s: %s", source, n.Type, n.Message)
+}
+
+// The notification type an event triggers, if any.
+func notificationType(event *Event) string {
+	switch event.Type {
+	case EventRoleChanged:
+		if event.Current != nil && event.Current.IsPrimary() {
+			return "promoted"
+		}
+		return "demoted"
+	case EventLagExceeded, EventLagRecovered, EventReplayPaused, EventReplayResumed, EventSlotLost:
+		return event.Type
+	}
+	return ""
+}
+
+// The delivery state of a condition.
+type notificationCondition struct {
+	// The type of the last notification sent.
+	delivered string
+	// The latest notification held back by the minimum interval, sent when
+	// the interval is up unless the condition returned to the delivered
+	// state in the meantime.
+	pending *Notification
+	timer   *time.Timer
+}
+
+// Sends webhooks for promotions, demotions, lag, paused replay and lost slots
+// published on the event bus. A notification repeating the state last sent
+// for its condition is dropped, and each type is sent at most once per
+// min_interval for each node, so a flapping replica collapses into its
+// final state.
+type notifier struct {
+	mutex      sync.Mutex
+	cfg        *config.NotificationsConfig
+	events     *eventBus
+	client     *http.Client
+	host       string
+	workers    map[config.WebhookConfig]*webhookWorker
+	lastSent   map[string]time.Time
+	conditions map[string]*notificationCondition
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+func newNotifier(cfg *config.Config, events *eventBus) *notifier {
+	host, _ := os.Hostname()
+	ctx, cancel := context.WithCancel(context.Background())
+	n := &notifier{
+		events:     events,
+		client:     &http.Client{},
+		host:       host,
+		workers:    make(map[config.WebhookConfig]*webhookWorker),
+		lastSent:   make(map[string]time.Time),
+		conditions: make(map[string]*notificationCondition),
+		ctx:        ctx,
+		cancel:     cancel,
+	}
+	n.setConfig(cfg.Notifications)
+	return n
+}
+
+// Swaps in the config and starts or stops webhook workers to match it. Must
+// be called with the mutex held, or before Start.
+func (n *notifier) setConfig(cfg *config.NotificationsConfig) {
+	n.cfg = cfg
+	webhooks := make(map[config.WebhookConfig]bool)
+	for _, webhook := range cfg.Webhooks {
+		webhooks[webhook] = true
+		if _, ok := n.workers[webhook]; !ok {
+			worker := &webhookWorker{notifier: n, webhook: webhook, queue: make(chan *Notification, webhookQueueSize), stop: make(chan struct{})}
+			n.workers[webhook] = worker
+			go worker.run()
+		}
+	}
+	for webhook, worker := range n.workers {
+		if !webhooks[webhook] {
+			close(worker.stop)
+			delete(n.workers, webhook)
+		}
+	}
+}
+
+func (n *notifier) reload(cfg *config.Config) {
+	if cfg.Notifications == nil {
+		slog.Warn("Config reloaded: notifications are only removed after a restart")
+		return
+	}
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.setConfig(cfg.Notifications)
+}
+
+func (n *notifier) Start() {
+	subscription := n.events.Subscribe(webhookQueueSize)
+	go func() {
+		defer n.events.Unsubscribe(subscription)
+		for {
+			select {
+			case <-n.ctx.Done():
+				return
+			case event, ok := <-subscription:
+				if !ok {
+					return
+				}
+				notificationType := notificationType(event)
+				if len(notificationType) == 0 {
+					continue
+				}
+				n.notify(&Notification{
+					ID:       newNotificationID(),
+					Type:     notificationType,
+					Time:     event.Time,
+					Host:     n.host,
+					Instance: event.Instance,
+					Slot:     event.Slot,
+					Message:  event.Message,
+					Previous: event.Previous,
+					Current:  event.Current,
+				}, time.Now())
+			}
+		}
+	}()
+}
+
+func (n *notifier) Close() error {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+	n.cancel()
+	for _, condition := range n.conditions {
+		if condition.timer != nil {
+			condition.timer.Stop()
+		}
+	}
+	for webhook, worker := range n.workers {
+		close(worker.stop)
+		delete(n.workers, webhook)
+	}
+	return nil
+}
+
+func (n *notifier) minInterval(notificationType string) time.Duration {
+	if interval, ok := n.cfg.MinIntervals[notificationType]; ok {
+		return interval
+	}
+	if n.cfg.MinInterval == 0 {
+		return defaultNotificationMinInterval
+	}
+	return n.cfg.MinInterval
+}
+
+// Queues a notification on every webhook, unless it is a duplicate or held
+// back by the minimum interval.
+func (n *notifier) notify(notification *Notification, now time.Time) {
+	n.mutex.Lock()
+	defer n.mutex.Unlock()
+
+	key := notification.condition()
+	condition, ok := n.conditions[key]
+	if !ok {
+		condition = &notificationCondition{}
+		n.conditions[key] = condition
+	}
+
+	// Lost slots aren't paired with a recovery: a slot lost again under
+	// the same name was recreated in between.
+	if condition.delivered == notification.Type && notification.Type != "slot_lost" {
+		slog.Debug("Notification is a duplicate, not sending it", "type", notification.Type, "key", key)
+		condition.pending = nil
+		return
+	}
+
+	rateKey := notification.Instance + "/" + notification.Type + "/" + notification.Slot
+	wait := n.lastSent[rateKey].Add(n.minInterval(notification.Type)).Sub(now)
+	if wait > 0 {
+		slog.Info("Notification was sent recently, holding it back", "type", notification.Type, "key", key, "min_interval", n.minInterval(notification.Type))
+		condition.pending = notification
+		if condition.timer == nil {
+			condition.timer = time.AfterFunc(wait, func() { n.flush(key) })
+		}
+		return
+	}
+
+	condition.delivered = notification.Type
+	condition.pending = nil
+	n.lastSent[rateKey] = now
+	for _, worker := range n.workers {
+		select {
+		case worker.queue <- notification:
+		default:
+			slog.Warn("Webhook is too far behind, dropping notification", "webhook", worker.webhook.URL, "notification", notification.ID)
+		}
+	}
+}
+
+// Sends a condition's held back notification once the minimum interval is up.
+func (n *notifier) flush(key string) {
+	n.mutex.Lock()
+	condition := n.conditions[key]
+	pending := condition.pending
+	condition.pending = nil
+	condition.timer = nil
+	closed := n.ctx.Err() != nil
+	n.mutex.Unlock()
+
+	if pending != nil && !closed {
+		n.notify(pending, time.Now())
+	}
+}
+
+func newNotificationID() string {
+	id := make([]byte, 16)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
+
+// Delivers notifications to one webhook in order, retrying failures.
+type webhookWorker struct {
+	notifier *notifier
+	webhook  config.WebhookConfig
+	queue    chan *Notification
+	stop     chan struct{}
+}
+
+func (ww *webhookWorker) run() {
+	for {
+		select {
+		case <-ww.stop:
+			return
+		case notification := <-ww.queue:
+			ww.deliver(notification)
+		}
+	}
+}
+
+func (ww *webhookWorker) deliver(notification *Notification) {
+	var body []byte
+	var err error
+	if ww.webhook.Format == "slack" {
+		body, err = json.Marshal(map[string]string{"text": notification.slackText()})
+	} else {
+		body, err = json.Marshal(notification)
+	}
+	if err != nil {
+		slog.Error("Error encoding notification", "error", err)
+		return
+	}
+
+	ww.notifier.mutex.Lock()
+	cfg := ww.notifier.cfg
+	ww.notifier.mutex.Unlock()
+	maxRetries, backoff, timeout := cfg.MaxRetries, cfg.RetryBackoff, cfg.Timeout
+	if maxRetries == 0 {
+		maxRetries = defaultNotificationMaxRetries
+	}
+	if backoff == 0 {
+		backoff = defaultNotificationRetryBackoff
+	}
+	if timeout == 0 {
+		timeout = defaultNotificationTimeout
+	}
+
+	for attempt := 0; ; attempt++ {
+		retry, err := ww.post(body, timeout)
+		if err == nil {
+			return
+		}
+		if !retry || attempt >= maxRetries {
+			slog.Error("Error sending notification, giving up", "notification", notification.ID, "webhook", ww.webhook.URL, "error", err)
+			return
+		}
+		slog.Warn("Error sending notification, retrying", "notification", notification.ID, "webhook", ww.webhook.URL, "backoff", backoff, "error", err)
+
+		select {
+		case <-ww.stop:
+			return
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxNotificationRetryBackoff {
+			backoff = maxNotificationRetryBackoff
+		}
+	}
+}
+
+// Posts a payload, returning whether a failure is worth retrying.
+func (ww *webhookWorker) post(body []byte, timeout time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(ww.notifier.ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", ww.webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := ww.notifier.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	err = fmt.Errorf("err: webhook returned %d", resp.StatusCode)
+	return resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500, err
+}
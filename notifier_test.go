@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/film42/pgreba/config"
+)
+
+// Records the bodies posted to it, answering with the given status codes in
+// turn and 200 after that.
+type fakeWebhook struct {
+	mutex    sync.Mutex
+	statuses []int
+	bodies   chan []byte
+}
+
+func newFakeWebhook(statuses ...int) (*fakeWebhook, *httptest.Server) {
+	fw := &fakeWebhook{statuses: statuses, bodies: make(chan []byte, 10)}
+	return fw, httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		fw.bodies <- body
+
+		fw.mutex.Lock()
+		defer fw.mutex.Unlock()
+		if len(fw.statuses) > 0 {
+			w.WriteHeader(fw.statuses[0])
+			fw.statuses = fw.statuses[1:]
+		}
+	}))
+}
+
+func (fw *fakeWebhook) next(t *testing.T) []byte {
+	t.Helper()
+	select {
+	case body := <-fw.bodies:
+		return body
+	case <-time.After(5 * time.Second):
+		t.Fatal("Expected a webhook call")
+		return nil
+	}
+}
+
+func (fw *fakeWebhook) expectNoCall(t *testing.T) {
+	t.Helper()
+	select {
+	case body := <-fw.bodies:
+		t.Fatal("Unexpected webhook call:", string(body))
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestNotifierSendsJSONAndSlackWebhooks(t *testing.T) {
+	generic, genericServer := newFakeWebhook()
+	defer genericServer.Close()
+	slack, slackServer := newFakeWebhook()
+	defer slackServer.Close()
+
+	events := newEventBus()
+	n := newNotifier(&config.Config{Notifications: &config.NotificationsConfig{
+		Webhooks: []config.WebhookConfig{
+			{URL: genericServer.URL},
+			{URL: slackServer.URL, Format: "slack"},
+		},
+	}}, events)
+	n.Start()
+	defer n.Close()
+
+	previous := &NodeInfo{Role: "replica", Xlog: &XlogInfo{}}
+	current := &NodeInfo{Role: "primary", Xlog: &XlogInfo{}}
+	// Not a notification type, so only logged.
+	events.Publish(&Event{Type: EventLagChanged, Instance: "main", Message: "replica lag is low"})
+	events.Publish(&Event{Type: EventRoleChanged, Instance: "main", Message: "role changed from replica to primary", Previous: previous, Current: current})
+
+	notification := &Notification{}
+	if err := json.Unmarshal(generic.next(t), notification); err != nil {
+		t.Fatal(err)
+	}
+	if notification.Type != "promoted" || notification.Instance != "main" || len(notification.ID) == 0 ||
+		notification.Previous.Role != "replica" || notification.Current.Role != "primary" {
+		t.Fatal("Unexpected notification:", notification)
+	}
+
+	payload := map[string]string{}
+	if err := json.Unmarshal(slack.next(t), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(payload["text"], "(main): promoted: role changed from replica to primary") {
+		t.Fatal("Unexpected slack text:", payload["text"])
+	}
+}
+
+func TestNotifierRetriesFailedDeliveries(t *testing.T) {
+	webhook, server := newFakeWebhook(http.StatusServiceUnavailable, http.StatusTooManyRequests, http.StatusOK, http.StatusBadRequest)
+	defer server.Close()
+
+	n := newNotifier(&config.Config{Notifications: &config.NotificationsConfig{
+		Webhooks:     []config.WebhookConfig{{URL: server.URL}},
+		RetryBackoff: time.Millisecond,
+	}}, newEventBus())
+	defer n.Close()
+
+	n.notify(&Notification{ID: "1", Type: "replay_paused"}, time.Now())
+	first, second, third := webhook.next(t), webhook.next(t), webhook.next(t)
+	if string(first) != string(second) || string(second) != string(third) {
+		t.Fatal("Expected retries to send the same notification")
+	}
+
+	// Client errors aren't retried.
+	n.notify(&Notification{ID: "2", Type: "slot_lost", Slot: "a"}, time.Now())
+	webhook.next(t)
+	webhook.expectNoCall(t)
+}
+
+func TestNotifierDropsDuplicatesAndHoldsBackRepeats(t *testing.T) {
+	n := newNotifier(&config.Config{Notifications: &config.NotificationsConfig{MinInterval: time.Hour}}, newEventBus())
+	defer n.Close()
+	queue := make(chan *Notification, 10)
+	n.workers[config.WebhookConfig{URL: "http://example.com"}] = &webhookWorker{queue: queue, stop: make(chan struct{})}
+
+	now := time.Now()
+	notify := func(notificationType string, slot string, at time.Duration) {
+		n.notify(&Notification{ID: notificationType + slot, Type: notificationType, Instance: "main", Slot: slot}, now.Add(at))
+	}
+	notify("lag_exceeded", "", 0)
+	notify("lag_recovered", "", time.Second)
+	// Held back by the minimum interval, and then no longer relevant once
+	// the replica recovered again.
+	notify("lag_exceeded", "", 2*time.Second)
+	notify("lag_recovered", "", 3*time.Second)
+	notify("promoted", "", 4*time.Second)
+	notify("promoted", "", 2*time.Hour)
+	notify("slot_lost", "a", 5*time.Second)
+	notify("slot_lost", "b", 5*time.Second)
+	notify("slot_lost", "a", 6*time.Second)
+
+	sent := []string{}
+	for len(queue) > 0 {
+		sent = append(sent, (<-queue).ID)
+	}
+	expected := []string{"lag_exceeded", "lag_recovered", "promoted", "slot_losta", "slot_lostb"}
+	if strings.Join(sent, ",") != strings.Join(expected, ",") {
+		t.Fatal("Unexpected notifications:", sent)
+	}
+	if n.conditions["main/lag"].pending != nil || n.conditions["main/slot_lost/a"].pending == nil {
+		t.Fatal("Expected only the repeated lost slot to be held back")
+	}
+}
+
+func TestNotifierSendsHeldBackNotificationsOnceTheIntervalIsUp(t *testing.T) {
+	n := newNotifier(&config.Config{Notifications: &config.NotificationsConfig{
+		MinIntervals: map[string]time.Duration{"lag_exceeded": 20 * time.Millisecond},
+	}}, newEventBus())
+	defer n.Close()
+	queue := make(chan *Notification, 10)
+	n.workers[config.WebhookConfig{URL: "http://example.com"}] = &webhookWorker{queue: queue, stop: make(chan struct{})}
+
+	for _, notificationType := range []string{"lag_exceeded", "lag_recovered", "lag_exceeded"} {
+		n.notify(&Notification{Type: notificationType, Instance: "main"}, time.Now())
+	}
+	for _, expected := range []string{"lag_exceeded", "lag_recovered", "lag_exceeded"} {
+		select {
+		case notification := <-queue:
+			if notification.Type != expected {
+				t.Fatal("Expected", expected, "but found", notification.Type)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Expected a", expected, "notification")
+		}
+	}
+}
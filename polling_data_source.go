@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	ErrSnapshotNotReady = errors.New("err: no snapshot has been taken yet")
+	ErrSnapshotStale    = errors.New("err: snapshot is older than max staleness")
+)
+
+// The methods of the wrapped data source besides GetNodeInfo, which is always
+// polled.
+type polledMethod int
+
+const (
+	pollIsInRecovery polledMethod = iota
+	pollPgStatReplication
+	pollPgReplicationSlots
+	pollSyncState
+	pollTopology
+	pollPgStatSubscription
+	pollLocalNodeStatus
+)
+
+// The results (and errors) of polling each method of the wrapped data source.
+type dataSourceSnapshot struct {
+	takenAt time.Time
+	// The methods polled besides GetNodeInfo.
+	polled map[polledMethod]bool
+
+	nodeInfo    *NodeInfo
+	nodeInfoErr error
+
+	isInRecovery    bool
+	isInRecoveryErr error
+
+	pgStatReplication    []*PgStatReplication
+	pgStatReplicationErr error
+
+	pgReplicationSlots    []*PgReplicationSlot
+	pgReplicationSlotsErr error
+
+	syncState    string
+	syncStateErr error
+
+	topology    *Topology
+	topologyErr error
+
+	pgStatSubscription    []*PgStatSubscription
+	pgStatSubscriptionErr error
+
+	localNodeStatus    *NodeInfo
+	localNodeStatusErr error
+}
+
+// Polling data source which refreshes in the background so a slow postgres
+// never holds up a health-check. Reads are served from the last snapshot,
+// errors included, until it becomes too stale.
+//
+// Node info is always polled. Everything else, such as the sync state and
+// topology which each walk up the replication chain, is only polled once
+// something has asked for it. Until then, calls go straight to the wrapped
+// data source.
+type pollingDataSource struct {
+	dataSource   ReplicationDataSource
+	interval     time.Duration
+	maxStaleness time.Duration
+
+	mutex     sync.RWMutex
+	snapshot  *dataSourceSnapshot
+	requested map[polledMethod]bool
+
+	stop     chan struct{}
+	stopped  chan struct{}
+	stopOnce sync.Once
+}
+
+// A zero maxStaleness defaults to three poll intervals.
+func NewPollingDataSource(ds ReplicationDataSource, interval time.Duration, maxStaleness time.Duration) *pollingDataSource {
+	if maxStaleness <= 0 {
+		maxStaleness = 3 * interval
+	}
+
+	pds := &pollingDataSource{
+		dataSource:   ds,
+		interval:     interval,
+		maxStaleness: maxStaleness,
+		requested:    make(map[polledMethod]bool),
+		stop:         make(chan struct{}),
+		stopped:      make(chan struct{}),
+	}
+	go pds.run()
+	return pds
+}
+
+func (ds *pollingDataSource) run() {
+	defer close(ds.stopped)
+
+	ticker := time.NewTicker(ds.interval)
+	defer ticker.Stop()
+
+	for {
+		ds.poll()
+
+		select {
+		case <-ticker.C:
+		case <-ds.stop:
+			return
+		}
+	}
+}
+
+func (ds *pollingDataSource) poll() {
+	ds.mutex.RLock()
+	requested := make(map[polledMethod]bool)
+	for method := range ds.requested {
+		requested[method] = true
+	}
+	ds.mutex.RUnlock()
+
+	ctx := context.Background()
+	snapshot := &dataSourceSnapshot{takenAt: time.Now(), polled: requested}
+	snapshot.nodeInfo, snapshot.nodeInfoErr = ds.dataSource.GetNodeInfo(ctx)
+	if requested[pollIsInRecovery] {
+		snapshot.isInRecovery, snapshot.isInRecoveryErr = ds.dataSource.IsInRecovery(ctx)
+	}
+	if requested[pollPgStatReplication] {
+		snapshot.pgStatReplication, snapshot.pgStatReplicationErr = ds.dataSource.GetPgStatReplication(ctx)
+	}
+	if requested[pollPgReplicationSlots] {
+		snapshot.pgReplicationSlots, snapshot.pgReplicationSlotsErr = ds.dataSource.GetPgReplicationSlots(ctx)
+	}
+	if requested[pollSyncState] {
+		snapshot.syncState, snapshot.syncStateErr = ds.dataSource.GetSyncState(ctx)
+	}
+	if requested[pollTopology] {
+		snapshot.topology, snapshot.topologyErr = ds.dataSource.GetTopology(ctx)
+	}
+	if requested[pollPgStatSubscription] {
+		snapshot.pgStatSubscription, snapshot.pgStatSubscriptionErr = ds.dataSource.GetPgStatSubscription(ctx)
+	}
+	if requested[pollLocalNodeStatus] {
+		snapshot.localNodeStatus, snapshot.localNodeStatusErr = ds.dataSource.GetLocalNodeStatus(ctx)
+	}
+
+	if snapshot.nodeInfoErr != nil {
+		slog.Error("Error polling node info", "error", snapshot.nodeInfoErr)
+	}
+
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+	ds.snapshot = snapshot
+}
+
+// How long ago the current snapshot was taken. Zero if there is none yet.
+func (ds *pollingDataSource) SnapshotAge() time.Duration {
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+	if ds.snapshot == nil {
+		return 0
+	}
+	return time.Since(ds.snapshot.takenAt)
+}
+
+// Sets the X-PgReba-Snapshot-Age header (in seconds) so callers can see how
+// old the data behind a check is.
+func (ds *pollingDataSource) snapshotAgeMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		age := strconv.FormatFloat(ds.SnapshotAge().Seconds(), 'f', 3, 64)
+		w.Header().Set("X-PgReba-Snapshot-Age", age)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (ds *pollingDataSource) getSnapshot() (*dataSourceSnapshot, error) {
+	ds.mutex.RLock()
+	defer ds.mutex.RUnlock()
+
+	if ds.snapshot == nil {
+		return nil, ErrSnapshotNotReady
+	}
+	if time.Since(ds.snapshot.takenAt) > ds.maxStaleness {
+		return nil, ErrSnapshotStale
+	}
+	return ds.snapshot, nil
+}
+
+// Like getSnapshot, for a method which is only polled once requested. Marks
+// the method as requested, and returns a nil snapshot when the current one
+// doesn't hold it yet, so the caller asks the wrapped data source.
+func (ds *pollingDataSource) getRequestedSnapshot(method polledMethod) (*dataSourceSnapshot, error) {
+	ds.mutex.Lock()
+	ds.requested[method] = true
+	ds.mutex.Unlock()
+
+	snapshot, err := ds.getSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if !snapshot.polled[method] {
+		return nil, nil
+	}
+	return snapshot, nil
+}
+
+func (ds *pollingDataSource) GetNodeInfo(ctx context.Context) (*NodeInfo, error) {
+	snapshot, err := ds.getSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	return snapshot.nodeInfo, snapshot.nodeInfoErr
+}
+
+// The snapshot always holds the full node info, which costs nothing extra to
+// serve.
+func (ds *pollingDataSource) GetNodeStatus(ctx context.Context) (*NodeInfo, error) {
+	return ds.GetNodeInfo(ctx)
+}
+
+// The full node info answers as well, unless walking up the replication chain
+// failed, as when the primary is unreachable. Only then is the local status
+// asked for, and polled from then on.
+func (ds *pollingDataSource) GetLocalNodeStatus(ctx context.Context) (*NodeInfo, error) {
+	snapshot, err := ds.getSnapshot()
+	if err != nil {
+		return nil, err
+	}
+	if snapshot.nodeInfoErr == nil {
+		return snapshot.nodeInfo, nil
+	}
+
+	snapshot, err = ds.getRequestedSnapshot(pollLocalNodeStatus)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return ds.dataSource.GetLocalNodeStatus(ctx)
+	}
+	return snapshot.localNodeStatus, snapshot.localNodeStatusErr
+}
+
+func (ds *pollingDataSource) IsInRecovery(ctx context.Context) (bool, error) {
+	snapshot, err := ds.getRequestedSnapshot(pollIsInRecovery)
+	if err != nil {
+		return false, err
+	}
+	if snapshot == nil {
+		return ds.dataSource.IsInRecovery(ctx)
+	}
+	return snapshot.isInRecovery, snapshot.isInRecoveryErr
+}
+
+func (ds *pollingDataSource) GetPgStatReplication(ctx context.Context) ([]*PgStatReplication, error) {
+	snapshot, err := ds.getRequestedSnapshot(pollPgStatReplication)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return ds.dataSource.GetPgStatReplication(ctx)
+	}
+	return snapshot.pgStatReplication, snapshot.pgStatReplicationErr
+}
+
+func (ds *pollingDataSource) GetPgReplicationSlots(ctx context.Context) ([]*PgReplicationSlot, error) {
+	snapshot, err := ds.getRequestedSnapshot(pollPgReplicationSlots)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return ds.dataSource.GetPgReplicationSlots(ctx)
+	}
+	return snapshot.pgReplicationSlots, snapshot.pgReplicationSlotsErr
+}
+
+func (ds *pollingDataSource) GetSyncState(ctx context.Context) (string, error) {
+	snapshot, err := ds.getRequestedSnapshot(pollSyncState)
+	if err != nil {
+		return "", err
+	}
+	if snapshot == nil {
+		return ds.dataSource.GetSyncState(ctx)
+	}
+	return snapshot.syncState, snapshot.syncStateErr
+}
+
+func (ds *pollingDataSource) GetTopology(ctx context.Context) (*Topology, error) {
+	snapshot, err := ds.getRequestedSnapshot(pollTopology)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return ds.dataSource.GetTopology(ctx)
+	}
+	return snapshot.topology, snapshot.topologyErr
+}
+
+func (ds *pollingDataSource) GetPgStatSubscription(ctx context.Context) ([]*PgStatSubscription, error) {
+	snapshot, err := ds.getRequestedSnapshot(pollPgStatSubscription)
+	if err != nil {
+		return nil, err
+	}
+	if snapshot == nil {
+		return ds.dataSource.GetPgStatSubscription(ctx)
+	}
+	return snapshot.pgStatSubscription, snapshot.pgStatSubscriptionErr
+}
+
+// Stops polling, waiting for an in-flight poll to finish, before closing the
+// wrapped data source.
+func (ds *pollingDataSource) Close() error {
+	ds.stopOnce.Do(func() { close(ds.stop) })
+	<-ds.stopped
+	return ds.dataSource.Close()
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPollingDataSource_ServesSnapshotUntilStale(t *testing.T) {
+	fds := &fakeDataSource{byteLag: 1337}
+	pds := NewPollingDataSource(fds, time.Hour, time.Hour)
+	defer pds.Close()
+
+	// Wait for the first poll to land.
+	for i := 0; i < 100 && pds.SnapshotAge() == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+
+	nodeInfo, err := pds.GetNodeInfo(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nodeInfo.ByteLag != 1337 {
+		t.Fatal("Expected the polled node info but found byte lag:", nodeInfo.ByteLag)
+	}
+
+	// Age the snapshot past max staleness.
+	pds.mutex.Lock()
+	pds.snapshot.takenAt = time.Now().Add(-2 * time.Hour)
+	pds.mutex.Unlock()
+
+	if pds.SnapshotAge() < 2*time.Hour {
+		t.Fatal("Expected the snapshot age to reflect when it was taken")
+	}
+	if _, err := pds.GetNodeInfo(context.Background()); err != ErrSnapshotStale {
+		t.Fatal("Expected a stale snapshot err but found:", err)
+	}
+}
+
+func TestPollingDataSource_CachesErrors(t *testing.T) {
+	pds := &pollingDataSource{
+		dataSource:   &fakeDataSource{nodeInfoErr: errors.New("boom")},
+		maxStaleness: time.Hour,
+		requested:    make(map[polledMethod]bool),
+	}
+
+	if _, err := pds.GetNodeInfo(context.Background()); err != ErrSnapshotNotReady {
+		t.Fatal("Expected a not ready err before the first poll but found:", err)
+	}
+
+	pds.poll()
+	if _, err := pds.GetNodeInfo(context.Background()); err == nil || err.Error() != "boom" {
+		t.Fatal("Expected the polled err to be served but found:", err)
+	}
+	if _, err := pds.GetPgReplicationSlots(context.Background()); err != nil {
+		t.Fatal("Expected other results to be served but found:", err)
+	}
+}
+
+// Counts the topology walks.
+type topologyCountingDataSource struct {
+	*fakeDataSource
+	topologyCalls int
+}
+
+func (tcds *topologyCountingDataSource) GetTopology(ctx context.Context) (*Topology, error) {
+	tcds.topologyCalls++
+	return tcds.fakeDataSource.GetTopology(ctx)
+}
+
+func TestPollingDataSource_OnlyPollsWhatWasRequested(t *testing.T) {
+	tcds := &topologyCountingDataSource{fakeDataSource: &fakeDataSource{}}
+	pds := &pollingDataSource{
+		dataSource:   tcds,
+		maxStaleness: time.Hour,
+		requested:    make(map[polledMethod]bool),
+	}
+
+	pds.poll()
+	if tcds.topologyCalls != 0 {
+		t.Fatal("Expected the topology not to be polled before it was requested")
+	}
+
+	// The first request goes to the wrapped data source.
+	if _, err := pds.GetTopology(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tcds.topologyCalls != 1 {
+		t.Fatal("Expected the first request to walk the topology but found calls:", tcds.topologyCalls)
+	}
+
+	// Later polls include it, and requests are served from the snapshot.
+	pds.poll()
+	if _, err := pds.GetTopology(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if tcds.topologyCalls != 2 {
+		t.Fatal("Expected the topology to be polled once requested but found calls:", tcds.topologyCalls)
+	}
+}
+
+func TestPollingDataSource_LocalNodeStatusWithoutUpstream(t *testing.T) {
+	pds := &pollingDataSource{
+		dataSource:   &fakeDataSource{role: "replica", upstreamErr: errors.New("upstream down")},
+		maxStaleness: time.Hour,
+		requested:    make(map[polledMethod]bool),
+	}
+
+	pds.poll()
+	if _, err := pds.GetNodeInfo(context.Background()); err == nil {
+		t.Fatal("Expected the polled node info to fail without the upstream")
+	}
+	nodeInfo, err := pds.GetLocalNodeStatus(context.Background())
+	if err != nil || !nodeInfo.IsReplica() {
+		t.Fatal("Expected the local status to answer without the upstream but found:", nodeInfo, err)
+	}
+
+	pds.poll()
+	if !pds.snapshot.polled[pollLocalNodeStatus] || pds.snapshot.localNodeStatus == nil {
+		t.Fatal("Expected the local status to be polled once requested")
+	}
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/film42/pgreba/config"
+)
+
+const (
+	defaultProxyCheckInterval = 2 * time.Second
+	defaultProxyDrainTimeout  = 30 * time.Second
+
+	// How long connecting to a node may take before the client is dropped.
+	proxyDialTimeout = 5 * time.Second
+)
+
+// What the proxy checks a node with.
+type proxyNodeDataSource interface {
+	GetNodeStatus(ctx context.Context) (*NodeInfo, error)
+	GetLocalNodeStatus(ctx context.Context) (*NodeInfo, error)
+	Close() error
+}
+
+// A postgres node the proxy forwards clients to.
+type proxyNode struct {
+	address string
+	pgds    *pgDataSource
+	ds      proxyNodeDataSource
+
+	// Guarded by the proxy's mutex.
+	isPrimary        bool
+	isHealthyReplica bool
+	drainTimer       *time.Timer
+	conns            map[*proxyConn]bool
+}
+
+func (pn *proxyNode) servesReads() bool {
+	return pn.isPrimary || pn.isHealthyReplica
+}
+
+func (pn *proxyNode) readOnlyConns() int {
+	count := 0
+	for pc := range pn.conns {
+		if pc.readOnly {
+			count++
+		}
+	}
+	return count
+}
+
+// A client connection and, once dialed, its connection to a node.
+type proxyConn struct {
+	client   net.Conn
+	server   net.Conn
+	readOnly bool
+	closed   bool
+}
+
+func (pc *proxyConn) close() {
+	pc.closed = true
+	pc.client.Close()
+	if pc.server != nil {
+		pc.server.Close()
+	}
+}
+
+// Proxy mode: a built-in replica balancer for deployments without HAProxy.
+// Nodes are checked on an interval and clients are forwarded to the primary,
+// or to the healthy replica with the fewest connections.
+type tcpProxy struct {
+	mutex     sync.Mutex
+	cfg       *config.ProxyConfig
+	nodes     []*proxyNode
+	listeners map[net.Listener]bool
+	stop      chan struct{}
+	// Signals the check loop to pick up a reloaded check_interval.
+	reloaded chan struct{}
+}
+
+func newTCPProxy(cfg *config.Config) *tcpProxy {
+	proxy := &tcpProxy{
+		cfg:       cfg.Proxy,
+		listeners: make(map[net.Listener]bool),
+		stop:      make(chan struct{}),
+		reloaded:  make(chan struct{}, 1),
+	}
+	for _, address := range cfg.Proxy.Nodes {
+		pgds := &pgDataSource{cfg: proxyNodeConfig(cfg, address)}
+		proxy.nodes = append(proxy.nodes, &proxyNode{
+			address: address,
+			pgds:    pgds,
+			ds:      pgds,
+			conns:   make(map[*proxyConn]bool),
+		})
+	}
+	return proxy
+}
+
+// Nodes are checked with the top level connection settings.
+func proxyNodeConfig(cfg *config.Config, address string) *config.Config {
+	nodeCfg := *cfg
+	nodeCfg.Host, nodeCfg.Port, _ = net.SplitHostPort(address)
+	return &nodeCfg
+}
+
+// Opens the configured listeners. Clients of the replica address are marked
+// read only.
+func (p *tcpProxy) Listen() error {
+	addresses := []struct {
+		address  string
+		readOnly bool
+	}{
+		{p.cfg.PrimaryAddress, false},
+		{p.cfg.ReplicaAddress, true},
+	}
+	for _, listen := range addresses {
+		if len(listen.address) == 0 {
+			continue
+		}
+		listener, err := net.Listen("tcp", listen.address)
+		if err != nil {
+			p.Close()
+			return err
+		}
+		p.listeners[listener] = listen.readOnly
+		if listen.readOnly {
+			slog.Info("Proxying replica clients", "address", listener.Addr().String())
+		} else {
+			slog.Info("Proxying primary clients", "address", listener.Addr().String())
+		}
+	}
+	return nil
+}
+
+// Checks the nodes and forwards clients until Close is called.
+func (p *tcpProxy) Serve() error {
+	go p.checkLoop()
+
+	errs := make(chan error, len(p.listeners))
+	for listener, readOnly := range p.listeners {
+		go func(listener net.Listener, readOnly bool) {
+			errs <- p.accept(listener, readOnly)
+		}(listener, readOnly)
+	}
+	return <-errs
+}
+
+func (p *tcpProxy) Close() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	select {
+	case <-p.stop:
+		return nil
+	default:
+		close(p.stop)
+	}
+	for listener := range p.listeners {
+		listener.Close()
+	}
+	for _, node := range p.nodes {
+		for pc := range node.conns {
+			pc.close()
+		}
+		if node.drainTimer != nil {
+			node.drainTimer.Stop()
+		}
+		node.ds.Close()
+	}
+	return nil
+}
+
+// Swaps in reloaded thresholds, check interval and connection settings.
+// Listeners and nodes only change on restart.
+func (p *tcpProxy) reload(cfg *config.Config) {
+	if cfg.Proxy == nil {
+		slog.Warn("Config reloaded: proxy is only removed after a restart")
+		return
+	}
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.cfg = cfg.Proxy
+	for _, node := range p.nodes {
+		if node.pgds != nil {
+			node.pgds.Reload(proxyNodeConfig(cfg, node.address))
+		}
+	}
+	select {
+	case p.reloaded <- struct{}{}:
+	default:
+	}
+}
+
+func (p *tcpProxy) getConfig() *config.ProxyConfig {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	return p.cfg
+}
+
+func (p *tcpProxy) checkInterval() time.Duration {
+	interval := p.getConfig().CheckInterval
+	if interval == 0 {
+		interval = defaultProxyCheckInterval
+	}
+	return interval
+}
+
+func (p *tcpProxy) checkLoop() {
+	p.check()
+
+	interval := p.checkInterval()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.stop:
+			return
+		case <-p.reloaded:
+			if reloaded := p.checkInterval(); reloaded != interval {
+				interval = reloaded
+				ticker.Reset(interval)
+			}
+		case <-ticker.C:
+			p.check()
+		}
+	}
+}
+
+// Checks every node and updates where clients are sent. Clients of a node
+// which is no longer the primary are disconnected right away, since writes
+// would fail, while read only clients of a node which stopped serving reads
+// get the drain timeout to finish.
+func (p *tcpProxy) check() {
+	checkByteLag := p.getConfig().MaxByteLag > 0
+	nodeInfos := make([]*NodeInfo, len(p.nodes))
+	errs := make([]error, len(p.nodes))
+	wg := sync.WaitGroup{}
+	for i, node := range p.nodes {
+		wg.Add(1)
+		go func(i int, node *proxyNode) {
+			defer wg.Done()
+			nodeInfos[i], errs[i] = p.checkNode(node, checkByteLag)
+		}(i, node)
+	}
+	wg.Wait()
+
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	for i, node := range p.nodes {
+		nodeInfo, err := nodeInfos[i], errs[i]
+		if err != nil {
+			slog.Error("Proxy: error checking node", "node", node.address, "error", err)
+		}
+
+		wasPrimary, wasServingReads := node.isPrimary, node.servesReads()
+		node.isPrimary = err == nil && nodeInfo.IsPrimary()
+		node.isHealthyReplica = err == nil && nodeInfo.IsReplica() &&
+			!nodeInfo.Xlog.Paused && !p.lagExceeded(nodeInfo)
+
+		if node.isPrimary && !wasPrimary {
+			slog.Info("Proxy: node is the primary", "node", node.address)
+		}
+		if wasPrimary && !node.isPrimary {
+			slog.Warn("Proxy: node is no longer the primary, disconnecting its clients", "node", node.address)
+			for pc := range node.conns {
+				if !pc.readOnly {
+					pc.close()
+				}
+			}
+		}
+
+		if node.servesReads() && node.drainTimer != nil {
+			node.drainTimer.Stop()
+			node.drainTimer = nil
+		}
+		if node.isHealthyReplica && !wasServingReads {
+			slog.Info("Proxy: node is a healthy replica", "node", node.address)
+		}
+		if wasServingReads && !node.servesReads() {
+			slog.Warn("Proxy: node is unhealthy, draining its clients", "node", node.address)
+			p.drain(node)
+		}
+	}
+}
+
+// Replicas are judged on their own state, so reads keep flowing while the
+// primary is down. Only max_byte_lag needs the primary's WAL location. When
+// it can't be had, the byte lag is unknown and doesn't count against the
+// replica.
+func (p *tcpProxy) checkNode(node *proxyNode, checkByteLag bool) (*NodeInfo, error) {
+	if checkByteLag {
+		nodeInfo, err := node.ds.GetNodeStatus(context.Background())
+		if err == nil {
+			return nodeInfo, nil
+		}
+		slog.Warn("Proxy: error checking node through its upstream, byte lag is unknown", "node", node.address, "error", err)
+	}
+	return node.ds.GetLocalNodeStatus(context.Background())
+}
+
+func (p *tcpProxy) lagExceeded(nodeInfo *NodeInfo) bool {
+	if p.cfg.MaxByteLag > 0 && nodeInfo.ByteLag > p.cfg.MaxByteLag {
+		return true
+	}
+	if p.cfg.MaxLagSeconds > 0 && nodeInfo.LagSeconds.Valid && nodeInfo.LagSeconds.Float64 > p.cfg.MaxLagSeconds {
+		return true
+	}
+	return false
+}
+
+// Disconnects the read only clients of a node once the drain timeout is up.
+// Must be called with the mutex held.
+func (p *tcpProxy) drain(node *proxyNode) {
+	timeout := p.cfg.DrainTimeout
+	if timeout == 0 {
+		timeout = defaultProxyDrainTimeout
+	}
+	node.drainTimer = time.AfterFunc(timeout, func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		for pc := range node.conns {
+			if pc.readOnly {
+				pc.close()
+			}
+		}
+		node.drainTimer = nil
+	})
+}
+
+// Picks the node for a client and registers the connection with it, or
+// returns nil when there is nowhere to send it. Writes are refused when more
+// than one node claims to be the primary.
+func (p *tcpProxy) assign(pc *proxyConn) *proxyNode {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	var primary *proxyNode
+	primaries := 0
+	for _, node := range p.nodes {
+		if node.isPrimary {
+			primary = node
+			primaries++
+		}
+	}
+	if primaries > 1 {
+		primary = nil
+	}
+
+	node := primary
+	if pc.readOnly {
+		var leastConns *proxyNode
+		for _, candidate := range p.nodes {
+			if !candidate.isHealthyReplica {
+				continue
+			}
+			if leastConns == nil || candidate.readOnlyConns() < leastConns.readOnlyConns() {
+				leastConns = candidate
+			}
+		}
+		if leastConns != nil {
+			node = leastConns
+		}
+	}
+
+	if node != nil {
+		node.conns[pc] = true
+	}
+	return node
+}
+
+func (p *tcpProxy) release(node *proxyNode, pc *proxyConn) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	pc.close()
+	delete(node.conns, pc)
+}
+
+func (p *tcpProxy) accept(listener net.Listener, readOnly bool) error {
+	for {
+		client, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		go p.forward(&proxyConn{client: client, readOnly: readOnly})
+	}
+}
+
+func (p *tcpProxy) forward(pc *proxyConn) {
+	node := p.assign(pc)
+	if node == nil {
+		slog.Warn("Proxy: no node available", "client", pc.client.RemoteAddr().String())
+		pc.client.Close()
+		return
+	}
+	defer p.release(node, pc)
+
+	server, err := net.DialTimeout("tcp", node.address, proxyDialTimeout)
+	if err != nil {
+		slog.Error("Proxy: error connecting to node", "node", node.address, "error", err)
+		return
+	}
+
+	// The node may have been drained while dialing.
+	p.mutex.Lock()
+	pc.server = server
+	closed := pc.closed
+	p.mutex.Unlock()
+	if closed {
+		server.Close()
+		return
+	}
+
+	// Once either side hangs up, release closes both.
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(server, pc.client)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(pc.client, server)
+		done <- struct{}{}
+	}()
+	<-done
+}
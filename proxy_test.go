@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/film42/pgreba/config"
+)
+
+// Stands in for postgres: greets each client with its name and holds the
+// connection open until the client hangs up.
+func startFakeNode(t *testing.T, name string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.Write([]byte(name + "\n"))
+				conn.Read(make([]byte, 1))
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func newTestProxy(t *testing.T, cfg *config.ProxyConfig, roles map[string]*fakeDataSource) (*tcpProxy, map[string]*proxyNode) {
+	cfg.PrimaryAddress = "127.0.0.1:0"
+	cfg.ReplicaAddress = "127.0.0.1:0"
+	proxy := &tcpProxy{cfg: cfg, listeners: make(map[net.Listener]bool), stop: make(chan struct{}), reloaded: make(chan struct{}, 1)}
+
+	nodes := make(map[string]*proxyNode)
+	for name, fds := range roles {
+		node := &proxyNode{address: startFakeNode(t, name), ds: fds, conns: make(map[*proxyConn]bool)}
+		proxy.nodes = append(proxy.nodes, node)
+		nodes[name] = node
+	}
+
+	if err := proxy.Listen(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { proxy.Close() })
+	for listener, readOnly := range proxy.listeners {
+		go proxy.accept(listener, readOnly)
+	}
+	proxy.check()
+	return proxy, nodes
+}
+
+func (p *tcpProxy) address(readOnly bool) string {
+	for listener, listenerReadOnly := range p.listeners {
+		if listenerReadOnly == readOnly {
+			return listener.Addr().String()
+		}
+	}
+	return ""
+}
+
+// Connects through the proxy and returns the connection and the name of the
+// node it reached, or "" when the proxy hung up.
+func dialProxy(t *testing.T, address string) (net.Conn, string) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	name, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return conn, ""
+	}
+	return conn, name[:len(name)-1]
+}
+
+func TestProxyRoutesByRoleWithLeastConnections(t *testing.T) {
+	proxy, _ := newTestProxy(t, &config.ProxyConfig{MaxByteLag: 100}, map[string]*fakeDataSource{
+		"primary":  {role: "primary"},
+		"replica1": {role: "replica"},
+		"replica2": {role: "replica"},
+		"lagging":  {role: "replica", byteLag: 1000},
+	})
+
+	if _, name := dialProxy(t, proxy.address(false)); name != "primary" {
+		t.Fatal("Expected writes to go to the primary but found:", name)
+	}
+
+	reached := make(map[string]int)
+	for i := 0; i < 4; i++ {
+		_, name := dialProxy(t, proxy.address(true))
+		reached[name]++
+	}
+	if reached["replica1"] != 2 || reached["replica2"] != 2 {
+		t.Fatal("Expected reads to be spread over the healthy replicas:", reached)
+	}
+}
+
+func TestProxyFallsBackToThePrimaryForReads(t *testing.T) {
+	proxy, _ := newTestProxy(t, &config.ProxyConfig{}, map[string]*fakeDataSource{
+		"primary": {role: "primary"},
+		"replica": {role: "replica", nodeInfoErr: ErrSnapshotNotReady},
+	})
+
+	if _, name := dialProxy(t, proxy.address(true)); name != "primary" {
+		t.Fatal("Expected reads to fall back to the primary but found:", name)
+	}
+}
+
+func TestProxyKeepsReplicasDuringAPrimaryOutage(t *testing.T) {
+	for _, cfg := range []*config.ProxyConfig{{}, {MaxByteLag: 100}} {
+		proxy, _ := newTestProxy(t, cfg, map[string]*fakeDataSource{
+			"primary": {role: "primary", nodeInfoErr: ErrSnapshotNotReady},
+			"replica": {role: "replica", byteLag: 1000, upstreamErr: ErrSnapshotNotReady},
+		})
+
+		if _, name := dialProxy(t, proxy.address(true)); name != "replica" {
+			t.Fatalf("Expected reads to reach the replica with max_byte_lag %d but found: %q", cfg.MaxByteLag, name)
+		}
+	}
+}
+
+func TestProxyRefusesWritesWithTwoPrimaries(t *testing.T) {
+	proxy, _ := newTestProxy(t, &config.ProxyConfig{}, map[string]*fakeDataSource{
+		"primary1": {role: "primary"},
+		"primary2": {role: "primary"},
+	})
+
+	if _, name := dialProxy(t, proxy.address(false)); name != "" {
+		t.Fatal("Expected writes to be refused but reached:", name)
+	}
+}
+
+func TestProxyDrainsUnhealthyReplicas(t *testing.T) {
+	proxy, nodes := newTestProxy(t, &config.ProxyConfig{DrainTimeout: 50 * time.Millisecond}, map[string]*fakeDataSource{
+		"primary": {role: "primary"},
+		"replica": {role: "replica"},
+	})
+
+	conn, name := dialProxy(t, proxy.address(true))
+	if name != "replica" {
+		t.Fatal("Expected to reach the replica but found:", name)
+	}
+
+	nodes["replica"].ds.(*fakeDataSource).byteLag = 1000
+	proxy.cfg.MaxByteLag = 100
+	proxy.check()
+
+	// New clients go elsewhere right away.
+	if _, name := dialProxy(t, proxy.address(true)); name != "primary" {
+		t.Fatal("Expected new reads to avoid the drained replica but found:", name)
+	}
+
+	// Existing clients are disconnected once the drain timeout is up.
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Fatal("Expected the drained client to be disconnected")
+	}
+}
+
+func TestProxyReloadsCheckInterval(t *testing.T) {
+	proxy, nodes := newTestProxy(t, &config.ProxyConfig{CheckInterval: time.Hour}, map[string]*fakeDataSource{
+		"primary": {role: "primary"},
+	})
+	go proxy.checkLoop()
+
+	fds := nodes["primary"].ds.(*fakeDataSource)
+	before := atomic.LoadInt64(&fds.calls)
+	proxy.reload(&config.Config{Proxy: &config.ProxyConfig{CheckInterval: 10 * time.Millisecond}})
+
+	deadline := time.Now().Add(2 * time.Second)
+	for atomic.LoadInt64(&fds.calls) < before+3 {
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the reloaded check interval to take effect")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -2,6 +2,8 @@ package conf
 
 import (
 	"errors"
+	"strings"
+
 	"github.com/jmoiron/sqlx"
 	"gopkg.in/ini.v1"
 )
@@ -11,11 +13,34 @@ var (
 	ErrPrimaryConninfoMissing = errors.New("err: primary_conninfo missing in conf")
 )
 
+// Signal files which put a PG12+ server into recovery. For older servers these
+// are derived from standby_mode in recovery.conf.
+const (
+	SignalFileNone     = ""
+	SignalFileStandby  = "standby.signal"
+	SignalFileRecovery = "recovery.signal"
+)
+
+// PG12 moved recovery.conf settings into the main config and replaced the
+// file itself with signal files.
+const pg12VersionNum = 120000
+
 type Conf struct {
-	file *ini.File
+	settings   map[string]string
+	signalFile string
 }
 
 func FetchAndParseRecoveryConfFromDB(db *sqlx.DB) (*Conf, error) {
+	var versionNum int
+	err := db.Get(&versionNum, "select pg_catalog.current_setting('server_version_num')::int")
+	if err != nil {
+		return nil, err
+	}
+
+	if versionNum >= pg12VersionNum {
+		return fetchRecoverySettingsFromDB(db)
+	}
+
 	// Attempt to load recovery.conf from disk.
 	sql := `select * from pg_read_file('recovery.conf')`
 	rows, err := db.Queryx(sql)
@@ -41,18 +66,120 @@ func FetchAndParseRecoveryConfFromDB(db *sqlx.DB) (*Conf, error) {
 	return Parse([]byte(recoveryConf))
 }
 
+// On PG12+ the settings come from postgresql.conf/postgresql.auto.conf, so we
+// read the effective values and look for the signal files in the data dir.
+// Settings left at their defaults are skipped, as they would be missing from
+// a recovery.conf.
+func fetchRecoverySettingsFromDB(db *sqlx.DB) (*Conf, error) {
+	sql := `
+SELECT name, pg_catalog.current_setting(name) AS setting
+FROM pg_catalog.pg_settings
+WHERE (name IN ('primary_conninfo', 'primary_slot_name', 'restore_command', 'recovery_min_apply_delay')
+       OR name LIKE 'recovery_target%')
+  AND source <> 'default'
+`
+	rows := []struct {
+		Name    string `db:"name"`
+		Setting string `db:"setting"`
+	}{}
+	err := db.Select(&rows, sql)
+	if err != nil {
+		return nil, err
+	}
+
+	settings := make(map[string]string)
+	for _, row := range rows {
+		settings[row.Name] = row.Setting
+	}
+
+	signalFiles := struct {
+		Standby  bool `db:"standby"`
+		Recovery bool `db:"recovery"`
+	}{}
+	err = db.Get(&signalFiles, `
+SELECT (pg_catalog.pg_stat_file('standby.signal', true)).modification IS NOT NULL AS standby,
+       (pg_catalog.pg_stat_file('recovery.signal', true)).modification IS NOT NULL AS recovery
+`)
+	if err != nil {
+		return nil, err
+	}
+
+	// Postgres enters standby mode when both files are present.
+	signalFile := SignalFileNone
+	if signalFiles.Standby {
+		signalFile = SignalFileStandby
+	} else if signalFiles.Recovery {
+		signalFile = SignalFileRecovery
+	}
+
+	return &Conf{settings: settings, signalFile: signalFile}, nil
+}
+
+// Parses a pre-PG12 recovery.conf.
 func Parse(conf []byte) (*Conf, error) {
 	file, err := ini.Load(conf)
 	if err != nil {
 		return nil, err
 	}
-	return &Conf{file}, nil
+
+	settings := make(map[string]string)
+	for _, key := range file.Section("").Keys() {
+		settings[key.Name()] = key.String()
+	}
+
+	// A recovery.conf without standby_mode performs targeted recovery, which
+	// is what recovery.signal means on PG12+.
+	signalFile := SignalFileRecovery
+	if parseBool(settings["standby_mode"]) {
+		signalFile = SignalFileStandby
+	}
+
+	return &Conf{settings: settings, signalFile: signalFile}, nil
+}
+
+// Whether a setting is true the way postgres reads booleans: on, true, yes,
+// 1 or a unique prefix of true or yes, in any case.
+func parseBool(value string) bool {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if len(value) == 0 {
+		return false
+	}
+	return value == "on" || value == "1" ||
+		strings.HasPrefix("true", value) || strings.HasPrefix("yes", value)
 }
 
 func (c *Conf) GetPrimaryConninfo() (string, error) {
-	conninfo := c.file.Section("").Key("primary_conninfo").String()
+	conninfo := c.settings["primary_conninfo"]
 	if len(conninfo) == 0 {
 		return "", ErrPrimaryConninfoMissing
 	}
 	return conninfo, nil
 }
+
+func (c *Conf) GetPrimarySlotName() string {
+	return c.settings["primary_slot_name"]
+}
+
+func (c *Conf) GetRestoreCommand() string {
+	return c.settings["restore_command"]
+}
+
+func (c *Conf) GetRecoveryMinApplyDelay() string {
+	return c.settings["recovery_min_apply_delay"]
+}
+
+// All recovery_target* settings that have a value.
+func (c *Conf) GetRecoveryTargets() map[string]string {
+	targets := make(map[string]string)
+	for name, setting := range c.settings {
+		if strings.HasPrefix(name, "recovery_target") && len(setting) > 0 {
+			targets[name] = setting
+		}
+	}
+	return targets
+}
+
+// Which signal file put the server into recovery, if any.
+func (c *Conf) SignalFile() string {
+	return c.signalFile
+}
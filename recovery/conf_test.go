@@ -1,11 +1,132 @@
 package conf
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"strings"
 	"testing"
+
+	"github.com/jmoiron/sqlx"
 )
 
+// A pg_settings row.
+type fakeSetting struct {
+	name    string
+	setting string
+	source  string
+}
+
+// Answers the queries FetchAndParseRecoveryConfFromDB makes of a PG12+
+// server, so the settings path can be tested without postgres.
+type fakeDriver struct {
+	settings []fakeSetting
+	standby  bool
+}
+
+func (d *fakeDriver) Open(name string) (driver.Conn, error) {
+	return &fakeConn{driver: d}, nil
+}
+
+type fakeConn struct {
+	driver *fakeDriver
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{driver: c.driver, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) { return nil, errors.New("err: not supported") }
+
+type fakeStmt struct {
+	driver *fakeDriver
+	query  string
+}
+
+func (s *fakeStmt) Close() error { return nil }
+
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, errors.New("err: not supported")
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	switch {
+	case strings.Contains(s.query, "server_version_num"):
+		return &fakeRows{columns: []string{"current_setting"}, values: [][]driver.Value{{int64(150000)}}}, nil
+	case strings.Contains(s.query, "pg_settings"):
+		rows := &fakeRows{columns: []string{"name", "setting"}}
+		for _, setting := range s.driver.settings {
+			if setting.source == "default" && strings.Contains(s.query, "source <> 'default'") {
+				continue
+			}
+			rows.values = append(rows.values, []driver.Value{setting.name, setting.setting})
+		}
+		return rows, nil
+	case strings.Contains(s.query, "pg_stat_file"):
+		return &fakeRows{columns: []string{"standby", "recovery"}, values: [][]driver.Value{{s.driver.standby, false}}}, nil
+	}
+	return nil, errors.New("err: unexpected query: " + s.query)
+}
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+
+func (r *fakeRows) Close() error { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
+
 func TestFetchAndParseRecoveryConfFromDB(t *testing.T) {
-	// TODO: Impl
+	sql.Register("fakepg", &fakeDriver{
+		standby: true,
+		settings: []fakeSetting{
+			{"primary_conninfo", "host=upstream-db1 port=5432", "configuration file"},
+			{"primary_slot_name", "", "default"},
+			{"recovery_min_apply_delay", "0", "default"},
+			{"recovery_target_action", "pause", "default"},
+			{"recovery_target_inclusive", "on", "default"},
+			{"recovery_target_timeline", "latest", "default"},
+			{"recovery_target_time", "2020-11-12 10:55:55", "configuration file"},
+		},
+	})
+	db, err := sqlx.Open("fakepg", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	c, err := FetchAndParseRecoveryConfFromDB(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conninfo, _ := c.GetPrimaryConninfo(); conninfo != "host=upstream-db1 port=5432" {
+		t.Fatal("Unexpected primary_conninfo:", conninfo)
+	}
+	if c.GetRecoveryMinApplyDelay() != "" {
+		t.Fatal("Expected the default recovery_min_apply_delay to be left out but found:", c.GetRecoveryMinApplyDelay())
+	}
+	targets := c.GetRecoveryTargets()
+	if len(targets) != 1 || targets["recovery_target_time"] != "2020-11-12 10:55:55" {
+		t.Fatal("Expected only the configured recovery target but found:", targets)
+	}
+	if c.SignalFile() != SignalFileStandby {
+		t.Fatal("Expected standby.signal but found:", c.SignalFile())
+	}
 }
 
 func TestCanLoadRecoveryConf(t *testing.T) {
@@ -49,3 +170,70 @@ standby_mode      = 'on'
 		t.Fatal("expected a primary conninfo missing err but found this err instead:", err)
 	}
 }
+
+func TestRecoveryConfAccessors(t *testing.T) {
+	conf := `
+standby_mode      = 'on'
+primary_conninfo  = 'host=upstream-db1 port=5432 user=replicator'
+primary_slot_name = 'some-standby-db1'
+restore_command = 'cp /mnt/archive/%f %p'
+recovery_target_timeline = 'latest'
+recovery_min_apply_delay = '5min'
+`
+	c, err := Parse([]byte(conf))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if c.GetPrimarySlotName() != "some-standby-db1" {
+		t.Fatal("Unexpected primary_slot_name:", c.GetPrimarySlotName())
+	}
+	if c.GetRestoreCommand() != "cp /mnt/archive/%f %p" {
+		t.Fatal("Unexpected restore_command:", c.GetRestoreCommand())
+	}
+	if c.GetRecoveryMinApplyDelay() != "5min" {
+		t.Fatal("Unexpected recovery_min_apply_delay:", c.GetRecoveryMinApplyDelay())
+	}
+	targets := c.GetRecoveryTargets()
+	if len(targets) != 1 || targets["recovery_target_timeline"] != "latest" {
+		t.Fatal("Unexpected recovery targets:", targets)
+	}
+	if c.SignalFile() != SignalFileStandby {
+		t.Fatal("Expected standby_mode to map to standby.signal but found:", c.SignalFile())
+	}
+}
+
+func TestRecoveryConfWithoutStandbyModeIsTargetedRecovery(t *testing.T) {
+	c, err := Parse([]byte(`recovery_target_time = '2020-11-12 10:55:55'`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.SignalFile() != SignalFileRecovery {
+		t.Fatal("Expected recovery.signal but found:", c.SignalFile())
+	}
+}
+
+func TestStandbyModeIsAPostgresBoolean(t *testing.T) {
+	cases := map[string]string{
+		"on":    SignalFileStandby,
+		"true":  SignalFileStandby,
+		"yes":   SignalFileStandby,
+		"1":     SignalFileStandby,
+		"TRUE":  SignalFileStandby,
+		"t":     SignalFileStandby,
+		"off":   SignalFileRecovery,
+		"false": SignalFileRecovery,
+		"no":    SignalFileRecovery,
+		"0":     SignalFileRecovery,
+		"o":     SignalFileRecovery,
+	}
+	for value, expected := range cases {
+		c, err := Parse([]byte("standby_mode = '" + value + "'"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if c.SignalFile() != expected {
+			t.Fatalf("Expected standby_mode %q to map to %s but found %s", value, expected, c.SignalFile())
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/film42/pgreba/config"
+)
+
+// Settings which shape the http servers and data source stacks built at
+// startup, so changes only take effect after a restart.
+var restartRequiredKeys = map[string]bool{
+	"listen_address":      true,
+	"tls_cert_file":       true,
+	"tls_key_file":        true,
+	"tls_client_ca_file":  true,
+	"poll_interval":       true,
+	"max_staleness":       true,
+	"agent_check_address": true,
+	"watch_interval":      true,
+	"log_format":          true,
+}
+
+// Re-reads the config on SIGHUP and swaps it into each running instance, the
+// proxy, the cluster view, the notifier, the authenticator and the log level. Adding or
+// removing instances takes a restart.
+type configReloader struct {
+	path  string
+	flags *config.Flags
+	// The config in place, to compare the reloaded one with.
+	cfg       *config.Config
+	instances []*monitoredInstance
+	proxy     *tcpProxy
+	cluster   *clusterView
+	notifier  *notifier
+	auth      *authenticator
+
+	mutex sync.Mutex
+}
+
+// Loads and validates the config the same way as at startup. On error the
+// current config stays in place.
+func (cr *configReloader) reload() error {
+	cr.mutex.Lock()
+	defer cr.mutex.Unlock()
+
+	cfg, err := config.Load(cr.path, os.Environ(), cr.flags)
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		return err
+	}
+	logLevel.Set(parseLogLevel(cfg.LogLevel))
+
+	running := make(map[string]*monitoredInstance)
+	for _, mi := range cr.instances {
+		running[mi.name] = mi
+	}
+
+	changed := false
+	for _, instance := range cfg.Instances() {
+		mi, ok := running[instance.Name]
+		if !ok {
+			slog.Warn("Config reloaded: instances are only added after a restart", "instance", instance.Name)
+			changed = true
+			continue
+		}
+		delete(running, instance.Name)
+		if mi.reload(instance.Config) {
+			changed = true
+		}
+	}
+	for name := range running {
+		slog.Warn("Config reloaded: instances are only removed after a restart", "instance", name)
+		changed = true
+	}
+
+	if cr.cfg != nil {
+		for _, change := range config.DiffSections(cr.cfg, cfg) {
+			slog.Info("Config reloaded", "change", change.String())
+			if strings.HasPrefix(change.Key, "tracing.") {
+				slog.Warn("Config reloaded: the change only takes effect after a restart", "key", change.Key)
+			}
+			changed = true
+		}
+	}
+	cr.cfg = cfg
+
+	if cr.proxy != nil {
+		cr.proxy.reload(cfg)
+	}
+	if cr.cluster != nil {
+		cr.cluster.reload(cfg)
+	}
+	if cr.notifier != nil {
+		cr.notifier.reload(cfg)
+	}
+	if cr.auth != nil {
+		cr.auth.reload(cfg)
+	}
+
+	if !changed {
+		slog.Info("Config reloaded, nothing changed")
+	}
+	return nil
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/film42/pgreba/config"
+)
+
+func TestReloadKeepsConfigWhenInvalid(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgreba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yml")
+	writeConfig := func(contents string) {
+		if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeConfig("host: localhost\ndatabase: postgres\nuser: postgres\npassword: secret\n")
+	cfg, err := config.Load(path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := newMonitoredInstance(&config.Instance{Config: cfg}, newEventBus())
+	pgds, hcs := mi.pgds, mi.hcs
+	reloader := &configReloader{path: path, instances: []*monitoredInstance{mi}}
+
+	writeConfig("host: localhost\ndatabase: postgres\nuser: postgres\npassword: secret\nmax_hop: 0\n")
+	if err := reloader.reload(); err == nil {
+		t.Fatal("Expected the invalid config to be rejected")
+	}
+	if pgds.getConfig() != cfg || hcs.getConfig() != cfg {
+		t.Fatal("Expected the current config to be kept")
+	}
+
+	writeConfig("host: localhost\ndatabase: postgres\nuser: postgres\npassword: secret\nmax_allowable_lag_seconds: 30\n")
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	if pgds.getConfig().MaxAllowableLagSeconds != 30 || hcs.getConfig().MaxAllowableLagSeconds != 30 {
+		t.Fatal("Expected the new config to be swapped in")
+	}
+}
+
+func TestReloadLogsSectionChanges(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pgreba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.yml")
+	base := "host: localhost\ndatabase: postgres\nuser: postgres\nauth:\n  tokens:\n    - name: ops\n      token: "
+	if err := ioutil.WriteFile(path, []byte(base+"0123456789abcdef\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := config.Load(path, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mi := newMonitoredInstance(&config.Instance{Config: cfg}, newEventBus())
+	auth := newAuthenticator(cfg)
+	reloader := &configReloader{path: path, cfg: cfg, instances: []*monitoredInstance{mi}, auth: auth}
+
+	var logged bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logged, nil)))
+
+	if err := ioutil.WriteFile(path, []byte(base+"fedcba9876543210\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloader.reload(); err != nil {
+		t.Fatal(err)
+	}
+	output := logged.String()
+	if !strings.Contains(output, "auth.tokens[0].token: (changed)") || strings.Contains(output, "nothing changed") {
+		t.Fatal("Expected the auth change to be logged but found:", output)
+	}
+	if strings.Contains(output, "fedcba9876543210") {
+		t.Fatal("Expected the token to be masked but found:", output)
+	}
+	if auth.getConfig().Tokens[0].Token != "fedcba9876543210" {
+		t.Fatal("Expected the new token to be swapped in")
+	}
+}
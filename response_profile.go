@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/film42/pgreba/config"
+	"gopkg.in/volatiletech/null.v6"
+)
+
+// How much a health check says about the node, from least to most detail.
+type responseProfile int
+
+const (
+	// Only the status code.
+	responseStatus responseProfile = iota
+	// A NodeSummary.
+	responseSummary
+	// The full NodeInfo, including each standby's user and address.
+	responseFull
+)
+
+// An empty name is the default, full.
+func parseResponseProfile(name string) (responseProfile, error) {
+	if len(name) == 0 {
+		return responseFull, nil
+	}
+	for i, profile := range config.ResponseProfiles {
+		if name == profile {
+			return responseProfile(i), nil
+		}
+	}
+	return responseStatus, fmt.Errorf("err: verbose must be status, summary, full or a boolean, found %q", name)
+}
+
+// The configured response_profile unless the request asks for another with
+// ?verbose=, which takes a profile or a boolean for full or status. Callers
+// the auth middleware caps never get more than their limit.
+func (hc *HealthCheckWebService) responseProfile(r *http.Request) (responseProfile, error) {
+	profile, err := parseResponseProfile(hc.getConfig().ResponseProfile)
+	if err != nil {
+		return responseStatus, err
+	}
+
+	if values, ok := r.URL.Query()["verbose"]; ok {
+		verbose := values[0]
+		if len(verbose) == 0 {
+			profile = responseFull
+		} else if on, err := strconv.ParseBool(verbose); err == nil {
+			profile = responseStatus
+			if on {
+				profile = responseFull
+			}
+		} else if profile, err = parseResponseProfile(verbose); err != nil {
+			return responseStatus, err
+		}
+	}
+
+	if limit := requestProfileLimit(r); len(limit) > 0 {
+		max, err := parseResponseProfile(limit)
+		if err != nil {
+			return responseStatus, err
+		}
+		if profile > max {
+			profile = max
+		}
+	}
+	return profile, nil
+}
+
+// Only the full profile needs the replication summary, so the others skip
+// its query.
+func (hc *HealthCheckWebService) getNodeInfo(ctx context.Context, profile responseProfile) (*NodeInfo, error) {
+	if profile == responseFull {
+		return hc.healthChecker.dataSource.GetNodeInfo(ctx)
+	}
+	return hc.healthChecker.dataSource.GetNodeStatus(ctx)
+}
+
+// What the summary profile tells about a node. The fields match NodeInfo, so
+// readers of the full document can read this too.
+type NodeSummary struct {
+	Role       string       `json:"role"`
+	Timeline   null.Int64   `json:"timeline"`
+	ByteLag    int64        `json:"byte_lag"`
+	LagSeconds null.Float64 `json:"lag_seconds"`
+}
+
+func newNodeSummary(nodeInfo *NodeInfo) *NodeSummary {
+	return &NodeSummary{
+		Role:       nodeInfo.Role,
+		Timeline:   nodeInfo.Timeline,
+		ByteLag:    nodeInfo.ByteLag,
+		LagSeconds: nodeInfo.LagSeconds,
+	}
+}
+
+func writeNodeInfo(w http.ResponseWriter, profile responseProfile, nodeInfo *NodeInfo, healthy bool) {
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	switch profile {
+	case responseStatus:
+	case responseSummary:
+		json.NewEncoder(w).Encode(newNodeSummary(nodeInfo))
+	default:
+		json.NewEncoder(w).Encode(nodeInfo)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/film42/pgreba/config"
+)
+
+var (
+	ErrTLSCertAndKeyRequired = errors.New("err: tls_cert_file and tls_key_file must be set together")
+	ErrTLSClientCANeedsTLS   = errors.New("err: tls_client_ca_file requires tls_cert_file and tls_key_file")
+	ErrTLSClientCAInvalid    = errors.New("err: no certificates found in tls_client_ca_file")
+)
+
+func newHTTPServer(cfg *config.Config, handler http.Handler) (*http.Server, error) {
+	srv := &http.Server{
+		Addr:    cfg.ListenAddress,
+		Handler: handler,
+	}
+
+	if (len(cfg.TLSCertFile) == 0) != (len(cfg.TLSKeyFile) == 0) {
+		return nil, ErrTLSCertAndKeyRequired
+	}
+	if len(cfg.TLSClientCAFile) > 0 && len(cfg.TLSCertFile) == 0 {
+		return nil, ErrTLSClientCANeedsTLS
+	}
+
+	if len(cfg.TLSClientCAFile) > 0 {
+		caBytes, err := ioutil.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caBytes) {
+			return nil, ErrTLSClientCAInvalid
+		}
+		srv.TLSConfig = &tls.Config{
+			ClientCAs:  clientCAs,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+
+	return srv, nil
+}
+
+// Blocks until the server stops. Returns http.ErrServerClosed after a
+// graceful shutdown.
+func listenAndServe(srv *http.Server, cfg *config.Config) error {
+	if len(cfg.TLSCertFile) > 0 {
+		return srv.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	return srv.ListenAndServe()
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/film42/pgreba/config"
+)
+
+func TestNewHTTPServer_PlainHTTP(t *testing.T) {
+	srv, err := newHTTPServer(&config.Config{ListenAddress: ":9432"}, http.NotFoundHandler())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if srv.Addr != ":9432" {
+		t.Fatal("Expected the configured listen address but found:", srv.Addr)
+	}
+	if srv.TLSConfig != nil {
+		t.Fatal("Expected no tls config without a client CA")
+	}
+}
+
+func TestNewHTTPServer_InvalidTLSSettings(t *testing.T) {
+	_, err := newHTTPServer(&config.Config{TLSCertFile: "cert.pem"}, http.NotFoundHandler())
+	if err != ErrTLSCertAndKeyRequired {
+		t.Fatal("Expected a cert and key required err but found:", err)
+	}
+
+	_, err = newHTTPServer(&config.Config{TLSClientCAFile: "ca.pem"}, http.NotFoundHandler())
+	if err != ErrTLSClientCANeedsTLS {
+		t.Fatal("Expected a client CA needs tls err but found:", err)
+	}
+
+	dir, err := ioutil.TempDir("", "pgreba")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caFile := filepath.Join(dir, "ca.pem")
+	if err := ioutil.WriteFile(caFile, []byte("not a cert"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = newHTTPServer(&config.Config{TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", TLSClientCAFile: caFile}, http.NotFoundHandler())
+	if err != ErrTLSClientCAInvalid {
+		t.Fatal("Expected an invalid client CA err but found:", err)
+	}
+}
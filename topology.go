@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/film42/pgreba/conninfo"
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel/trace"
+	"gopkg.in/volatiletech/null.v6"
+)
+
+// The replication chain from this node up to the primary. The first node is
+// this node and, when complete, the last node is the primary.
+type Topology struct {
+	Nodes    []*TopologyNode `json:"nodes"`
+	Complete bool            `json:"complete"`
+}
+
+type TopologyNode struct {
+	Host        string      `json:"host"`
+	Port        string      `json:"port"`
+	Hop         int64       `json:"hop"`
+	Role        string      `json:"role"`
+	Timeline    null.Int64  `json:"timeline"`
+	CurrentLsn  null.String `json:"current_lsn"`
+	ReceivedLsn null.String `json:"received_lsn"`
+	ReplayedLsn null.String `json:"replayed_lsn"`
+	// Bytes between the WAL position of the upstream (the next node in the
+	// chain) and what this node has replayed.
+	ByteLagFromUpstream null.Int64         `json:"byte_lag_from_upstream"`
+	Standbys            []*TopologyStandby `json:"standbys"`
+	// Set when the upstream of this node could not be reached.
+	Error string `json:"error,omitempty"`
+}
+
+// A downstream standby as reported by pg_stat_replication.
+type TopologyStandby struct {
+	ApplicationName string      `json:"application_name" db:"application_name"`
+	ClientAddr      string      `json:"client_addr" db:"client_addr"`
+	State           string      `json:"state" db:"state"`
+	SyncState       string      `json:"sync_state" db:"sync_state"`
+	SentLsn         null.String `json:"sent_lsn" db:"sent_lsn"`
+	WriteLsn        null.String `json:"write_lsn" db:"write_lsn"`
+	FlushLsn        null.String `json:"flush_lsn" db:"flush_lsn"`
+	ReplayLsn       null.String `json:"replay_lsn" db:"replay_lsn"`
+	ReplayByteLag   null.Int64  `json:"replay_byte_lag" db:"replay_byte_lag"`
+}
+
+// The WAL position a downstream can catch up to: the current position on a
+// primary, or what a cascading standby has received.
+func (tn *TopologyNode) walPosition() null.String {
+	if tn.CurrentLsn.Valid {
+		return tn.CurrentLsn
+	}
+	if tn.ReceivedLsn.Valid {
+		return tn.ReceivedLsn
+	}
+	return tn.ReplayedLsn
+}
+
+func (ds *pgDataSource) GetTopology(ctx context.Context) (*Topology, error) {
+	defer observeQueryDuration("topology", time.Now())
+
+	db, dbErr := ds.getDB(ctx)
+	if dbErr != nil {
+		return nil, dbErr
+	}
+
+	cfg := ds.getConfig()
+	topology := &Topology{}
+	host := conninfo.Host{Host: cfg.Host, Port: cfg.Port}
+
+	// Upstream connections stay open until the walk is done, which is fine
+	// as the chain is at most MaxHop long.
+	for hop := int64(0); ; hop++ {
+		node, err := getTopologyNode(ctx, db)
+		if err != nil {
+			if hop == 0 {
+				return nil, err
+			}
+			topology.Nodes[hop-1].Error = err.Error()
+			break
+		}
+		node.Host = host.Host
+		node.Port = host.Port
+		node.Hop = hop
+		topology.Nodes = append(topology.Nodes, node)
+
+		if node.Role == "primary" {
+			topology.Complete = true
+			break
+		}
+		if hop >= cfg.MaxHop {
+			node.Error = "Reached max hop limit"
+			break
+		}
+
+		var upstreamDb *sqlx.DB
+		var span trace.Span
+		ctx, span, upstreamDb, host, err = ds.connectUpstreamHop(ctx, db, hop+1)
+		defer span.End()
+		if err != nil {
+			node.Error = err.Error()
+			break
+		}
+		defer upstreamDb.Close()
+		db = upstreamDb
+	}
+
+	// Lag between each node and the next one up the chain.
+	for i := 0; i+1 < len(topology.Nodes); i++ {
+		node, upstream := topology.Nodes[i], topology.Nodes[i+1]
+		byteLag, err := lsnDiff(upstream.walPosition(), node.ReplayedLsn)
+		if err != nil {
+			return nil, err
+		}
+		node.ByteLagFromUpstream = byteLag
+	}
+
+	return topology, nil
+}
+
+func getTopologyNode(ctx context.Context, db *sqlx.DB) (*TopologyNode, error) {
+	sql := `
+SELECT pg_catalog.pg_is_in_recovery() AS is_in_recovery,
+       CASE
+           WHEN pg_catalog.pg_is_in_recovery() THEN (SELECT received_tli FROM pg_catalog.pg_stat_wal_receiver)
+           ELSE ('x' || pg_catalog.substr(pg_catalog.pg_walfile_name(pg_catalog.pg_current_wal_lsn()), 1, 8))::bit(32)::int
+       END AS timeline,
+       CASE
+           WHEN pg_catalog.pg_is_in_recovery() THEN NULL
+           ELSE pg_catalog.pg_current_wal_lsn()::text
+       END AS current_lsn,
+       pg_catalog.pg_last_wal_receive_lsn()::text AS received_lsn,
+       pg_catalog.pg_last_wal_replay_lsn()::text AS replayed_lsn
+`
+	row := struct {
+		IsInRecovery bool        `db:"is_in_recovery"`
+		Timeline     null.Int64  `db:"timeline"`
+		CurrentLsn   null.String `db:"current_lsn"`
+		ReceivedLsn  null.String `db:"received_lsn"`
+		ReplayedLsn  null.String `db:"replayed_lsn"`
+	}{}
+	err := tracedGet(ctx, db, &row, sql)
+	if err != nil {
+		return nil, err
+	}
+
+	node := &TopologyNode{
+		Role:        "primary",
+		Timeline:    row.Timeline,
+		CurrentLsn:  row.CurrentLsn,
+		ReceivedLsn: row.ReceivedLsn,
+		ReplayedLsn: row.ReplayedLsn,
+		Standbys:    []*TopologyStandby{},
+	}
+	if row.IsInRecovery {
+		node.Role = "replica"
+	}
+
+	// Measure standbys against the position they can catch up to.
+	standbysSql := `
+SELECT application_name,
+       COALESCE(client_addr::text, '') AS client_addr,
+       COALESCE(state, '') AS state,
+       COALESCE(sync_state, '') AS sync_state,
+       sent_lsn::text AS sent_lsn,
+       write_lsn::text AS write_lsn,
+       flush_lsn::text AS flush_lsn,
+       replay_lsn::text AS replay_lsn,
+       pg_catalog.pg_wal_lsn_diff($1::pg_lsn, replay_lsn)::bigint AS replay_byte_lag
+FROM pg_catalog.pg_stat_replication
+`
+	err = tracedSelect(ctx, db, &node.Standbys, standbysSql, node.walPosition())
+	if err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// Parses a pg_lsn such as "16/B374D848" into a byte position.
+func parseLsn(lsn string) (uint64, error) {
+	parts := strings.Split(lsn, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("err: invalid lsn %q", lsn)
+	}
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("err: invalid lsn %q", lsn)
+	}
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("err: invalid lsn %q", lsn)
+	}
+	return hi<<32 | lo, nil
+}
+
+// The number of bytes from b to a, like pg_wal_lsn_diff(a, b). Null if either
+// side is unknown.
+func lsnDiff(a null.String, b null.String) (null.Int64, error) {
+	if !a.Valid || !b.Valid {
+		return null.Int64{}, nil
+	}
+	aPos, err := parseLsn(a.String)
+	if err != nil {
+		return null.Int64{}, err
+	}
+	bPos, err := parseLsn(b.String)
+	if err != nil {
+		return null.Int64{}, err
+	}
+	return null.Int64From(int64(aPos) - int64(bPos)), nil
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"testing"
+
+	"gopkg.in/volatiletech/null.v6"
+)
+
+func TestParseLsn(t *testing.T) {
+	pos, err := parseLsn("16/B374D848")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pos != 0x16B374D848 {
+		t.Fatalf("Unexpected lsn position: %X", pos)
+	}
+
+	for _, invalid := range []string{"", "16", "16/", "G/0", "1/2/3"} {
+		if _, err := parseLsn(invalid); err == nil {
+			t.Fatal("Expected an error parsing lsn:", invalid)
+		}
+	}
+}
+
+func TestLsnDiff(t *testing.T) {
+	diff, err := lsnDiff(null.StringFrom("1/0"), null.StringFrom("0/FFFFFF00"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !diff.Valid || diff.Int64 != 256 {
+		t.Fatal("Unexpected lsn diff:", diff)
+	}
+
+	diff, err = lsnDiff(null.StringFrom("1/0"), null.String{})
+	if err != nil || diff.Valid {
+		t.Fatal("Expected a null diff when one side is unknown:", diff, err)
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/film42/pgreba/config"
+	"github.com/gorilla/mux"
+	"github.com/jmoiron/sqlx"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Spans are started from this tracer everywhere. It does nothing until
+// setupTracing installs a provider.
+var tracer = otel.Tracer("github.com/film42/pgreba")
+
+var (
+	cacheHit  = attribute.Bool("pgreba.cache.hit", true)
+	cacheMiss = attribute.Bool("pgreba.cache.hit", false)
+)
+
+// Installs the global tracer provider when tracing is configured. The
+// returned func flushes the spans not yet exported and must be called on
+// shutdown.
+func setupTracing(ctx context.Context, cfg *config.Config) (func(context.Context) error, error) {
+	if cfg.Tracing == nil {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	var exporter sdktrace.SpanExporter
+	var err error
+	if cfg.Tracing.Exporter == "stdout" {
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout))
+	} else {
+		options := []otlptracehttp.Option{}
+		if len(cfg.Tracing.Endpoint) > 0 {
+			options = append(options, otlptracehttp.WithEndpointURL(cfg.Tracing.Endpoint))
+		}
+		exporter, err = otlptracehttp.New(ctx, options...)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES override the defaults.
+	res, err := resource.Merge(
+		resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("pgreba")),
+		resource.Environment(),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	sampleRatio := cfg.Tracing.SampleRatio
+	if sampleRatio == 0 {
+		sampleRatio = 1
+	}
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(sampleRatio))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	return provider.Shutdown, nil
+}
+
+// Wraps each request in a server span named after its route template, which
+// continues the caller's trace when it sent a traceparent header.
+func tracingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := r.URL.Path
+		if current := mux.CurrentRoute(r); current != nil {
+			if template, err := current.GetPathTemplate(); err == nil {
+				route = template
+			}
+		}
+
+		ctx := otel.GetTextMapPropagator().Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(r.Method),
+				semconv.HTTPRoute(route),
+				semconv.URLPath(r.URL.Path),
+				attribute.String("pgreba.request_id", requestID(ctx)),
+			),
+		)
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(ctx))
+
+		span.SetAttributes(semconv.HTTPResponseStatusCode(recorder.status))
+		if reason := w.Header().Get(reasonHeader); len(reason) > 0 {
+			span.SetAttributes(attribute.String("pgreba.reason", reason))
+		}
+		// A 503 only means the node isn't what was asked for.
+		if recorder.status >= 500 && recorder.status != http.StatusServiceUnavailable {
+			span.SetStatus(codes.Error, http.StatusText(recorder.status))
+		}
+	})
+}
+
+// Starts a span for a cachedDataSource lookup. It counts as a hit unless the
+// caller marks it with cacheMiss.
+func startCacheSpan(ctx context.Context, method string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "cache "+method, trace.WithAttributes(cacheHit))
+}
+
+// The first keyword of a statement, skipping tagQuery's comment, e.g.
+// "select".
+func queryOperation(sql string) string {
+	if end := strings.Index(sql, "*/"); strings.HasPrefix(sql, "/*") && end >= 0 {
+		sql = sql[end+2:]
+	}
+	fields := strings.Fields(sql)
+	if len(fields) == 0 {
+		return ""
+	}
+	return strings.ToLower(fields[0])
+}
+
+func startQuerySpan(ctx context.Context, sql string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "postgresql "+queryOperation(sql),
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(semconv.DBSystemPostgreSQL, semconv.DBQueryText(sql)),
+	)
+}
+
+func recordSpanError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+func endSpan(span trace.Span, err error) {
+	recordSpanError(span, err)
+	span.End()
+}
+
+// Like db.GetContext, with a span for the query.
+func tracedGet(ctx context.Context, db sqlx.QueryerContext, dest interface{}, sql string, args ...interface{}) error {
+	ctx, span := startQuerySpan(ctx, sql)
+	err := sqlx.GetContext(ctx, db, dest, sql, args...)
+	endSpan(span, err)
+	return err
+}
+
+// Like db.SelectContext, with a span for the query.
+func tracedSelect(ctx context.Context, db sqlx.QueryerContext, dest interface{}, sql string, args ...interface{}) error {
+	ctx, span := startQuerySpan(ctx, sql)
+	err := sqlx.SelectContext(ctx, db, dest, sql, args...)
+	endSpan(span, err)
+	return err
+}
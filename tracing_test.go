@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/film42/pgreba/config"
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func spanAttribute(span sdktrace.ReadOnlySpan, key attribute.Key) attribute.Value {
+	for _, kv := range span.Attributes() {
+		if kv.Key == key {
+			return kv.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func TestTracingSpans(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+
+	hcs := &HealthCheckWebService{
+		healthChecker: NewHealthChecker(NewCachedDataSource(&fakeDataSource{role: "primary"})),
+		cfg:           &config.Config{},
+	}
+	router := mux.NewRouter()
+	router.Use(requestIDMiddleware)
+	router.Use(tracingMiddleware)
+	hcs.registerRoutes(router)
+
+	for i := 0; i < 2; i++ {
+		router.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/replica", nil))
+	}
+
+	spans := recorder.Ended()
+	if len(spans) != 4 {
+		t.Fatal("Expected a request and a cache span per request but found", len(spans))
+	}
+	for i, hit := range []bool{false, true} {
+		cacheSpan, requestSpan := spans[i*2], spans[i*2+1]
+		if requestSpan.Name() != "GET /replica" || spanAttribute(requestSpan, "http.response.status_code").AsInt64() != 503 {
+			t.Fatal("Unexpected request span", requestSpan.Name(), requestSpan.Attributes())
+		}
+		if spanAttribute(requestSpan, "pgreba.reason").AsString() != "not a replica" {
+			t.Fatal("Expected the reason on the request span but found", requestSpan.Attributes())
+		}
+		if cacheSpan.Name() != "cache GetNodeInfo" || cacheSpan.Parent().SpanID() != requestSpan.SpanContext().SpanID() {
+			t.Fatal("Expected the cache span inside the request span but found", cacheSpan.Name())
+		}
+		if spanAttribute(cacheSpan, "pgreba.cache.hit").AsBool() != hit {
+			t.Fatalf("Expected request %d to hit the cache: %v", i, hit)
+		}
+	}
+}
+
+func TestQueryOperation(t *testing.T) {
+	cases := map[string]string{
+		"select 1":                           "select",
+		"\nSELECT pg_current_wal_lsn()":      "select",
+		"/* pgreba request_id=abc */ WITH x": "with",
+		"":                                   "",
+	}
+	for sql, expected := range cases {
+		if operation := queryOperation(sql); operation != expected {
+			t.Fatalf("Expected %q to be a %q but found %q", sql, expected, operation)
+		}
+	}
+}
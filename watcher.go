@@ -0,0 +1,259 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/film42/pgreba/config"
+)
+
+// How many timeline changes are kept in the history.
+const maxTimelineHistory = 100
+
+// A timeline this node was seen on, starting at Time.
+type TimelineChange struct {
+	Timeline int64     `json:"timeline"`
+	Role     string    `json:"role"`
+	Time     time.Time `json:"time"`
+}
+
+// Watches a node in the background and publishes an event whenever its role,
+// timeline, health or lag bucket changes, when a replica crosses
+// max_allowable_lag_seconds or pauses replay and when a replication slot is
+// lost. Also keeps the timeline history.
+type nodeWatcher struct {
+	instance   string
+	dataSource ReplicationDataSource
+	getConfig  func() *config.Config
+	events     *eventBus
+	interval   time.Duration
+	stop       chan struct{}
+
+	mutex        sync.Mutex
+	observed     bool
+	previous     *NodeInfo
+	role         string
+	timeline     int64
+	healthy      bool
+	lagBucket    string
+	lagExceeded  bool
+	replayPaused bool
+	diverged     error
+	lostSlots    map[string]bool
+	history      []*TimelineChange
+}
+
+func newNodeWatcher(instance string, dataSource ReplicationDataSource, getConfig func() *config.Config, events *eventBus, interval time.Duration) *nodeWatcher {
+	return &nodeWatcher{
+		instance:   instance,
+		dataSource: dataSource,
+		getConfig:  getConfig,
+		events:     events,
+		interval:   interval,
+		stop:       make(chan struct{}),
+		lostSlots:  make(map[string]bool),
+		history:    []*TimelineChange{},
+	}
+}
+
+func (nw *nodeWatcher) Start() {
+	go func() {
+		ctx := context.Background()
+		ticker := time.NewTicker(nw.interval)
+		defer ticker.Stop()
+		for {
+			nodeInfo, err := nw.dataSource.GetNodeInfo(ctx)
+			nw.observe(nodeInfo, err, time.Now())
+			if err == nil {
+				slots, err := nw.dataSource.GetPgReplicationSlots(ctx)
+				if err != nil {
+					slog.Error("Error watching replication slots", "instance", nw.instance, "error", err)
+				} else {
+					nw.observeSlots(nodeInfo, slots, time.Now())
+				}
+			}
+			select {
+			case <-nw.stop:
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func (nw *nodeWatcher) Close() error {
+	close(nw.stop)
+	return nil
+}
+
+// The timelines seen so far, oldest first.
+func (nw *nodeWatcher) History() []*TimelineChange {
+	nw.mutex.Lock()
+	defer nw.mutex.Unlock()
+	return append([]*TimelineChange{}, nw.history...)
+}
+
+// Whether a node is fit to serve its role: a primary always is, and a replica
+// is unless it diverged from its upstream or lags more than the configured
+// max_allowable_lag_seconds.
+func nodeHealth(nodeInfo *NodeInfo, cfg *config.Config) error {
+	if err := checkTimeline(nodeInfo); err != nil {
+		return err
+	}
+	if nodeInfo.IsReplica() && cfg.MaxAllowableLagSeconds > 0 && nodeInfo.LagSeconds.Valid &&
+		nodeInfo.LagSeconds.Float64 > cfg.MaxAllowableLagSeconds {
+		return fmt.Errorf("replica lags %.1fs, more than %.1fs", nodeInfo.LagSeconds.Float64, cfg.MaxAllowableLagSeconds)
+	}
+	return nil
+}
+
+// Coarse replica lag so small changes don't flood subscribers. Empty for
+// primaries.
+func lagBucket(nodeInfo *NodeInfo) string {
+	if !nodeInfo.IsReplica() {
+		return ""
+	}
+	if !nodeInfo.LagSeconds.Valid {
+		return "unknown"
+	}
+	switch lag := nodeInfo.LagSeconds.Float64; {
+	case lag < 1:
+		return "none"
+	case lag < 10:
+		return "low"
+	case lag < 60:
+		return "medium"
+	case lag < 300:
+		return "high"
+	default:
+		return "severe"
+	}
+}
+
+func (nw *nodeWatcher) observe(nodeInfo *NodeInfo, err error, now time.Time) {
+	nw.mutex.Lock()
+	defer nw.mutex.Unlock()
+
+	previous := nw.previous
+	firstObservation := !nw.observed
+	nw.observed = true
+	publish := func(eventType string, message string) {
+		if nw.events == nil {
+			return
+		}
+		nw.events.Publish(&Event{
+			Type:     eventType,
+			Time:     now,
+			Instance: nw.instance,
+			Message:  message,
+			Previous: previous,
+			Current:  nodeInfo,
+		})
+	}
+
+	if err != nil {
+		if nw.healthy || firstObservation {
+			publish(EventHealthChanged, "unhealthy: "+err.Error())
+		}
+		nw.healthy = false
+		nw.previous = nil
+		return
+	}
+
+	// Compared with the last known role, so a failover during an outage is
+	// still noticed.
+	if len(nw.role) > 0 && nw.role != nodeInfo.Role {
+		publish(EventRoleChanged, fmt.Sprintf("role changed from %s to %s", nw.role, nodeInfo.Role))
+	}
+	nw.role = nodeInfo.Role
+
+	// A replica's timeline is unknown while its wal receiver is down.
+	if nodeInfo.Timeline.Valid && nodeInfo.Timeline.Int64 != nw.timeline {
+		previousTimeline := nw.timeline
+		nw.timeline = nodeInfo.Timeline.Int64
+		nw.history = append(nw.history, &TimelineChange{Timeline: nw.timeline, Role: nodeInfo.Role, Time: now})
+		if len(nw.history) > maxTimelineHistory {
+			nw.history = nw.history[len(nw.history)-maxTimelineHistory:]
+		}
+		if previousTimeline != 0 {
+			publish(EventTimelineChanged, fmt.Sprintf("timeline changed from %d to %d, a promotion happened", previousTimeline, nw.timeline))
+		}
+	}
+
+	// Only publish when a replica starts diverging.
+	diverged := checkTimeline(nodeInfo)
+	if diverged != nil && diverged != nw.diverged {
+		eventType := EventTimelineDiverged
+		if diverged == ErrWalDiverged {
+			eventType = EventWalDiverged
+		}
+		publish(eventType, diverged.Error())
+	}
+	nw.diverged = diverged
+
+	cfg := nw.getConfig()
+	healthErr := nodeHealth(nodeInfo, cfg)
+	healthy := healthErr == nil
+	if healthy != nw.healthy || firstObservation {
+		if healthy {
+			publish(EventHealthChanged, "healthy "+nodeInfo.Role)
+		} else {
+			publish(EventHealthChanged, "unhealthy: "+healthErr.Error())
+		}
+	}
+	nw.healthy = healthy
+
+	bucket := lagBucket(nodeInfo)
+	if previous != nil && bucket != nw.lagBucket && len(bucket) > 0 {
+		publish(EventLagChanged, fmt.Sprintf("replica lag is %s", bucket))
+	}
+	nw.lagBucket = bucket
+
+	lagExceeded := nodeInfo.IsReplica() && cfg.MaxAllowableLagSeconds > 0 && nodeInfo.LagSeconds.Valid &&
+		nodeInfo.LagSeconds.Float64 > cfg.MaxAllowableLagSeconds
+	if lagExceeded && !nw.lagExceeded {
+		publish(EventLagExceeded, fmt.Sprintf("replica lags %.1fs, more than %.1fs", nodeInfo.LagSeconds.Float64, cfg.MaxAllowableLagSeconds))
+	} else if !lagExceeded && nw.lagExceeded && nodeInfo.IsReplica() {
+		publish(EventLagRecovered, "replica lag recovered")
+	}
+	nw.lagExceeded = lagExceeded
+
+	replayPaused := nodeInfo.IsReplica() && nodeInfo.Xlog.Paused
+	if replayPaused && !nw.replayPaused {
+		publish(EventReplayPaused, "wal replay is paused")
+	} else if !replayPaused && nw.replayPaused && nodeInfo.IsReplica() {
+		publish(EventReplayResumed, "wal replay resumed")
+	}
+	nw.replayPaused = replayPaused
+
+	nw.previous = nodeInfo
+}
+
+// Publishes an event for each replication slot whose wal_status became lost.
+func (nw *nodeWatcher) observeSlots(nodeInfo *NodeInfo, slots []*PgReplicationSlot, now time.Time) {
+	nw.mutex.Lock()
+	defer nw.mutex.Unlock()
+
+	lostSlots := make(map[string]bool)
+	for _, slot := range slots {
+		if slot.WalStatus.String != "lost" {
+			continue
+		}
+		lostSlots[slot.SlotName] = true
+		if !nw.lostSlots[slot.SlotName] && nw.events != nil {
+			nw.events.Publish(&Event{
+				Type:     EventSlotLost,
+				Time:     now,
+				Instance: nw.instance,
+				Slot:     slot.SlotName,
+				Message:  fmt.Sprintf("replication slot %s was lost", slot.SlotName),
+				Previous: nodeInfo,
+				Current:  nodeInfo,
+			})
+		}
+	}
+	nw.lostSlots = lostSlots
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/film42/pgreba/config"
+	"gopkg.in/volatiletech/null.v6"
+)
+
+func expectEvents(t *testing.T, subscription chan *Event, expected ...string) []*Event {
+	t.Helper()
+	found := []*Event{}
+	for _, eventType := range expected {
+		select {
+		case event := <-subscription:
+			if event.Type != eventType || event.Instance != "db1" {
+				t.Fatalf("Expected a %s event but found %s: %s", eventType, event.Type, event.Message)
+			}
+			found = append(found, event)
+		default:
+			t.Fatal("Expected a", eventType, "event")
+		}
+	}
+	select {
+	case event := <-subscription:
+		t.Fatal("Unexpected event:", event.Type, event.Message)
+	default:
+	}
+	return found
+}
+
+func TestNodeWatcherPublishesPromotionsAndDivergence(t *testing.T) {
+	events := newEventBus()
+	subscription := events.Subscribe(10)
+	nw := newNodeWatcher("db1", nil, func() *config.Config { return &config.Config{} }, events, time.Second)
+
+	now := time.Now()
+	replica := &NodeInfo{Role: "replica", Timeline: null.Int64From(1), UpstreamTimeline: null.Int64From(1), Xlog: &XlogInfo{}}
+	nw.observe(replica, nil, now)
+	nw.observe(replica, nil, now.Add(time.Second))
+
+	// A replica whose wal receiver is down has no timeline.
+	nw.observe(&NodeInfo{Role: "replica", Xlog: &XlogInfo{}}, nil, now.Add(2*time.Second))
+
+	promoted := &NodeInfo{Role: "primary", Timeline: null.Int64From(2), Xlog: &XlogInfo{}}
+	nw.observe(promoted, nil, now.Add(3*time.Second))
+
+	diverged := &NodeInfo{Role: "replica", Timeline: null.Int64From(2), UpstreamTimeline: null.Int64From(3), Xlog: &XlogInfo{}}
+	nw.observe(diverged, nil, now.Add(4*time.Second))
+	nw.observe(diverged, nil, now.Add(5*time.Second))
+
+	found := expectEvents(t, subscription,
+		EventHealthChanged,
+		EventRoleChanged, EventTimelineChanged,
+		EventRoleChanged, EventTimelineDiverged, EventHealthChanged, EventLagChanged)
+	if found[3].Previous != promoted || found[3].Current != diverged {
+		t.Fatal("Expected the event to carry both node infos:", found[3])
+	}
+
+	history := nw.History()
+	if len(history) != 2 || history[0].Timeline != 1 || history[1].Timeline != 2 || history[1].Role != "primary" {
+		t.Fatal("Unexpected history:", history)
+	}
+}
+
+func TestNodeWatcherPublishesHealthAndLagChanges(t *testing.T) {
+	events := newEventBus()
+	subscription := events.Subscribe(10)
+	cfg := &config.Config{MaxAllowableLagSeconds: 60}
+	nw := newNodeWatcher("db1", nil, func() *config.Config { return cfg }, events, time.Second)
+
+	replica := func(lag float64) *NodeInfo {
+		return &NodeInfo{Role: "replica", LagSeconds: null.Float64From(lag), Xlog: &XlogInfo{}}
+	}
+	now := time.Now()
+	nw.observe(replica(0.5), nil, now)
+	nw.observe(replica(0.7), nil, now.Add(time.Second))
+	nw.observe(replica(30), nil, now.Add(2*time.Second))
+	nw.observe(replica(90), nil, now.Add(3*time.Second))
+	nw.observe(nil, errors.New("err: connection refused"), now.Add(4*time.Second))
+	nw.observe(nil, errors.New("err: connection refused"), now.Add(5*time.Second))
+	nw.observe(replica(0.5), nil, now.Add(6*time.Second))
+
+	found := expectEvents(t, subscription,
+		EventHealthChanged,
+		EventLagChanged,
+		EventHealthChanged, EventLagChanged, EventLagExceeded,
+		EventHealthChanged, EventLagRecovered)
+	if found[1].Message != "replica lag is medium" || found[3].Message != "replica lag is high" {
+		t.Fatal("Unexpected lag events:", found[1].Message, found[3].Message)
+	}
+	if !strings.Contains(found[2].Message, "unhealthy") || found[2].Current.LagSeconds.Float64 != 90 {
+		t.Fatal("Expected the replica to become unhealthy:", found[2].Message)
+	}
+	// Already unhealthy, so losing the connection publishes nothing, and
+	// the lag bucket is only compared across successful checks.
+	if found[5].Message != "healthy replica" || found[5].Previous != nil {
+		t.Fatal("Expected the replica to recover:", found[5].Message)
+	}
+}
+
+func TestNodeWatcherPublishesReplayPausesAndLostSlots(t *testing.T) {
+	events := newEventBus()
+	subscription := events.Subscribe(10)
+	nw := newNodeWatcher("db1", nil, func() *config.Config { return &config.Config{} }, events, time.Second)
+
+	replica := func(paused bool) *NodeInfo {
+		return &NodeInfo{Role: "replica", Xlog: &XlogInfo{Paused: paused}}
+	}
+	slot := func(name string, walStatus string) *PgReplicationSlot {
+		return &PgReplicationSlot{SlotName: name, WalStatus: null.StringFrom(walStatus)}
+	}
+	now := time.Now()
+	nw.observe(replica(false), nil, now)
+	nw.observeSlots(replica(false), []*PgReplicationSlot{slot("a", "reserved"), slot("b", "lost")}, now)
+	nw.observe(replica(true), nil, now.Add(time.Second))
+	nw.observeSlots(replica(true), []*PgReplicationSlot{slot("a", "lost"), slot("b", "lost")}, now.Add(time.Second))
+	nw.observe(replica(true), nil, now.Add(2*time.Second))
+	nw.observe(replica(false), nil, now.Add(3*time.Second))
+
+	found := expectEvents(t, subscription,
+		EventHealthChanged, EventSlotLost, EventReplayPaused, EventSlotLost, EventReplayResumed)
+	if found[1].Slot != "b" || found[3].Slot != "a" {
+		t.Fatal("Unexpected lost slots:", found[1].Slot, found[3].Slot)
+	}
+}
+
+func TestEventsStream(t *testing.T) {
+	events := newEventBus()
+	server := httptest.NewServer(http.HandlerFunc(events.apiGetEvents))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL + "?instance=db1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatal("Unexpected content type:", resp.Header.Get("Content-Type"))
+	}
+
+	current := &NodeInfo{Role: "primary", Xlog: &XlogInfo{}}
+	events.Publish(&Event{Type: EventRoleChanged, Instance: "db2"})
+	events.Publish(&Event{Type: EventRoleChanged, Instance: "db1", Current: current})
+
+	reader := bufio.NewReader(resp.Body)
+	line, _ := reader.ReadString('\n')
+	if line != "event: role_changed\n" {
+		t.Fatalf("Unexpected line: %q", line)
+	}
+	line, _ = reader.ReadString('\n')
+	event := &Event{}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), event); err != nil {
+		t.Fatal(err)
+	}
+	if event.Instance != "db1" || event.Current.Role != "primary" || event.Previous != nil {
+		t.Fatal("Unexpected event:", event)
+	}
+
+	// Closing the bus ends the stream.
+	events.Close()
+	reader.ReadString('\n')
+	if _, err := reader.ReadString('\n'); err == nil {
+		t.Fatal("Expected the stream to end")
+	}
+}
+
+func TestEventBusDropsEventsForSlowSubscribers(t *testing.T) {
+	events := newEventBus()
+	slow := events.Subscribe(1)
+	fast := events.Subscribe(2)
+
+	events.Publish(&Event{Type: EventRoleChanged})
+	events.Publish(&Event{Type: EventTimelineChanged})
+
+	if len(slow) != 1 || len(fast) != 2 {
+		t.Fatal("Expected the slow subscriber to miss an event:", len(slow), len(fast))
+	}
+
+	events.Unsubscribe(slow)
+	if _, ok := <-slow; !ok {
+		t.Fatal("Expected buffered events to still be readable")
+	}
+	if _, ok := <-slow; ok {
+		t.Fatal("Expected the channel to be closed after unsubscribing")
+	}
+}
@@ -0,0 +1,754 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/film42/pgreba/config"
+	"github.com/gorilla/mux"
+	"gopkg.in/volatiletech/null.v6"
+)
+
+type HealthCheckWebService struct {
+	healthChecker *HealthChecker
+	cfg           *config.Config
+	cfgMutex      sync.RWMutex
+	// Optional, for the timeline history.
+	watcher *nodeWatcher
+	// Optional, for maintenance mode.
+	maintenance *maintenanceMode
+}
+
+func (hc *HealthCheckWebService) getConfig() *config.Config {
+	hc.cfgMutex.RLock()
+	defer hc.cfgMutex.RUnlock()
+	return hc.cfg
+}
+
+// Swaps in a reloaded config for checks which start after it.
+func (hc *HealthCheckWebService) Reload(cfg *config.Config) {
+	hc.cfgMutex.Lock()
+	defer hc.cfgMutex.Unlock()
+	hc.cfg = cfg
+}
+
+func (hc *HealthCheckWebService) registerRoutes(router *mux.Router) {
+	// HAProxy's httpchk sends OPTIONS unless told otherwise, and patroni answers
+	// all read-only methods, so we do the same.
+	methods := []string{"GET", "HEAD", "OPTIONS"}
+
+	// For primaries
+	router.HandleFunc("/", hc.apiGetIsPrimary).Methods(methods...)
+	router.HandleFunc("/primary", hc.apiGetIsPrimary).Methods(methods...)
+	router.HandleFunc("/read-write", hc.apiGetIsPrimary).Methods(methods...)
+
+	// For replicas
+	router.HandleFunc("/replica", hc.apiGetIsReplica).Methods(methods...)
+	router.HandleFunc("/read-only", hc.apiGetIsReadOnly).Methods(methods...)
+	router.HandleFunc("/standby-leader", hc.apiGetIsStandbyLeader).Methods(methods...)
+	router.HandleFunc("/synchronous", hc.apiGetIsSynchronous).Methods(methods...)
+	router.HandleFunc("/sync", hc.apiGetIsSynchronous).Methods(methods...)
+	router.HandleFunc("/asynchronous", hc.apiGetIsAsynchronous).Methods(methods...)
+	router.HandleFunc("/async", hc.apiGetIsAsynchronous).Methods(methods...)
+
+	// For any node
+	router.HandleFunc("/health", hc.apiGetHealth).Methods(methods...)
+	router.HandleFunc("/liveness", hc.apiGetLiveness).Methods(methods...)
+	router.HandleFunc("/readiness", hc.apiGetReadiness).Methods(methods...)
+	router.HandleFunc("/topology", hc.apiGetTopology).Methods("GET")
+	router.HandleFunc("/timeline", hc.apiGetTimeline).Methods(methods...)
+
+	// For taking the node out of rotation
+	router.HandleFunc("/maintenance", hc.apiGetMaintenance).Methods(methods...)
+	router.HandleFunc("/maintenance", hc.apiPostMaintenance).Methods("POST")
+	router.HandleFunc("/maintenance", hc.apiDeleteMaintenance).Methods("DELETE")
+
+	// For replication slots on the primary
+	router.HandleFunc("/slots", hc.apiGetSlots).Methods(methods...)
+	router.HandleFunc("/slot/{name}", hc.apiGetSlot).Methods(methods...)
+
+	// For logical replication
+	router.HandleFunc("/subscriptions", hc.apiGetSubscriptions).Methods(methods...)
+	router.HandleFunc("/subscription/{name}", hc.apiGetSubscription).Methods(methods...)
+	router.HandleFunc("/logical-slots", hc.apiGetLogicalSlots).Methods(methods...)
+	router.HandleFunc("/logical-slot/{name}", hc.apiGetLogicalSlot).Methods(methods...)
+}
+
+func (hc *HealthCheckWebService) apiGetIsPrimary(w http.ResponseWriter, r *http.Request) {
+	profile, err := hc.responseProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodeInfo, err := hc.getNodeInfo(r.Context(), profile)
+	if err != nil {
+		// Return a 500. Something bad happened.
+		reportCheck(w, r, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reason := ""
+	if !nodeInfo.IsPrimary() {
+		reason = "not a primary"
+	}
+	hc.writeRoleCheck(w, r, profile, nodeInfo, reason)
+}
+
+func (hc *HealthCheckWebService) apiGetIsReplica(w http.ResponseWriter, r *http.Request) {
+	profile, err := hc.responseProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lag, ok := hc.lagThresholds(w, r)
+	if !ok {
+		return
+	}
+	nodeInfo, err := hc.getNodeInfo(r.Context(), profile)
+	if err != nil {
+		// Return a 500. Something bad happened.
+		reportCheck(w, r, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// if not a replica OR byte lag exceeds max_allowable_byte_lag OR lag exceeds
+	// max_allowable_lag_seconds then return 503
+	reason := "not a replica"
+	if nodeInfo.IsReplica() {
+		reason = lag.reason(nodeInfo)
+	}
+	hc.writeRoleCheck(w, r, profile, nodeInfo, reason)
+}
+
+// A read-only node is any running node that can serve reads, so a primary or
+// a replica that is within the requested lag.
+func (hc *HealthCheckWebService) apiGetIsReadOnly(w http.ResponseWriter, r *http.Request) {
+	profile, err := hc.responseProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lag, ok := hc.lagThresholds(w, r)
+	if !ok {
+		return
+	}
+	nodeInfo, err := hc.getNodeInfo(r.Context(), profile)
+	if err != nil {
+		// Return a 500. Something bad happened.
+		reportCheck(w, r, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reason := ""
+	if nodeInfo.IsReplica() {
+		reason = lag.reason(nodeInfo)
+	} else if !nodeInfo.IsPrimary() {
+		reason = "not a primary or replica"
+	}
+	hc.writeRoleCheck(w, r, profile, nodeInfo, reason)
+}
+
+// Without a DCS we cannot know which node patroni would elect as the standby
+// leader, so standby_cluster has to say this cluster replicates from another
+// one. The standby leader is then the replica streaming straight from a
+// primary, while the other replicas cascade from it.
+func (hc *HealthCheckWebService) apiGetIsStandbyLeader(w http.ResponseWriter, r *http.Request) {
+	profile, err := hc.responseProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodeInfo, err := hc.getNodeInfo(r.Context(), profile)
+	if err != nil {
+		// Return a 500. Something bad happened.
+		reportCheck(w, r, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reason := ""
+	if !hc.getConfig().StandbyCluster {
+		reason = "not a standby cluster"
+	} else if !nodeInfo.IsReplica() {
+		reason = "not a replica"
+	} else {
+		topology, err := hc.healthChecker.dataSource.GetTopology(r.Context())
+		if err != nil {
+			// Return a 500. Something bad happened.
+			reportCheck(w, r, err.Error())
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(topology.Nodes) < 2 {
+			reason = "upstream unknown: " + topology.Nodes[0].Error
+		} else if topology.Nodes[1].Role != "primary" {
+			reason = "streams from a standby, not a primary"
+		}
+	}
+	hc.writeRoleCheck(w, r, profile, nodeInfo, reason)
+}
+
+func (hc *HealthCheckWebService) apiGetIsSynchronous(w http.ResponseWriter, r *http.Request) {
+	profile, err := hc.responseProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodeInfo, syncState, err := hc.getNodeInfoAndSyncState(r.Context(), profile)
+	if err != nil {
+		// Return a 500. Something bad happened.
+		reportCheck(w, r, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reason := ""
+	if !nodeInfo.IsReplica() {
+		reason = "not a replica"
+	} else if !isSynchronous(syncState) {
+		reason = "not a synchronous standby, " + describeSyncState(syncState)
+	}
+	hc.writeRoleCheck(w, r, profile, nodeInfo, reason)
+}
+
+func (hc *HealthCheckWebService) apiGetIsAsynchronous(w http.ResponseWriter, r *http.Request) {
+	profile, err := hc.responseProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	lag, ok := hc.lagThresholds(w, r)
+	if !ok {
+		return
+	}
+	nodeInfo, syncState, err := hc.getNodeInfoAndSyncState(r.Context(), profile)
+	if err != nil {
+		// Return a 500. Something bad happened.
+		reportCheck(w, r, err.Error())
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	reason := ""
+	if !nodeInfo.IsReplica() {
+		reason = "not a replica"
+	} else if isSynchronous(syncState) {
+		reason = "a synchronous standby, " + describeSyncState(syncState)
+	} else {
+		reason = lag.reason(nodeInfo)
+	}
+	hc.writeRoleCheck(w, r, profile, nodeInfo, reason)
+}
+
+// Health returns a 200 as long as postgres is up and answering queries. Only
+// the local node is asked, so an unreachable upstream doesn't fail it.
+func (hc *HealthCheckWebService) apiGetHealth(w http.ResponseWriter, r *http.Request) {
+	profile, err := hc.responseProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodeInfo, err := hc.healthChecker.dataSource.GetLocalNodeStatus(r.Context())
+	if err != nil {
+		reportCheck(w, r, err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	reportCheck(w, r, "")
+	writeNodeInfo(w, profile, nodeInfo, true)
+}
+
+// Liveness only reports that pgreba itself is running.
+func (hc *HealthCheckWebService) apiGetLiveness(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+}
+
+// Readiness returns a 200 when the node is running as a primary or replica.
+// Like health, it doesn't depend on the upstream.
+func (hc *HealthCheckWebService) apiGetReadiness(w http.ResponseWriter, r *http.Request) {
+	profile, err := hc.responseProfile(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nodeInfo, err := hc.healthChecker.dataSource.GetLocalNodeStatus(r.Context())
+	if err != nil {
+		reportCheck(w, r, err.Error())
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	reason := ""
+	if !nodeInfo.IsPrimary() && !nodeInfo.IsReplica() {
+		reason = "not a primary or replica"
+	}
+	hc.writeRoleCheck(w, r, profile, nodeInfo, reason)
+}
+
+// The replication chain from this node up to the primary.
+func (hc *HealthCheckWebService) apiGetTopology(w http.ResponseWriter, r *http.Request) {
+	topology, err := hc.healthChecker.dataSource.GetTopology(r.Context())
+	if err != nil {
+		// Return a 500. Something bad happened.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	json.NewEncoder(w).Encode(topology)
+}
+
+type TimelineStatus struct {
+	Role             string            `json:"role"`
+	Timeline         null.Int64        `json:"timeline"`
+	UpstreamTimeline null.Int64        `json:"upstream_timeline"`
+	ReceivedLocation int64             `json:"received_location"`
+	UpstreamLocation null.Int64        `json:"upstream_location"`
+	Healthy          bool              `json:"healthy"`
+	Reason           string            `json:"reason,omitempty"`
+	History          []*TimelineChange `json:"history"`
+}
+
+// Returns a 503 when a replica diverged from its upstream's timeline or WAL.
+// Primaries always pass.
+func (hc *HealthCheckWebService) apiGetTimeline(w http.ResponseWriter, r *http.Request) {
+	nodeInfo, err := hc.healthChecker.dataSource.GetNodeInfo(r.Context())
+	if err != nil {
+		// Return a 500. Something bad happened.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	status := &TimelineStatus{
+		Role:             nodeInfo.Role,
+		Timeline:         nodeInfo.Timeline,
+		UpstreamTimeline: nodeInfo.UpstreamTimeline,
+		ReceivedLocation: nodeInfo.Xlog.ReceivedLocation,
+		UpstreamLocation: nodeInfo.UpstreamLocation,
+		Healthy:          true,
+		History:          []*TimelineChange{},
+	}
+	if hc.watcher != nil {
+		status.History = hc.watcher.History()
+	}
+	if err := checkTimeline(nodeInfo); err != nil {
+		status.Healthy = false
+		status.Reason = err.Error()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+type ReplicationSlotStatus struct {
+	*PgReplicationSlot
+	SlotName string `json:"slot_name"`
+	Healthy  bool   `json:"healthy"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+func newReplicationSlotStatus(slot *PgReplicationSlot, err error) *ReplicationSlotStatus {
+	status := &ReplicationSlotStatus{PgReplicationSlot: slot, SlotName: slot.SlotName, Healthy: err == nil}
+	if err != nil {
+		status.Reason = err.Error()
+	}
+	return status
+}
+
+// Returns a 200 when the slot is healthy, a 404 when it does not exist and
+// otherwise a 503.
+func (hc *HealthCheckWebService) apiGetSlot(w http.ResponseWriter, r *http.Request) {
+	thresholds, err := hc.slotThresholds(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slotName := mux.Vars(r)["name"]
+	slot, err := hc.healthChecker.getReplicationSlotByName(r.Context(), slotName)
+	if err != nil {
+		// Return a 500. Something bad happened.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if slot == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&ReplicationSlotStatus{SlotName: slotName, Reason: ErrReplicationSlotNotFound.Error()})
+		return
+	}
+
+	status := newReplicationSlotStatus(slot, checkReplicationSlot(slot, thresholds))
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// Returns a 200 when every slot is healthy. Otherwise, 503.
+func (hc *HealthCheckWebService) apiGetSlots(w http.ResponseWriter, r *http.Request) {
+	thresholds, err := hc.slotThresholds(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slots, err := hc.healthChecker.dataSource.GetPgReplicationSlots(r.Context())
+	if err != nil {
+		// Return a 500. Something bad happened.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	healthy := true
+	statuses := []*ReplicationSlotStatus{}
+	for _, slot := range slots {
+		status := newReplicationSlotStatus(slot, checkReplicationSlot(slot, thresholds))
+		healthy = healthy && status.Healthy
+		statuses = append(statuses, status)
+	}
+
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// The query params take precedence over the configured defaults.
+func (hc *HealthCheckWebService) slotThresholds(r *http.Request) (SlotThresholds, error) {
+	cfg := hc.getConfig()
+	thresholds := SlotThresholds{}
+	var err error
+	if thresholds.MinSafeWalSize, err = queryByteSize(r, "min_safe_wal_size", cfg.MinSafeWalSize); err != nil {
+		return thresholds, err
+	}
+	if thresholds.MaxRetainedWalBytes, err = queryByteSize(r, "max_retained_wal_bytes", cfg.MaxRetainedWalBytes); err != nil {
+		return thresholds, err
+	}
+	return thresholds, nil
+}
+
+type SubscriptionStatus struct {
+	*PgStatSubscription
+	SubName string `json:"subname"`
+	Healthy bool   `json:"healthy"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+func newSubscriptionStatus(subscription *PgStatSubscription, err error) *SubscriptionStatus {
+	status := &SubscriptionStatus{PgStatSubscription: subscription, SubName: subscription.SubName, Healthy: err == nil}
+	if err != nil {
+		status.Reason = err.Error()
+	}
+	return status
+}
+
+// Returns a 200 when the subscription is healthy, a 404 when it does not exist
+// and otherwise a 503.
+func (hc *HealthCheckWebService) apiGetSubscription(w http.ResponseWriter, r *http.Request) {
+	thresholds, err := logicalThresholds(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	subName := mux.Vars(r)["name"]
+	subscription, err := hc.healthChecker.getSubscriptionByName(r.Context(), subName)
+	if err != nil {
+		// Return a 500. Something bad happened.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if subscription == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&SubscriptionStatus{SubName: subName, Reason: ErrSubscriptionNotFound.Error()})
+		return
+	}
+
+	status := newSubscriptionStatus(subscription, checkSubscription(subscription, thresholds))
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// Returns a 200 when every subscription is healthy. Otherwise, 503.
+func (hc *HealthCheckWebService) apiGetSubscriptions(w http.ResponseWriter, r *http.Request) {
+	thresholds, err := logicalThresholds(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	subscriptions, err := hc.healthChecker.dataSource.GetPgStatSubscription(r.Context())
+	if err != nil {
+		// Return a 500. Something bad happened.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	healthy := true
+	statuses := []*SubscriptionStatus{}
+	for _, subscription := range subscriptions {
+		status := newSubscriptionStatus(subscription, checkSubscription(subscription, thresholds))
+		healthy = healthy && status.Healthy
+		statuses = append(statuses, status)
+	}
+
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// Returns a 200 when the logical slot is healthy, a 404 when there is no
+// logical slot by that name and otherwise a 503.
+func (hc *HealthCheckWebService) apiGetLogicalSlot(w http.ResponseWriter, r *http.Request) {
+	thresholds, err := logicalThresholds(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slotName := mux.Vars(r)["name"]
+	slot, err := hc.healthChecker.getReplicationSlotByName(r.Context(), slotName)
+	if err != nil {
+		// Return a 500. Something bad happened.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if slot == nil || slot.SlotType != "logical" {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(&ReplicationSlotStatus{SlotName: slotName, Reason: ErrReplicationSlotNotFound.Error()})
+		return
+	}
+
+	status := newReplicationSlotStatus(slot, checkLogicalSlot(slot, thresholds))
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(status)
+}
+
+// Returns a 200 when every logical slot is healthy. Otherwise, 503.
+func (hc *HealthCheckWebService) apiGetLogicalSlots(w http.ResponseWriter, r *http.Request) {
+	thresholds, err := logicalThresholds(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	slots, err := hc.healthChecker.dataSource.GetPgReplicationSlots(r.Context())
+	if err != nil {
+		// Return a 500. Something bad happened.
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	healthy := true
+	statuses := []*ReplicationSlotStatus{}
+	for _, slot := range slots {
+		if slot.SlotType != "logical" {
+			continue
+		}
+		status := newReplicationSlotStatus(slot, checkLogicalSlot(slot, thresholds))
+		healthy = healthy && status.Healthy
+		statuses = append(statuses, status)
+	}
+
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// Logical replication thresholds are only taken from query params.
+func logicalThresholds(r *http.Request) (LogicalThresholds, error) {
+	thresholds := LogicalThresholds{}
+	var err error
+	if thresholds.MaxByteLag, err = queryByteSize(r, "max_allowable_byte_lag", 0); err != nil {
+		return thresholds, err
+	}
+	if thresholds.MaxLagSeconds, err = queryFloat(r, "max_allowable_lag_seconds", 0); err != nil {
+		return thresholds, err
+	}
+	if thresholds.MaxLatestEndAgeSeconds, err = queryFloat(r, "max_latest_end_age_seconds", 0); err != nil {
+		return thresholds, err
+	}
+	return thresholds, nil
+}
+
+func queryByteSize(r *http.Request, name string, defaultValue int64) (int64, error) {
+	valueString := r.URL.Query().Get(name)
+	if len(valueString) == 0 {
+		return defaultValue, nil
+	}
+
+	value, err := parseByteSize(valueString)
+	if err != nil {
+		return 0, fmt.Errorf("err: invalid %s: %v", name, err)
+	}
+	return value, nil
+}
+
+func queryFloat(r *http.Request, name string, defaultValue float64) (float64, error) {
+	valueString := r.URL.Query().Get(name)
+	if len(valueString) == 0 {
+		return defaultValue, nil
+	}
+
+	value, err := strconv.ParseFloat(valueString, 64)
+	if err != nil {
+		return 0, fmt.Errorf("err: invalid %s %q", name, valueString)
+	}
+	return value, nil
+}
+
+func (hc *HealthCheckWebService) getNodeInfoAndSyncState(ctx context.Context, profile responseProfile) (*NodeInfo, string, error) {
+	nodeInfo, err := hc.getNodeInfo(ctx, profile)
+	if err != nil {
+		return nil, "", err
+	}
+	if !nodeInfo.IsReplica() {
+		return nodeInfo, "", nil
+	}
+
+	syncState, err := hc.healthChecker.dataSource.GetSyncState(ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	return nodeInfo, syncState, nil
+}
+
+func isSynchronous(syncState string) bool {
+	return syncState == "sync" || syncState == "quorum"
+}
+
+func describeSyncState(syncState string) string {
+	if len(syncState) == 0 {
+		return "the upstream doesn't list it"
+	}
+	return "sync_state is " + syncState
+}
+
+// How far behind a replica may be. The query params take precedence over the
+// configured default.
+type lagThresholds struct {
+	// As given, for the reason. Empty disables the byte lag check.
+	maxByteLagParam string
+	maxByteLag      int64
+	// Zero disables the check.
+	maxLagSeconds float64
+}
+
+func parseLagThresholds(r *http.Request, cfg *config.Config) (*lagThresholds, error) {
+	thresholds := &lagThresholds{maxByteLagParam: maxAllowableByteLagParam(r)}
+	if len(thresholds.maxByteLagParam) > 0 {
+		maxByteLag, err := parseByteSize(thresholds.maxByteLagParam)
+		if err != nil {
+			return nil, err
+		}
+		thresholds.maxByteLag = maxByteLag
+	}
+
+	maxLagSeconds, err := queryFloat(r, "max_allowable_lag_seconds", cfg.MaxAllowableLagSeconds)
+	if err != nil {
+		return nil, err
+	}
+	thresholds.maxLagSeconds = maxLagSeconds
+	return thresholds, nil
+}
+
+// Parses the lag thresholds before anything is queried, answering a 400 when
+// they are malformed.
+func (hc *HealthCheckWebService) lagThresholds(w http.ResponseWriter, r *http.Request) (*lagThresholds, bool) {
+	thresholds, err := parseLagThresholds(r, hc.getConfig())
+	if err != nil {
+		reportCheck(w, r, err.Error())
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return thresholds, true
+}
+
+// Why a replica is too far behind, or empty when it isn't.
+func (lt *lagThresholds) reason(nodeInfo *NodeInfo) string {
+	if lt.byteLagExceeded(nodeInfo) {
+		return fmt.Sprintf("byte lag %d greater than %s", nodeInfo.ByteLag, lt.maxByteLagParam)
+	}
+	if lt.lagSecondsExceeded(nodeInfo) {
+		return fmt.Sprintf("lag %.1fs greater than %gs", nodeInfo.LagSeconds.Float64, lt.maxLagSeconds)
+	}
+	return ""
+}
+
+func maxAllowableByteLagParam(r *http.Request) string {
+	maxAllowableByteLagString := r.URL.Query().Get("max_allowable_byte_lag")
+
+	// Patroni spells this as lag, so existing checks can keep using it.
+	if len(maxAllowableByteLagString) == 0 {
+		maxAllowableByteLagString = r.URL.Query().Get("lag")
+	}
+	return maxAllowableByteLagString
+}
+
+func (lt *lagThresholds) byteLagExceeded(nodeInfo *NodeInfo) bool {
+	// If byte lag was not specified, assume the replica is up to date.
+	if len(lt.maxByteLagParam) == 0 {
+		return false
+	}
+	return nodeInfo.ByteLag > lt.maxByteLag
+}
+
+func (lt *lagThresholds) lagSecondsExceeded(nodeInfo *NodeInfo) bool {
+	// A zero threshold disables the check.
+	if lt.maxLagSeconds <= 0 {
+		return false
+	}
+
+	// If nothing has been replayed yet, assume the replica is up to date.
+	if !nodeInfo.LagSeconds.Valid {
+		return false
+	}
+
+	return nodeInfo.LagSeconds.Float64 > lt.maxLagSeconds
+}
+
+// Parses a byte count with an optional postgres style unit (kB, MB, GB, TB),
+// which is what patroni accepts for its lag param.
+func parseByteSize(size string) (int64, error) {
+	units := []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"kB", 1 << 10},
+		{"MB", 1 << 20},
+		{"GB", 1 << 30},
+		{"TB", 1 << 40},
+	}
+
+	multiplier := int64(1)
+	for _, unit := range units {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSpace(strings.TrimSuffix(size, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("err: invalid byte size %q", size)
+	}
+	return value * multiplier, nil
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/film42/pgreba/config"
+	"github.com/gorilla/mux"
+	"gopkg.in/volatiletech/null.v6"
+)
+
+func TestMaxAllowableLagSecondsExceeded(t *testing.T) {
+	nodeInfo := &NodeInfo{Role: "replica", LagSeconds: null.Float64From(5)}
+	exceeded := func(r *http.Request, cfg *config.Config, nodeInfo *NodeInfo) bool {
+		thresholds, err := parseLagThresholds(r, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return thresholds.lagSecondsExceeded(nodeInfo)
+	}
+
+	// No threshold configured or requested.
+	r := httptest.NewRequest("GET", "/replica", nil)
+	if exceeded(r, &config.Config{}, nodeInfo) {
+		t.Fatal("Expected the lag check to be disabled without a threshold")
+	}
+
+	// Configured default is used when the query param is missing.
+	if !exceeded(r, &config.Config{MaxAllowableLagSeconds: 2}, nodeInfo) {
+		t.Fatal("Expected the configured threshold to be exceeded")
+	}
+
+	// Query param takes precedence over the configured default.
+	r = httptest.NewRequest("GET", "/replica?max_allowable_lag_seconds=10", nil)
+	if exceeded(r, &config.Config{MaxAllowableLagSeconds: 2}, nodeInfo) {
+		t.Fatal("Expected the query param threshold to take precedence")
+	}
+
+	// Unknown lag is treated as up to date.
+	r = httptest.NewRequest("GET", "/replica?max_allowable_lag_seconds=1", nil)
+	if exceeded(r, &config.Config{}, &NodeInfo{Role: "replica"}) {
+		t.Fatal("Expected an unknown lag to pass the check")
+	}
+}
+
+func TestMalformedThresholdsAreRejected(t *testing.T) {
+	fds := &fakeDataSource{role: "replica"}
+	hcs := &HealthCheckWebService{healthChecker: NewHealthChecker(fds), cfg: &config.Config{}}
+	router := mux.NewRouter()
+	hcs.registerRoutes(router)
+
+	paths := []string{
+		"/replica?lag=lots",
+		"/replica?max_allowable_byte_lag=10XB",
+		"/read-only?max_allowable_lag_seconds=soon",
+		"/async?max_allowable_lag_seconds=soon",
+		"/slot/active?min_safe_wal_size=big",
+		"/slots?max_retained_wal_bytes=big",
+		"/subscription/cdc?max_latest_end_age_seconds=old",
+		"/subscriptions?max_allowable_lag_seconds=soon",
+		"/logical-slot/cdc?max_allowable_byte_lag=big",
+		"/logical-slots?max_allowable_byte_lag=big",
+	}
+	for _, path := range paths {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != http.StatusBadRequest {
+			t.Fatal(path, "returned", w.Code, "but expected a 400")
+		}
+	}
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/replica?lag=lots", nil))
+	if reason := w.Header().Get(reasonHeader); reason != `err: invalid byte size "lots"` {
+		t.Fatal("Expected the reason header to explain the 400 but found:", reason)
+	}
+}
+
+func TestParseByteSize(t *testing.T) {
+	cases := map[string]int64{
+		"1024":  1024,
+		"16kB":  16 * 1024,
+		"10MB":  10 * 1024 * 1024,
+		"1 GB":  1024 * 1024 * 1024,
+		"2TB":   2 * 1024 * 1024 * 1024 * 1024,
+		"0":     0,
+		"100kB": 100 * 1024,
+	}
+	for input, expected := range cases {
+		size, err := parseByteSize(input)
+		if err != nil {
+			t.Fatal("Unexpected error parsing", input, err)
+		}
+		if size != expected {
+			t.Fatal("Parsed", input, "as", size, "but expected", expected)
+		}
+	}
+
+	if _, err := parseByteSize("10 bananas"); err == nil {
+		t.Fatal("Expected an error for an invalid byte size")
+	}
+}
+
+func TestPatroniEndpointStatusCodes(t *testing.T) {
+	cases := []struct {
+		role      string
+		syncState string
+		path      string
+		expected  int
+	}{
+		{"primary", "", "/read-write", 200},
+		{"primary", "", "/read-only", 200},
+		{"primary", "", "/replica", 503},
+		{"primary", "", "/sync", 503},
+		{"replica", "", "/read-write", 503},
+		{"replica", "", "/read-only", 200},
+		{"replica", "", "/read-only?lag=1kB", 503},
+		{"replica", "sync", "/synchronous", 200},
+		{"replica", "sync", "/asynchronous", 503},
+		{"replica", "async", "/sync", 503},
+		{"replica", "async", "/async", 200},
+		{"replica", "", "/standby-leader", 503},
+		{"replica", "", "/health", 200},
+		{"replica", "", "/readiness", 200},
+		{"replica", "", "/liveness", 200},
+	}
+
+	for _, c := range cases {
+		fds := &fakeDataSource{role: c.role, syncState: c.syncState, byteLag: 4096}
+		hcs := &HealthCheckWebService{healthChecker: NewHealthChecker(fds), cfg: &config.Config{}}
+		router := mux.NewRouter()
+		hcs.registerRoutes(router)
+
+		for _, method := range []string{"GET", "OPTIONS"} {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(method, c.path, nil))
+			if w.Code != c.expected {
+				t.Fatal(method, c.path, "for a", c.role, "returned", w.Code, "but expected", c.expected)
+			}
+		}
+	}
+}
+
+func TestHealthWithoutUpstream(t *testing.T) {
+	fds := &fakeDataSource{role: "replica", upstreamErr: errors.New("err: upstream unreachable")}
+	hcs := &HealthCheckWebService{healthChecker: NewHealthChecker(fds), cfg: &config.Config{}}
+	router := mux.NewRouter()
+	hcs.registerRoutes(router)
+
+	cases := map[string]int{
+		"/health":                  200,
+		"/health?verbose=full":     200,
+		"/readiness":               200,
+		"/readiness?verbose=false": 200,
+		"/replica":                 500,
+	}
+	for path, expected := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != expected {
+			t.Fatal(path, "returned", w.Code, "but expected", expected)
+		}
+	}
+}
+
+func TestStandbyLeader(t *testing.T) {
+	cascading := &Topology{Nodes: []*TopologyNode{
+		{Host: "replica2", Role: "replica"},
+		{Host: "replica1", Hop: 1, Role: "replica"},
+		{Host: "primary1", Hop: 2, Role: "primary"},
+	}, Complete: true}
+	unreachable := &Topology{Nodes: []*TopologyNode{{Host: "replica1", Role: "replica", Error: "connection refused"}}}
+
+	cases := []struct {
+		fds            *fakeDataSource
+		standbyCluster bool
+		expected       int
+		reason         string
+	}{
+		{&fakeDataSource{role: "replica"}, false, 503, "not a standby cluster"},
+		{&fakeDataSource{role: "replica"}, true, 200, ""},
+		{&fakeDataSource{role: "primary"}, true, 503, "not a replica"},
+		{&fakeDataSource{role: "replica", topology: cascading}, true, 503, "streams from a standby, not a primary"},
+		{&fakeDataSource{role: "replica", topology: unreachable}, true, 503, "upstream unknown: connection refused"},
+	}
+	for _, c := range cases {
+		hcs := &HealthCheckWebService{healthChecker: NewHealthChecker(c.fds), cfg: &config.Config{StandbyCluster: c.standbyCluster}}
+		router := mux.NewRouter()
+		hcs.registerRoutes(router)
+
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", "/standby-leader", nil))
+		if w.Code != c.expected || w.Header().Get(reasonHeader) != c.reason {
+			t.Fatalf("Expected %d with %q but found %d with %q", c.expected, c.reason, w.Code, w.Header().Get(reasonHeader))
+		}
+	}
+}
+
+func TestSlotEndpointStatusCodes(t *testing.T) {
+	fds := &fakeDataSource{slots: []*PgReplicationSlot{
+		{SlotName: "active", Active: true, RetainedWalBytes: null.Int64From(2048)},
+		{SlotName: "inactive", Active: false},
+	}}
+	hcs := &HealthCheckWebService{healthChecker: NewHealthChecker(fds), cfg: &config.Config{}}
+	router := mux.NewRouter()
+	hcs.registerRoutes(router)
+
+	cases := map[string]int{
+		"/slot/active": 200,
+		"/slot/active?max_retained_wal_bytes=1kB": 503,
+		"/slot/inactive": 503,
+		"/slot/missing":  404,
+		"/slots":         503,
+	}
+	for path, expected := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != expected {
+			t.Fatal(path, "returned", w.Code, "but expected", expected)
+		}
+	}
+}
+
+func TestLogicalReplicationEndpointStatusCodes(t *testing.T) {
+	fds := &fakeDataSource{
+		slots: []*PgReplicationSlot{
+			{SlotName: "physical", SlotType: "physical", Active: true},
+			{SlotName: "cdc", SlotType: "logical", Active: true, ConfirmedFlushLagBytes: null.Int64From(2048)},
+		},
+		subscriptions: []*PgStatSubscription{
+			{SubName: "cdc", Pid: null.StringFrom("1234"), ApplyLagSeconds: null.Float64From(2)},
+		},
+	}
+	hcs := &HealthCheckWebService{healthChecker: NewHealthChecker(fds), cfg: &config.Config{}}
+	router := mux.NewRouter()
+	hcs.registerRoutes(router)
+
+	cases := map[string]int{
+		"/subscription/cdc":                             200,
+		"/subscription/cdc?max_allowable_lag_seconds=1": 503,
+		"/subscription/missing":                         404,
+		"/subscriptions":                                200,
+		"/logical-slot/cdc":                             200,
+		"/logical-slot/cdc?max_allowable_byte_lag=1kB":  503,
+		"/logical-slot/physical":                        404,
+		"/logical-slots?max_allowable_byte_lag=1kB":     503,
+	}
+	for path, expected := range cases {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != expected {
+			t.Fatal(path, "returned", w.Code, "but expected", expected)
+		}
+	}
+}
+
+func TestInstancesAreServedUnderTheirName(t *testing.T) {
+	router := mux.NewRouter()
+	for name, role := range map[string]string{"db1": "primary", "db2": "replica"} {
+		fds := &fakeDataSource{role: role}
+		mi := &monitoredInstance{
+			name: name,
+			ds:   fds,
+			hcs:  &HealthCheckWebService{healthChecker: NewHealthChecker(fds), cfg: &config.Config{}},
+		}
+		mi.registerRoutes(router.PathPrefix("/" + name).Subrouter())
+	}
+
+	expected := map[string]int{
+		"/db1/primary": http.StatusOK,
+		"/db1/replica": http.StatusServiceUnavailable,
+		"/db2/primary": http.StatusServiceUnavailable,
+		"/db2/replica": http.StatusOK,
+		"/primary":     http.StatusNotFound,
+	}
+	for path, status := range expected {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		if w.Code != status {
+			t.Fatalf("Expected %s to return %d but found %d", path, status, w.Code)
+		}
+	}
+}
+
+func TestTimelineEndpoint(t *testing.T) {
+	fds := &fakeDataSource{}
+	hcs := &HealthCheckWebService{healthChecker: NewHealthChecker(fds), cfg: &config.Config{}}
+	router := mux.NewRouter()
+	hcs.registerRoutes(router)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/timeline", nil))
+	if w.Code != http.StatusOK {
+		t.Fatal("Expected a primary to pass the timeline check but found:", w.Code)
+	}
+}
+
+// Counts the full node info queries, which include the replication summary.
+type countingDataSource struct {
+	*fakeDataSource
+	nodeInfoCalls int
+}
+
+func (cds *countingDataSource) GetNodeInfo(ctx context.Context) (*NodeInfo, error) {
+	cds.nodeInfoCalls++
+	return cds.fakeDataSource.GetNodeInfo(ctx)
+}
+
+func TestResponseProfiles(t *testing.T) {
+	cases := []struct {
+		profile       string
+		path          string
+		limit         string
+		status        int
+		fields        []string
+		nodeInfoCalls int
+	}{
+		{"", "/replica", "", 200, []string{"byte_lag", "lag_seconds", "postmaster_start_time", "replication", "role", "state", "timeline", "upstream_location", "upstream_timeline", "xlog"}, 1},
+		{"", "/replica?verbose=summary", "", 200, []string{"byte_lag", "lag_seconds", "role", "timeline"}, 0},
+		{"", "/replica?verbose=false", "", 200, nil, 0},
+		{"", "/replica?verbose=maybe", "", 400, nil, 0},
+		{"status", "/health", "", 200, nil, 0},
+		{"status", "/primary?verbose", "", 503, []string{"byte_lag", "lag_seconds", "postmaster_start_time", "replication", "role", "state", "timeline", "upstream_location", "upstream_timeline", "xlog"}, 1},
+		{"", "/replica?verbose=full", "summary", 200, []string{"byte_lag", "lag_seconds", "role", "timeline"}, 0},
+		{"summary", "/replica", "status", 200, nil, 0},
+	}
+
+	for _, c := range cases {
+		cds := &countingDataSource{fakeDataSource: &fakeDataSource{role: "replica"}}
+		hcs := &HealthCheckWebService{healthChecker: NewHealthChecker(cds), cfg: &config.Config{ResponseProfile: c.profile}}
+		router := mux.NewRouter()
+		hcs.registerRoutes(router)
+
+		r := httptest.NewRequest("GET", c.path, nil)
+		if len(c.limit) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), profileLimitContextKey{}, c.limit))
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Fatalf("%s with profile %q returned %d but expected %d", c.path, c.profile, w.Code, c.status)
+		}
+
+		var fields []string
+		if w.Code != 400 && w.Body.Len() > 0 {
+			body := map[string]interface{}{}
+			if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+				t.Fatal(err)
+			}
+			for field := range body {
+				fields = append(fields, field)
+			}
+			sort.Strings(fields)
+		}
+		if !reflect.DeepEqual(fields, c.fields) {
+			t.Fatalf("%s with profile %q returned %v but expected %v", c.path, c.profile, fields, c.fields)
+		}
+		if cds.nodeInfoCalls != c.nodeInfoCalls {
+			t.Fatalf("%s with profile %q queried the replication summary %d times", c.path, c.profile, cds.nodeInfoCalls)
+		}
+	}
+}